@@ -0,0 +1,225 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Admin API. When admin_api_listen names an address, the operator serves
+// a small authenticated JSON API so external automation and a future UI
+// can drive operations without kubectl access to the CRs:
+//
+//	POST /v1/backup         start a backup through the operation queue
+//	POST /v1/backup/cancel  cancel the running backup
+//	GET  /v1/backups        list the backups in the bucket
+//	GET  /v1/status         operator status (last backup, restore phases)
+//
+// Every request must carry "Authorization: Bearer <token>" matching the
+// token in the admin token Secret.
+const (
+	AdminAPIListenSetting   = "admin_api_listen"
+	AdminTokenSecretSetting = "admin_api_token_secret"
+	DefaultAdminTokenSecret = "gitlab-operator-admin-token"
+)
+
+// Cancellation registry for the running backup. Backup registers a cancel
+// function while it runs; CancelActiveBackup invokes it.
+var backupCancelMutex sync.Mutex
+var backupCancelFunc func()
+
+// SetBackupCancel registers (or, with nil, clears) the function that
+// cancels the backup currently in flight.
+func SetBackupCancel(cancel func()) {
+	backupCancelMutex.Lock()
+	defer backupCancelMutex.Unlock()
+	backupCancelFunc = cancel
+}
+
+// CancelActiveBackup cancels the running backup, if any.
+func CancelActiveBackup() error {
+	backupCancelMutex.Lock()
+	defer backupCancelMutex.Unlock()
+	if backupCancelFunc == nil {
+		return fmt.Errorf("no backup is running")
+	}
+	backupCancelFunc()
+	backupCancelFunc = nil
+	return nil
+}
+
+// Wraps a handler with bearer token authentication.
+func authenticated(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		header := request.Header.Get("Authorization")
+		presented := strings.TrimPrefix(header, "Bearer ")
+		if header == presented || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+func writeJSON(writer http.ResponseWriter, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(value)
+}
+
+func backupNowHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s3Bucket := operatorConfig.GetString("s3")
+	if s3Bucket == "" {
+		http.Error(writer, "no s3 bucket configured", http.StatusConflict)
+		return
+	}
+
+	EnqueueOperation("api backup", func() error {
+		return Backup(s3Bucket, nil)
+	})
+	writer.WriteHeader(http.StatusAccepted)
+	writeJSON(writer, map[string]string{"status": "queued"})
+}
+
+func cancelBackupHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := CancelActiveBackup()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(writer, map[string]string{"status": "cancelled"})
+}
+
+func pauseHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	PauseOperations()
+	writeJSON(writer, map[string]string{"status": "paused"})
+}
+
+func resumeHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ResumeOperations()
+	writeJSON(writer, map[string]string{"status": "resumed"})
+}
+
+func listBackupsHandler(writer http.ResponseWriter, request *http.Request) {
+	backups, err := ListBackups(operatorConfig.GetString("s3"))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(writer, backups)
+}
+
+// Reports the operator's status ConfigMap plus the phase of every
+// GitLabRestore in the namespace.
+func statusHandler(writer http.ResponseWriter, request *http.Request) {
+	namespace, err := GetNamespace()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := map[string]interface{}{}
+
+	_, clientset, err := GetInCluster()
+	if err == nil {
+		configMap, err := clientset.Core().ConfigMaps(namespace).Get(StatusConfigMapName, metav1.GetOptions{})
+		if err == nil {
+			status["operator"] = configMap.Data
+		}
+	}
+
+	restores := map[string]string{}
+	client, err := NewCRDClient("gitlabrestores", namespace)
+	if err == nil {
+		list, listErr := client.List(metav1.ListOptions{})
+		if items, ok := list.(*unstructured.UnstructuredList); listErr == nil && ok {
+			for i := range items.Items {
+				obj := &items.Items[i]
+				phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+				restores[obj.GetName()] = phase
+			}
+		}
+	}
+	status["restores"] = restores
+
+	writeJSON(writer, status)
+}
+
+// StartAdminAPIServer serves the admin API in the background. A no-op
+// unless admin_api_listen is configured; refuses to start without an
+// admin token Secret, since the API must never run unauthenticated.
+func StartAdminAPIServer() {
+	addr := operatorConfig.GetString(AdminAPIListenSetting)
+	if addr == "" {
+		return
+	}
+
+	namespace, err := GetNamespace()
+	if err != nil {
+		fmt.Printf("admin api disabled: %v\n", err)
+		return
+	}
+
+	secretName := operatorConfig.GetString(AdminTokenSecretSetting)
+	if secretName == "" {
+		secretName = DefaultAdminTokenSecret
+	}
+	token, err := readSecretKey(namespace, secretName, "token")
+	if err != nil {
+		fmt.Printf("admin api disabled, no token available: %v\n", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/backup", authenticated(token, backupNowHandler))
+	mux.HandleFunc("/v1/backup/cancel", authenticated(token, cancelBackupHandler))
+	mux.HandleFunc("/v1/backup/pause", authenticated(token, pauseHandler))
+	mux.HandleFunc("/v1/backup/resume", authenticated(token, resumeHandler))
+	mux.HandleFunc("/v1/backups", authenticated(token, listBackupsHandler))
+	mux.HandleFunc("/v1/status", authenticated(token, statusHandler))
+
+	fmt.Printf("Serving admin api on %v\n", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			fmt.Printf("admin api server failed: %v\n", err)
+		}
+	}()
+}
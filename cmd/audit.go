@@ -0,0 +1,107 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit log of every command the operator runs inside a pod. Set
+// audit_log to a file path to append one JSON record per exec, or to "-"
+// to write the records to stdout. Disabled when unset.
+const AuditLogSetting = "audit_log"
+
+// auditRecord is one exec the operator performed: what ran, where, on
+// whose behalf, and how it went.
+type auditRecord struct {
+	Time      string   `json:"time"`
+	Context   string   `json:"context,omitempty"`
+	Namespace string   `json:"namespace"`
+	Pod       string   `json:"pod"`
+	Container string   `json:"container"`
+	Command   []string `json:"command"`
+	Duration  float64  `json:"durationSeconds"`
+	Error     string   `json:"error,omitempty"`
+}
+
+var (
+	auditMutex sync.Mutex
+
+	// What the operator is currently doing, recorded with each exec so
+	// the log reads "backup of gitlab ran gitlab-rake ..." rather than a
+	// bare command.
+	auditContext string
+)
+
+// SetAuditContext names the operation on whose behalf subsequent execs
+// run (e.g. the queued operation or reconciled resource). An empty string
+// clears it.
+func SetAuditContext(context string) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	auditContext = context
+}
+
+// auditExec appends one record to the audit log. Best effort: a broken
+// audit destination is reported but never fails the exec itself.
+func auditExec(namespace, podName, containerName string, command []string, start time.Time, execErr error) {
+	destination := operatorConfig.GetString(AuditLogSetting)
+	if destination == "" {
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	record := auditRecord{
+		Time:      start.UTC().Format(time.RFC3339),
+		Context:   auditContext,
+		Namespace: namespace,
+		Pod:       podName,
+		Container: containerName,
+		Command:   command,
+		Duration:  time.Since(start).Seconds(),
+	}
+	if execErr != nil {
+		record.Error = execErr.Error()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		fmt.Printf("unable to write audit record: %v\n", err)
+		return
+	}
+
+	if destination == "-" {
+		fmt.Printf("%s\n", data)
+		return
+	}
+
+	file, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Printf("unable to write audit record: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		fmt.Printf("unable to write audit record: %v\n", err)
+	}
+}
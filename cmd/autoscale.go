@@ -0,0 +1,246 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Horizontal scaling for scaled-out installs. The operator already probes
+// Sidekiq queue depth and can time a request against the web service; this
+// controller turns those into replica recommendations for the Deployments
+// named by sidekiq_deployment and web_deployment, clamped to the
+// configured min/max. Recommendations always land in the GitLab CR status
+// (recommendedSidekiqReplicas / recommendedWebReplicas); with
+// autoscale_apply set the operator edits the Deployments' replica counts
+// itself. Disabled unless autoscale_interval is set.
+const (
+	AutoscaleIntervalSetting = "autoscale_interval"
+	AutoscaleApplySetting    = "autoscale_apply"
+
+	SidekiqDeploymentSetting = "sidekiq_deployment"
+	WebDeploymentSetting     = "web_deployment"
+
+	SidekiqMinReplicasSetting = "sidekiq_min_replicas"
+	SidekiqMaxReplicasSetting = "sidekiq_max_replicas"
+	WebMinReplicasSetting     = "web_min_replicas"
+	WebMaxReplicasSetting     = "web_max_replicas"
+
+	// One Sidekiq replica per this many enqueued jobs.
+	QueuePerReplicaSetting = "autoscale_queue_per_replica"
+	DefaultQueuePerReplica = 1000
+	// Web replicas are added while request latency exceeds this.
+	LatencyTargetSetting = "autoscale_latency_target"
+	DefaultLatencyTarget = time.Second
+)
+
+// Times one request against the instance's readiness endpoint, as a cheap
+// stand-in for request latency. Returns -1 when the probe fails.
+func probeRequestLatency(namespace, podName string) time.Duration {
+	options := ExecOptions{
+		Command: []string{"sh", "-c",
+			"curl -s -o /dev/null -w '%{time_total}' http://localhost/-/readiness"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return -1
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(stdout), 64)
+	if err != nil {
+		return -1
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Clamps a replica count to the configured bounds, with sane fallbacks
+// when the bounds are unset.
+func clampReplicas(desired, min, max int) int {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if desired < min {
+		return min
+	}
+	if desired > max {
+		return max
+	}
+	return desired
+}
+
+// Current replica count of a Deployment, or -1 when it cannot be read.
+func deploymentReplicas(namespace, name string) int {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return -1
+	}
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{})
+	if err != nil || deployment.Spec.Replicas == nil {
+		return -1
+	}
+	return int(*deployment.Spec.Replicas)
+}
+
+// Sets a Deployment's replica count. Gated on autoscale_apply by the
+// caller.
+func scaleDeployment(namespace, name string, replicas int) {
+	if DryRun {
+		fmt.Printf("Dry run: would scale deployment %v/%v to %v replicas\n", namespace, name, replicas)
+		return
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		fmt.Printf("unable to scale %v: %v\n", name, err)
+		return
+	}
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		fmt.Printf("unable to scale %v: %v\n", name, err)
+		return
+	}
+
+	count := int32(replicas)
+	deployment.Spec.Replicas = &count
+	_, err = clientset.AppsV1().Deployments(namespace).Update(deployment)
+	if err != nil {
+		fmt.Printf("unable to scale %v: %v\n", name, err)
+		return
+	}
+	fmt.Printf("Scaled deployment %v/%v to %v replicas\n", namespace, name, replicas)
+}
+
+// Computes and publishes scaling recommendations for one namespace, and
+// applies them when autoscale_apply is set.
+func autoscaleNamespace(namespace string) {
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return
+	}
+
+	// Sidekiq: one replica per queue_per_replica enqueued jobs.
+	sidekiqName := operatorConfig.GetString(SidekiqDeploymentSetting)
+	recommendedSidekiq := -1
+	if depth := probeSidekiqDepth(namespace, podName); depth >= 0 {
+		perReplica := operatorConfig.GetInt(QueuePerReplicaSetting)
+		if perReplica <= 0 {
+			perReplica = DefaultQueuePerReplica
+		}
+		desired := int(depth)/perReplica + 1
+		recommendedSidekiq = clampReplicas(desired,
+			operatorConfig.GetInt(SidekiqMinReplicasSetting),
+			operatorConfig.GetInt(SidekiqMaxReplicasSetting))
+		setHealthMetric("gitlab_operator_recommended_sidekiq_replicas", float64(recommendedSidekiq))
+	}
+
+	// Web: step up one replica while latency is above target, down one
+	// while comfortably below, instead of chasing a ratio.
+	webName := operatorConfig.GetString(WebDeploymentSetting)
+	recommendedWeb := -1
+	if webName != "" {
+		if current := deploymentReplicas(namespace, webName); current > 0 {
+			target := operatorConfig.GetDuration(LatencyTargetSetting)
+			if target <= 0 {
+				target = DefaultLatencyTarget
+			}
+			latency := probeRequestLatency(namespace, podName)
+			desired := current
+			if latency > target {
+				desired = current + 1
+			} else if latency >= 0 && latency < target/2 {
+				desired = current - 1
+			}
+			recommendedWeb = clampReplicas(desired,
+				operatorConfig.GetInt(WebMinReplicasSetting),
+				operatorConfig.GetInt(WebMaxReplicasSetting))
+			setHealthMetric("gitlab_operator_recommended_web_replicas", float64(recommendedWeb))
+		}
+	}
+
+	// Publish on the CR status so the recommendations are visible even
+	// when the operator is not applying them.
+	if client, err := NewCRDClient("gitlabs", namespace); err == nil {
+		if list, err := client.List(metav1.ListOptions{}); err == nil {
+			if items, ok := list.(*unstructured.UnstructuredList); ok {
+				for i := range items.Items {
+					obj := &items.Items[i]
+					if recommendedSidekiq > 0 {
+						SetStatusField(client, obj, "recommendedSidekiqReplicas", int64(recommendedSidekiq))
+					}
+					if recommendedWeb > 0 {
+						SetStatusField(client, obj, "recommendedWebReplicas", int64(recommendedWeb))
+					}
+				}
+			}
+		}
+	}
+
+	if !operatorConfig.GetBool(AutoscaleApplySetting) {
+		return
+	}
+	if sidekiqName != "" && recommendedSidekiq > 0 && deploymentReplicas(namespace, sidekiqName) != recommendedSidekiq {
+		scaleDeployment(namespace, sidekiqName, recommendedSidekiq)
+	}
+	if webName != "" && recommendedWeb > 0 && deploymentReplicas(namespace, webName) != recommendedWeb {
+		scaleDeployment(namespace, webName, recommendedWeb)
+	}
+}
+
+// Runs the autoscaler at the configured interval in every watched
+// namespace. Disabled unless autoscale_interval is set.
+func runAutoscaleController(stop <-chan struct{}) {
+	interval := operatorConfig.GetDuration(AutoscaleIntervalSetting)
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		namespaces, err := WatchNamespaces()
+		if err != nil {
+			fmt.Printf("autoscale controller: %v\n", err)
+			continue
+		}
+		for _, namespace := range namespaces {
+			autoscaleNamespace(namespace)
+		}
+	}
+}
+
+func init() {
+	RegisterController(runAutoscaleController)
+}
@@ -0,0 +1,152 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// AWS credential handling. The default session chain works for static
+// keys and instance profiles, but clusters increasingly hand out
+// credentials through IRSA (a projected web identity token plus a role to
+// assume) or require assuming a role with an external ID. These settings
+// make each of those explicit:
+//
+//	aws_region                   region override
+//	aws_profile                  named profile from the shared config
+//	aws_role_arn                 role to assume for object storage access
+//	aws_external_id              external ID presented when assuming the role
+//	aws_web_identity_token_file  IRSA token file; with aws_role_arn set,
+//	                             the role is assumed via the web identity
+//	                             (AWS_WEB_IDENTITY_TOKEN_FILE also works)
+const (
+	AWSRegionSetting        = "aws_region"
+	AWSProfileSetting       = "aws_profile"
+	AWSRoleARNSetting       = "aws_role_arn"
+	AWSExternalIDSetting    = "aws_external_id"
+	AWSWebIdentitySetting   = "aws_web_identity_token_file"
+	awsRoleSessionName      = "gitlab-operator"
+	webIdentityExpiryWindow = 5 * time.Minute
+)
+
+// webIdentityProvider resolves credentials by assuming a role with a web
+// identity token, the way IRSA expects. The vendored SDK predates the
+// upstream provider, so it is small enough to carry ourselves.
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client    *sts.STS
+	roleARN   string
+	tokenFile string
+}
+
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to read web identity token %v: %v", p.tokenFile, err)
+	}
+
+	result, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(awsRoleSessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to assume role %v with web identity: %v", p.roleARN, err)
+	}
+
+	p.SetExpiration(aws.TimeValue(result.Credentials.Expiration), webIdentityExpiryWindow)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(result.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(result.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(result.Credentials.SessionToken),
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
+
+// newAWSSession builds the session every object storage call uses,
+// honoring the region, profile, assume-role, and web identity settings.
+func newAWSSession() (*session.Session, error) {
+	config := aws.NewConfig()
+	if region := operatorConfig.GetString(AWSRegionSetting); region != "" {
+		config = config.WithRegion(region)
+	}
+
+	options := session.Options{Config: *config}
+	if profile := operatorConfig.GetString(AWSProfileSetting); profile != "" {
+		options.Profile = profile
+	}
+
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	roleARN := operatorConfig.GetString(AWSRoleARNSetting)
+	if roleARN == "" {
+		return sess, nil
+	}
+
+	tokenFile := operatorConfig.GetString(AWSWebIdentitySetting)
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+
+	if tokenFile != "" {
+		sess.Config.Credentials = credentials.NewCredentials(&webIdentityProvider{
+			client:    sts.New(sess),
+			roleARN:   roleARN,
+			tokenFile: tokenFile,
+		})
+		return sess, nil
+	}
+
+	sess.Config.Credentials = stscreds.NewCredentials(sess, roleARN, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = awsRoleSessionName
+		if externalID := operatorConfig.GetString(AWSExternalIDSetting); externalID != "" {
+			provider.ExternalID = aws.String(externalID)
+		}
+	})
+	return sess, nil
+}
+
+// CheckAWSCredentials resolves credentials once and fails with an
+// actionable message when the chain is misconfigured, so the operator
+// stops at startup instead of three hours into a backup.
+func CheckAWSCredentials() error {
+	sess, err := newAWSSession()
+	if err != nil {
+		return fmt.Errorf("unable to build AWS session: %v", err)
+	}
+
+	value, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return fmt.Errorf("unable to resolve AWS credentials: %v "+
+			"(set static keys, an instance profile, aws_profile, or aws_role_arn with a web identity token)", err)
+	}
+
+	fmt.Printf("Using AWS credentials from %v\n", value.ProviderName)
+	return nil
+}
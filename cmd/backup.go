@@ -16,81 +16,251 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// Components gitlab-rake gitlab:backup:create knows how to skip.
+var validBackupSkips = []string{"db", "repositories", "uploads", "builds", "artifacts", "lfs", "registry", "pages"}
+
+// Checks that every requested skip is one gitlab-rake understands.
+func validateBackupSkips(skips []string) error {
+	for _, skip := range skips {
+		valid := false
+		for _, candidate := range validBackupSkips {
+			if skip == candidate {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown backup component %q; valid components are %v", skip, validBackupSkips)
+		}
+	}
+	return nil
+}
+
+// Terminates the rake backup process in the target pod so a canceled
+// backup does not keep writing to the backup directory. Best effort.
+func killRemoteBackup(namespace, podName, containerName string) {
+	options := ExecOptions{
+		Command:       []string{"pkill", "-f", "gitlab:backup:create"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: containerName,
+		CaptureStderr: true,
+	}
+	err := ExecWithOptions(options)
+	if err != nil {
+		fmt.Printf("unable to kill remote backup process: %v\n", err)
+	}
+}
+
 // Find the one expected pod with the label selector in this namespace and run
-// GitLab backup on it. Store the result in an s3 bucket.
-func Backup(s3Bucket string) error {
+// GitLab backup on it. Store the result in an s3 bucket. skips names the
+// components to leave out of the backup, e.g. hourly db-only backups with
+// everything else skipped.
+func Backup(s3Bucket string, skips []string) error {
+	err := validateBackupSkips(skips)
+	if err != nil {
+		return err
+	}
+
+	// Components already living in object storage are skipped and recorded
+	// as references instead of being tarred up.
+	refs := parseObjectStorageRefs()
+	skips = appendObjectStorageSkips(skips, refs)
+
 	namespace, err := GetNamespace()
 	if err != nil {
 		return err
 	}
 
-	key, value := GitLabLabelKey, GitLabLabelValue
-	podNames, err := GetPodsWithLabel(namespace, key, value)
+	topology := CurrentTopology()
+	podName, containerName, err := topology.BackupTarget(namespace)
 	if err != nil {
 		return err
-	} else if len(podNames) != 1 {
-		return fmt.Errorf("there were %v pods with label %v=%v when exactly one was expected\n", len(podNames), key, value)
 	}
 
-	fmt.Printf("Begining backup of GitLab instance %v, %v\n", namespace, podNames[0])
+	// Hold the backup until the configured window opens and CI traffic has
+	// died down.
+	err = waitForBackupWindow(namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Begining backup of GitLab instance %v, %v (%v topology)\n", namespace, podName, topology.Name())
+	EmitNormalEvent(namespace, podName, EventBackupStarted, "GitLab backup started")
+	start := time.Now()
+
+	// Persist what we are doing so a restarted operator can clean up after
+	// us if this process dies mid-backup.
+	inflight := inflightOperation{
+		Operation:     "backup",
+		Phase:         InflightPhaseRunning,
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: containerName,
+		Bucket:        s3Bucket,
+		StartedAt:     start,
+	}
+	recordInflight(inflight)
+	defer clearInflight()
+
+	// Keep drains and autoscaler scale-downs away from the pod while the
+	// backup runs.
+	ProtectPodFromDisruption(namespace, podName, "backup")
+	defer UnprotectPodFromDisruption(namespace, podName)
+
+	// Register with the cancellation registry so the admin API can abort
+	// this backup. Cancelling kills the remote rake process; the stage
+	// checks below stop the workflow at the next boundary.
+	canceled := make(chan struct{})
+	SetBackupCancel(func() {
+		close(canceled)
+		killRemoteBackup(namespace, podName, containerName)
+	})
+	defer SetBackupCancel(nil)
+
+	checkCanceled := func() error {
+		select {
+		case <-canceled:
+			return fmt.Errorf("backup canceled")
+		default:
+			return nil
+		}
+	}
 
 	options := ExecOptions{
 		Command:       nil,
 		Namespace:     namespace,
-		PodName:       podNames[0],
-		ContainerName: GitLabContainerName,
+		PodName:       podName,
+		ContainerName: containerName,
 		CaptureStdout: true,
 		CaptureStderr: true,
 	}
 
+	err = PreflightBackupCheck(namespace, podName, containerName, topology.BackupDir(), skips)
+	if err != nil {
+		return err
+	}
+
+	err = RunHook(HookPreBackup, namespace, podName, containerName)
+	if err != nil {
+		return err
+	}
+
 	// Remove the contents of the backup directory to avoid resource
 	// exhaustion and simplify identifying the backup we are about
 	// to generate.
-	options.Command = []string{"rm", "-f", GitLabRemoteRakeDir + "/*"}
+	options.Command = []string{"rm", "-f", topology.BackupDir() + "/*"}
 	err = ExecWithOptions(options)
 	if err != nil {
 		return err
 	}
 
-	// Run the gitlab rake backup command. It will place a tarball
-	// in GitLabRemoteRakeDir
-	options.Command = []string{"gitlab-rake", "gitlab:backup:create"}
+	// Run the topology's backup command. It will place a tarball in the
+	// topology's backup directory.
+	options.Command = topology.BackupCommand(skips)
 	err = ExecWithOptions(options)
 	if err != nil {
 		return err
 	}
 
-	// Backup additional GitLab configuration. Place the resulting
-	// tarball in the same directory as the rake backup.
-	options.Command = []string{"tar", "czf", GitLabRemoteEtcFile, "/etc/gitlab"}
-	err = ExecWithOptions(options)
-	if err != nil {
+	// Backup additional GitLab configuration, when the topology keeps any
+	// on disk. Place the resulting tarball in the same directory as the
+	// rake backup.
+	if command := topology.ConfigBackupCommand(); command != nil {
+		options.Command = command
+		err = ExecWithOptions(options)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = checkCanceled(); err != nil {
 		return err
 	}
 
-	// Create a tarball of the remote backup dir and save it locally.
-	localFilename := GitLabLocalBackupPrefix + time.Now().UTC().Format(time.RFC3339) + ".tar.gz"
+	// Create a tarball of the remote backup dir and save it locally,
+	// staged on the dedicated volume when one is configured.
+	CleanupStaging()
+	taken := time.Now().UTC()
+	localFilename := GitLabLocalBackupPrefix + taken.Format(time.RFC3339) + CurrentCompression().Extension
+	s3Key := backupObjectKey(taken.Format(time.RFC3339), taken)
+	localPath := stagingPath(localFilename)
+	inflight.Phase = InflightPhaseCopying
+	inflight.Key = s3Key
+	inflight.LocalPath = localPath
+	recordInflight(inflight)
 	src := fileSpec{PodNamespace: namespace,
-		PodName: podNames[0],
-		File:    GitLabRemoteRakeDir,
+		PodName: podName,
+		File:    topology.BackupDir(),
 	}
 	dest := fileSpec{
-		File: localFilename,
+		File: localPath,
 	}
 	err = CopyFromPod(src, dest)
 	if err != nil {
 		return err
 	}
 
-	err = UploadToS3(s3Bucket, localFilename)
+	if err = checkCanceled(); err != nil {
+		os.Remove(localPath)
+		return err
+	}
+
+	var backupSize int64
+	if info, err := os.Stat(localPath); err == nil {
+		backupSize = info.Size()
+	}
+	checksum, _ := FileChecksum(localPath)
+
+	result := BackupResult{
+		Timestamp:     start,
+		Size:          backupSize,
+		Destination:   s3Bucket + "/" + s3Key,
+		Checksum:      checksum,
+		GitLabVersion: gitLabVersion(namespace, podName, containerName),
+	}
+	if len(refs) > 0 {
+		result.ObjectStorageRefs = refs
+	}
+
+	inflight.Phase = InflightPhaseUploading
+	recordInflight(inflight)
+	err = UploadBackupEverywhere(s3Bucket, s3Key, localPath)
+	if err != nil {
+		// Clean up whatever partially made it into the bucket, especially
+		// when the failure was a cancellation mid-upload.
+		if deleteErr := DeleteS3Object(s3Bucket, s3Key); deleteErr != nil {
+			fmt.Printf("%v\n", deleteErr)
+		}
+		os.Remove(localPath)
+		EmitWarningEvent(namespace, podName, EventUploadFailed,
+			fmt.Sprintf("Upload of %v to %v failed: %v", s3Key, s3Bucket, err))
+		result.Duration = time.Since(start)
+		RecordBackupResult(result)
+		return err
+	}
+
+	// Copy the backup to the replica bucket, when one is configured. A
+	// replication failure is surfaced but does not undo the primary upload.
+	replica, err := ReplicateToS3(s3Bucket, s3Key)
 	if err != nil {
+		EmitWarningEvent(namespace, podName, EventUploadFailed,
+			fmt.Sprintf("Replication of %v failed: %v", s3Key, err))
+		result.Duration = time.Since(start)
+		RecordBackupResult(result)
 		return err
 	}
+	result.Replica = replica
+
+	// The referenced buckets are not in the backup; make sure the provider
+	// replicates them too when asked to.
+	replicateObjectStorageBuckets(refs)
 
 	options.Command = []string{"rm", "-f", localFilename}
 	err = ExecWithOptions(options)
@@ -98,11 +268,34 @@ func Backup(s3Bucket string) error {
 		return err
 	}
 
+	err = RunHook(HookPostBackup, namespace, podName, containerName)
+	if err != nil {
+		return err
+	}
+
 	fmt.Printf("Finished backup of GitLab instance\n")
+	result.Succeeded = true
+	result.Duration = time.Since(start)
+	RecordBackupResult(result)
+	UploadBackupMetadata(s3Bucket, s3Key, result)
+	EmitNormalEvent(namespace, podName, EventBackupSucceeded,
+		fmt.Sprintf("GitLab backup uploaded to %v", s3Bucket))
+	SendNotification(Notification{
+		Operation:   "backup",
+		Succeeded:   true,
+		Size:        backupSize,
+		Duration:    time.Since(start),
+		Destination: s3Bucket + "/" + s3Key,
+	})
 
 	return nil
 }
 
+var BackupInParallel bool
+var BackupIncrementally bool
+var BackupSkips []string
+var BackupStrategy string
+
 // backupCmd represents the backup command
 var backupCmd = &cobra.Command{
 	Use:          "backup [-s bucket]",
@@ -112,8 +305,25 @@ var backupCmd = &cobra.Command{
 	PreRunE:      validateArguments,
 	Run: func(cmd *cobra.Command, args []string) {
 		s3 := operatorConfig.GetString("s3")
-		err := Backup(s3)
+		var err error
+		if BackupStrategy == "snapshot" {
+			err = BackupSnapshot()
+		} else if BackupStrategy == "gitaly" {
+			err = BackupGitaly(s3)
+		} else if BackupInParallel {
+			err = BackupParallel(s3)
+		} else if BackupIncrementally {
+			err = BackupIncremental(s3)
+		} else {
+			err = Backup(s3, BackupSkips)
+		}
 		if err != nil {
+			SendNotification(Notification{
+				Operation:   "backup",
+				Succeeded:   false,
+				Destination: s3,
+				Message:     err.Error(),
+			})
 			ExitCode = 1
 			return
 		}
@@ -125,4 +335,25 @@ var backupCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(backupCmd)
+
+	backupCmd.Flags().BoolVar(
+		&BackupInParallel,
+		"parallel",
+		false,
+		"back up database, repositories, and object-storage directories as parallel streams")
+	backupCmd.Flags().BoolVar(
+		&BackupIncrementally,
+		"incremental",
+		false,
+		"back up repositories as git bundles containing only changes since the last run")
+	backupCmd.Flags().StringVar(
+		&BackupStrategy,
+		"strategy",
+		"rake",
+		"backup strategy: rake (default), snapshot (CSI VolumeSnapshots of the data PVCs), or gitaly (per-storage repository backups for multi-Gitaly installs)")
+	backupCmd.Flags().StringSliceVar(
+		&BackupSkips,
+		"skip",
+		nil,
+		"backup components to skip (db, repositories, uploads, builds, artifacts, lfs, registry, pages)")
 }
@@ -0,0 +1,144 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// How long bootstrap-restore waits for the freshly deployed instance to
+// become ready before restoring into it. First boot of an Omnibus image
+// reconfigures everything from scratch.
+const BootstrapReadyDeadline = 30 * time.Minute
+
+// BootstrapRestore stands a dead instance back up in one step: deploy
+// GitLab into the target namespace at the version recorded in the
+// backup's metadata, wait for it to come up, then restore the backup into
+// it. The disaster-recovery runbook collapsed into one command.
+func BootstrapRestore(namespace, name, s3Bucket, timestamp, externalURL string) error {
+	backupKey, err := resolveBackupKey(s3Bucket, timestamp)
+	if err != nil {
+		return err
+	}
+
+	// Deploy the version the backup was taken from; GitLab refuses to
+	// load a backup into a different version.
+	spec := GitLabSpec{
+		Version:     "latest",
+		ExternalURL: externalURL,
+		Storage:     "50Gi",
+	}
+	if metadata, found := fetchBackupMetadata(s3Bucket, backupKey); found && metadata.GitLabVersion != "" {
+		spec.Version = metadata.GitLabVersion
+	} else {
+		fmt.Printf("no metadata for %v; deploying gitlab/gitlab-ce:latest and hoping the versions match\n", backupKey)
+	}
+
+	fmt.Printf("Begining bootstrap restore of %v into %v/%v at version %v\n", backupKey, namespace, name, spec.Version)
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	err = reconcilePVC(clientset, namespace, name, spec)
+	if err != nil {
+		return fmt.Errorf("unable to create data volume: %v", err)
+	}
+	err = reconcileDeployment(clientset, namespace, name, spec)
+	if err != nil {
+		return fmt.Errorf("unable to create deployment: %v", err)
+	}
+	err = reconcileService(clientset, namespace, name, spec)
+	if err != nil {
+		return fmt.Errorf("unable to create service: %v", err)
+	}
+
+	fmt.Printf("Waiting up to %v for %v/%v to become ready\n", BootstrapReadyDeadline, namespace, name)
+	err = waitForGitLabReady(clientset, namespace, name, BootstrapReadyDeadline)
+	if err != nil {
+		return err
+	}
+
+	err = Restore(namespace, s3Bucket, timestamp, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished bootstrap restore of %v/%v\n", namespace, name)
+	return nil
+}
+
+// Flags of the bootstrap-restore command.
+var (
+	BootstrapNamespace   string
+	BootstrapName        string
+	BootstrapExternalURL string
+)
+
+// bootstrapRestoreCmd represents the bootstrap-restore command
+var bootstrapRestoreCmd = &cobra.Command{
+	Use:          "bootstrap-restore",
+	Short:        "Deploys GitLab into an empty namespace and restores a backup into it",
+	SilenceUsage: true,
+	Long: `Stands a dead instance back up end-to-end: deploys GitLab at the version
+recorded in the backup's metadata, waits for it to become ready, and
+restores the backup into it. Use -t to pick a backup, or the latest is
+used.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		namespace := BootstrapNamespace
+		if namespace == "" {
+			var err error
+			namespace, err = GetNamespace()
+			if err != nil {
+				fmt.Println(err)
+				ExitCode = 1
+				return
+			}
+		}
+		if BootstrapExternalURL == "" {
+			fmt.Println("an --external-url for the new instance is required")
+			ExitCode = 1
+			return
+		}
+
+		err := BootstrapRestore(namespace, BootstrapName, operatorConfig.GetString("s3"),
+			RestoreTimestamp, BootstrapExternalURL)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	bootstrapRestoreCmd.Flags().StringVar(&BootstrapNamespace, "target-namespace", "",
+		"namespace to deploy into (default this pod's namespace)")
+	bootstrapRestoreCmd.Flags().StringVar(&BootstrapName, "name", "gitlab",
+		"name of the GitLab instance to create")
+	bootstrapRestoreCmd.Flags().StringVar(&BootstrapExternalURL, "external-url", "",
+		"external URL of the new instance")
+	bootstrapRestoreCmd.Flags().StringVarP(&RestoreTimestamp, "timestamp", "t", "latest",
+		"timestamp of the backup to restore")
+	RootCmd.AddCommand(bootstrapRestoreCmd)
+}
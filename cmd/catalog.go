@@ -0,0 +1,331 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+// The backup catalog: everything the bucket holds about this instance's
+// backups, flattened into rows that other tooling can consume. Exported as
+// JSON or CSV, to stdout or straight to a bucket key. The catalog can also
+// be reconciled against an S3 Inventory report to surface objects that
+// disappeared without the operator deleting them — inventory listings are
+// the provider's view, so a backup present there whose metadata still
+// exists but whose object is gone was deleted behind the operator's back.
+
+// catalogEntry is one backup in the exported catalog.
+type catalogEntry struct {
+	Instance      string `json:"instance"`
+	Key           string `json:"key"`
+	Timestamp     string `json:"timestamp"`
+	Size          int64  `json:"size"`
+	StorageClass  string `json:"storageClass"`
+	Checksum      string `json:"checksum,omitempty"`
+	GitLabVersion string `json:"gitlabVersion,omitempty"`
+}
+
+// buildCatalog assembles the catalog from the bucket listing, the chunk
+// indexes, and the per-backup metadata.
+func buildCatalog(s3Bucket string) ([]catalogEntry, error) {
+	instance, err := GetNamespace()
+	if err != nil {
+		instance = ""
+	}
+
+	// Storage classes come from the raw listing, which ListBackups does
+	// not expose.
+	classes := map[string]string{}
+	sess, err := newAWSSession()
+	if err == nil {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(s3Bucket),
+			Prefix: aws.String(backupSearchPrefix()),
+		}
+		s3.New(sess).ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				classes[aws.StringValue(object.Key)] = aws.StringValue(object.StorageClass)
+			}
+			return true
+		})
+	}
+
+	backups, err := ListBackups(s3Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []catalogEntry
+	for _, backup := range backups {
+		class := classes[backup.Key]
+		if class == "" {
+			if backupIsChunked(s3Bucket, backup.Key) {
+				class = "CHUNKED"
+			} else {
+				class = s3.ObjectStorageClassStandard
+			}
+		}
+		entries = append(entries, catalogEntry{
+			Instance:      instance,
+			Key:           backup.Key,
+			Timestamp:     backup.Timestamp,
+			Size:          backup.Size,
+			StorageClass:  class,
+			Checksum:      backup.Checksum,
+			GitLabVersion: backup.GitLabVersion,
+		})
+	}
+
+	return entries, nil
+}
+
+// writeCatalog renders the catalog as JSON or CSV.
+func writeCatalog(writer io.Writer, entries []catalogEntry, format string) error {
+	switch format {
+	case "", "json":
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(append(data, '\n'))
+		return err
+	case "csv":
+		out := csv.NewWriter(writer)
+		out.Write([]string{"instance", "key", "timestamp", "size", "storage_class", "checksum", "gitlab_version"})
+		for _, entry := range entries {
+			out.Write([]string{
+				entry.Instance, entry.Key, entry.Timestamp,
+				strconv.FormatInt(entry.Size, 10),
+				entry.StorageClass, entry.Checksum, entry.GitLabVersion,
+			})
+		}
+		out.Flush()
+		return out.Error()
+	default:
+		return fmt.Errorf("unknown catalog format %q; use json or csv", format)
+	}
+}
+
+// ExportCatalog writes the catalog to stdout, or uploads it to the bucket
+// when destinationKey is set.
+func ExportCatalog(s3Bucket, format, destinationKey string) error {
+	entries, err := buildCatalog(s3Bucket)
+	if err != nil {
+		return err
+	}
+
+	if destinationKey == "" {
+		return writeCatalog(os.Stdout, entries, format)
+	}
+
+	localFilename := "backup-catalog." + format
+	file, err := os.OpenFile(localFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFilename)
+
+	err = writeCatalog(file, entries, format)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	return UploadFileToS3(s3Bucket, destinationKey, localFilename)
+}
+
+// Reads the object keys out of an S3 Inventory report (CSV, optionally
+// gzipped, with bucket and key as its first two columns).
+func readInventoryKeys(s3Bucket, inventoryKey string) ([]string, error) {
+	sess, err := newAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(inventoryKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read inventory %v: %v", inventoryKey, err)
+	}
+	defer object.Body.Close()
+
+	var reader io.Reader = object.Body
+	if strings.HasSuffix(inventoryKey, ".gz") {
+		gzReader, err := gzip.NewReader(object.Body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read inventory %v: %v", inventoryKey, err)
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	}
+
+	var keys []string
+	records := csv.NewReader(reader)
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse inventory %v: %v", inventoryKey, err)
+		}
+		if len(record) >= 2 {
+			keys = append(keys, record[1])
+		}
+	}
+
+	return keys, nil
+}
+
+// ReconcileInventory compares an S3 Inventory report against the live
+// bucket and reports backups the inventory knew about that are gone while
+// their metadata survived — the signature of deletion outside the
+// operator, which removes metadata together with the backup.
+func ReconcileInventory(s3Bucket, inventoryKey string) error {
+	inventoryKeys, err := readInventoryKeys(s3Bucket, inventoryKey)
+	if err != nil {
+		return err
+	}
+
+	live := map[string]bool{}
+	for _, prefix := range []string{backupSearchPrefix(), BackupMetadataPrefix, BackupChunkIndexPrefix} {
+		keys, err := ListS3Objects(s3Bucket, prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			live[key] = true
+		}
+	}
+
+	var missing []string
+	for _, key := range inventoryKeys {
+		if !strings.HasPrefix(key, backupSearchPrefix()) || live[key] {
+			continue
+		}
+		// Gone from the bucket; the operator would have taken the
+		// metadata with it.
+		if live[backupMetadataKey(key)] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+
+	if len(missing) > 0 {
+		err := fmt.Errorf("%v backups in the inventory were deleted outside the operator: %v",
+			len(missing), strings.Join(missing, ", "))
+		SendNotification(Notification{
+			Operation:   "catalog-reconcile",
+			Succeeded:   false,
+			Destination: s3Bucket,
+			Message:     err.Error(),
+		})
+		return err
+	}
+
+	fmt.Printf("Finished reconciling inventory %v: no unexpected deletions\n", inventoryKey)
+	return nil
+}
+
+var CatalogFormat string
+var CatalogOutputKey string
+var CatalogInventoryKey string
+
+// catalogCmd groups the catalog subcommands.
+var catalogCmd = &cobra.Command{
+	Use:          "catalog",
+	Short:        "Inspects the backup catalog",
+	SilenceUsage: true,
+}
+
+var catalogExportCmd = &cobra.Command{
+	Use:          "export [-s bucket] [--format json|csv] [--output key]",
+	Short:        "Exports the backup catalog as JSON or CSV",
+	SilenceUsage: true,
+	Long: `Exports the full backup inventory — timestamps, sizes, storage classes,
+checksums, and GitLab versions — as JSON or CSV, to stdout or to a key in
+the bucket.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := ExportCatalog(operatorConfig.GetString("s3"), CatalogFormat, CatalogOutputKey)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+		return
+	},
+}
+
+var catalogReconcileCmd = &cobra.Command{
+	Use:          "reconcile [-s bucket] --inventory key",
+	Short:        "Reconciles the catalog against an S3 Inventory report",
+	SilenceUsage: true,
+	Long: `Compares an S3 Inventory report against the live bucket and flags
+backups that were deleted outside the operator.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		if CatalogInventoryKey == "" {
+			fmt.Println("an inventory report key is required (--inventory)")
+			ExitCode = 1
+			return
+		}
+		err := ReconcileInventory(operatorConfig.GetString("s3"), CatalogInventoryKey)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(catalogCmd)
+	catalogCmd.AddCommand(catalogExportCmd)
+	catalogCmd.AddCommand(catalogReconcileCmd)
+
+	catalogExportCmd.Flags().StringVar(
+		&CatalogFormat,
+		"format",
+		"json",
+		"catalog format: json or csv")
+	catalogExportCmd.Flags().StringVar(
+		&CatalogOutputKey,
+		"output",
+		"",
+		"bucket key to upload the catalog to instead of printing it")
+	catalogReconcileCmd.Flags().StringVar(
+		&CatalogInventoryKey,
+		"inventory",
+		"",
+		"key of the S3 Inventory report (CSV, optionally gzipped) to reconcile against")
+}
@@ -0,0 +1,176 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// cert-manager integration. When cert_manager_issuer names an Issuer, the
+// operator creates cert-manager Certificate resources for the instance's
+// external URL (and registry URL when one is declared), adds the resulting
+// Secret to the Ingress TLS configuration, and reconfigures GitLab when
+// cert-manager renews the certificate.
+const (
+	CertManagerGroup      = "certmanager.k8s.io"
+	CertManagerVersion    = "v1alpha1"
+	CertIssuerSetting     = "cert_manager_issuer"
+	CertIssuerKindSetting = "cert_manager_issuer_kind"
+	DefaultCertIssuerKind = "ClusterIssuer"
+)
+
+// Name of the Secret cert-manager fills for an instance's certificate.
+func certificateSecretName(name string) string {
+	return name + "-tls"
+}
+
+// Strips the scheme off an external URL, leaving the hostname.
+func hostFromURL(url string) string {
+	host := url
+	for _, prefix := range []string{"https://", "http://"} {
+		if len(host) > len(prefix) && host[:len(prefix)] == prefix {
+			host = host[len(prefix):]
+		}
+	}
+	return host
+}
+
+// Creates one cert-manager Certificate when it does not exist yet.
+// Certificates are renewed by cert-manager itself, so an existing one is
+// left alone.
+func reconcileCertificate(namespace, name, secretName string, dnsNames []string) error {
+	issuer := operatorConfig.GetString(CertIssuerSetting)
+	issuerKind := operatorConfig.GetString(CertIssuerKindSetting)
+	if issuerKind == "" {
+		issuerKind = DefaultCertIssuerKind
+	}
+
+	client, err := NewDynamicResourceClient(CertManagerGroup, CertManagerVersion, "certificates", namespace)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Get(name, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	if DryRun {
+		fmt.Printf("Dry run: would create Certificate %v/%v for %v\n", namespace, name, dnsNames)
+		return nil
+	}
+
+	names := make([]interface{}, 0, len(dnsNames))
+	for _, dnsName := range dnsNames {
+		names = append(names, dnsName)
+	}
+
+	certificate := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": CertManagerGroup + "/" + CertManagerVersion,
+			"kind":       "Certificate",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"secretName": secretName,
+				"dnsNames":   names,
+				"issuerRef": map[string]interface{}{
+					"name": issuer,
+					"kind": issuerKind,
+				},
+			},
+		},
+	}
+
+	fmt.Printf("Creating Certificate %v/%v for %v\n", namespace, name, dnsNames)
+	_, err = client.Create(certificate)
+	return err
+}
+
+// ReconcileCertificates manages the cert-manager Certificates of a GitLab
+// resource and reconfigures the instance when a certificate has been
+// renewed. A no-op when no issuer is configured.
+func ReconcileCertificates(client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	if operatorConfig.GetString(CertIssuerSetting) == "" {
+		return nil
+	}
+
+	namespace := obj.GetNamespace()
+	name := obj.GetName()
+	spec := gitLabSpecFrom(obj)
+	if spec.ExternalURL == "" {
+		return nil
+	}
+
+	dnsNames := []string{hostFromURL(spec.ExternalURL)}
+	if registryURL := GetSpecString(obj, "registryURL"); registryURL != "" {
+		dnsNames = append(dnsNames, hostFromURL(registryURL))
+	}
+
+	err := reconcileCertificate(namespace, name, certificateSecretName(name), dnsNames)
+	if err != nil {
+		return err
+	}
+
+	// cert-manager rewrites the Secret on renewal; a resourceVersion
+	// change is our cue to reload the certificate into GitLab.
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+	secret, err := clientset.Core().Secrets(namespace).Get(certificateSecretName(name), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// Not issued yet; check again on the next reconcile.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	seenVersion, _, _ := unstructured.NestedString(obj.Object, "status", "tlsSecretVersion")
+	if seenVersion == secret.ResourceVersion {
+		return nil
+	}
+
+	if seenVersion != "" {
+		fmt.Printf("Certificate of %v/%v was renewed, reconfiguring\n", namespace, name)
+		podName, err := GetTargetPod(namespace)
+		if err != nil {
+			return err
+		}
+		options := ExecOptions{
+			Command:       []string{"gitlab-ctl", "reconfigure"},
+			Namespace:     namespace,
+			PodName:       podName,
+			ContainerName: GitLabContainerName,
+			CaptureStdout: true,
+			CaptureStderr: true,
+		}
+		err = ExecWithOptions(options)
+		if err != nil {
+			return err
+		}
+	}
+
+	return SetStatusField(client, obj, "tlsSecretVersion", secret.ResourceVersion)
+}
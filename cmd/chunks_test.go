@@ -0,0 +1,124 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Deterministic pseudo-random content, incompressible enough to exercise
+// chunk boundaries.
+func testContent(seed int64, size int) []byte {
+	random := rand.New(rand.NewSource(seed))
+	content := make([]byte, size)
+	random.Read(content)
+	return content
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	store := newMemoryObjectStore()
+	defer useObjectStore(store)()
+
+	directory, err := ioutil.TempDir("", "gitlab-operator-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	content := testContent(1, 4*chunkMinSize)
+	source := filepath.Join(directory, "backup.tar.gz")
+	err = ioutil.WriteFile(source, content, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	key := GitLabLocalBackupPrefix + "2020-01-01T00:00:00Z.tar.gz"
+	err = ChunkedUpload("backups", key, source)
+	if err != nil {
+		t.Fatalf("ChunkedUpload: %v", err)
+	}
+
+	if !backupIsChunked("backups", key) {
+		t.Error("backup not recognized as chunked after upload")
+	}
+
+	destination := filepath.Join(directory, "restored.tar.gz")
+	err = ChunkedDownload("backups", key, destination)
+	if err != nil {
+		t.Fatalf("ChunkedDownload: %v", err)
+	}
+	restored, err := ioutil.ReadFile(destination)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(restored, content) {
+		t.Error("restored content differs from the original")
+	}
+}
+
+func TestChunkedUploadDeduplicates(t *testing.T) {
+	store := newMemoryObjectStore()
+	defer useObjectStore(store)()
+
+	directory, err := ioutil.TempDir("", "gitlab-operator-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	content := testContent(2, 8*chunkMinSize)
+	source := filepath.Join(directory, "backup.tar.gz")
+	err = ioutil.WriteFile(source, content, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	err = ChunkedUpload("backups", GitLabLocalBackupPrefix+"first.tar.gz", source)
+	if err != nil {
+		t.Fatalf("ChunkedUpload: %v", err)
+	}
+	objectsAfterFirst := len(store.objects["backups"])
+
+	// A second backup with identical content must reuse every chunk: the
+	// only new object is its index.
+	err = ChunkedUpload("backups", GitLabLocalBackupPrefix+"second.tar.gz", source)
+	if err != nil {
+		t.Fatalf("ChunkedUpload: %v", err)
+	}
+
+	newObjects := len(store.objects["backups"]) - objectsAfterFirst
+	if newObjects != 1 {
+		t.Errorf("second upload added %v objects, expected only the chunk index", newObjects)
+	}
+
+	index, err := fetchChunkIndex("backups", GitLabLocalBackupPrefix+"second.tar.gz")
+	if err != nil {
+		t.Fatalf("fetchChunkIndex: %v", err)
+	}
+	if index.Size != int64(len(content)) {
+		t.Errorf("index records size %v, expected %v", index.Size, len(content))
+	}
+
+	keys := chunkedBackupKeys("backups")
+	if len(keys) != 2 || !strings.HasPrefix(keys[0], GitLabLocalBackupPrefix) {
+		t.Errorf("got chunked backup keys %v", keys)
+	}
+}
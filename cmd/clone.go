@@ -0,0 +1,126 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var CloneTargetNamespace string
+var CloneExternalURL string
+
+// CloneInstance restores a backup of one GitLab instance into another
+// instance in a different namespace, then rewrites external_url and
+// regenerates runner registration tokens so the clone does not impersonate
+// the source. Used to refresh staging from production on demand.
+func CloneInstance(s3Bucket, timestamp, targetNamespace, externalURL string) error {
+	if targetNamespace == "" {
+		return fmt.Errorf("a target namespace is required")
+	}
+
+	fmt.Printf("Cloning backup into GitLab instance in namespace %v\n", targetNamespace)
+
+	err := Restore(targetNamespace, s3Bucket, timestamp, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	podName, err := GetTargetPod(targetNamespace)
+	if err != nil {
+		return err
+	}
+
+	options := ExecOptions{
+		Namespace:     targetNamespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+
+	// The restore brought over the source's external_url; point the
+	// clone at its own hostname before anything caches the wrong URL.
+	if externalURL != "" {
+		options.Command = []string{"sh", "-c",
+			fmt.Sprintf("sed -i \"s|^external_url .*|external_url '%v'|\" /etc/gitlab/gitlab.rb", externalURL)}
+		err = ExecWithOptions(options)
+		if err != nil {
+			return fmt.Errorf("unable to rewrite external_url: %v", err)
+		}
+
+		options.Command = []string{"gitlab-ctl", "reconfigure"}
+		err = ExecWithOptions(options)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Drop the runners copied from the source and reset the registration
+	// token so the source's runners cannot pick up the clone's jobs.
+	options.Command = []string{"gitlab-rails", "runner",
+		"Ci::Runner.delete_all; ApplicationSetting.current.reset_runners_registration_token!"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("unable to regenerate runner tokens: %v", err)
+	}
+
+	fmt.Printf("Finished cloning into namespace %v\n", targetNamespace)
+	return nil
+}
+
+// cloneCmd represents the clone command
+var cloneCmd = &cobra.Command{
+	Use:          "clone [-s bucket] [-t timestamp] --target-namespace ns [--external-url url]",
+	Short:        "Clones a backup into another GitLab instance",
+	SilenceUsage: true,
+	Long: `Restores a backup of one GitLab instance into an instance in another
+namespace, rewriting external_url and regenerating runner registration
+tokens. Useful for refreshing a staging instance from production.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		s3 := operatorConfig.GetString("s3")
+		err := CloneInstance(s3, RestoreTimestamp, CloneTargetNamespace, CloneExternalURL)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cloneCmd)
+
+	cloneCmd.Flags().StringVarP(
+		&RestoreTimestamp,
+		"timestamp",
+		"t",
+		"latest",
+		"timestamp of the backup to clone, or \"latest\"")
+	cloneCmd.Flags().StringVar(
+		&CloneTargetNamespace,
+		"target-namespace",
+		"",
+		"namespace of the GitLab instance to restore the clone into")
+	cloneCmd.Flags().StringVar(
+		&CloneExternalURL,
+		"external-url",
+		"",
+		"external_url for the cloned instance")
+}
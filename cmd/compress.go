@@ -0,0 +1,77 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+)
+
+// CompressionCodec describes how the tar stream between the pod and
+// object storage is compressed. zstd cuts backup time and storage
+// substantially compared to gzip; none is useful when the payload is
+// already compressed (like rake's own tarballs).
+type CompressionCodec struct {
+	Name      string
+	Extension string
+	// Program invoked via tar --use-compress-program, e.g. "zstd -3".
+	// Empty means no compression.
+	program string
+}
+
+// TarCreateArgs returns the arguments added to `tar cf -` so the stream
+// leaving the pod is compressed by this codec.
+func (c CompressionCodec) TarCreateArgs() []string {
+	if c.program == "" {
+		return nil
+	}
+	return []string{"--use-compress-program", c.program}
+}
+
+// TarExtractArgs returns the arguments added to `tar xf -` so a stream
+// compressed by this codec can be pushed back into a pod.
+func (c CompressionCodec) TarExtractArgs() []string {
+	if c.program == "" {
+		return nil
+	}
+	return []string{"--use-compress-program", c.program + " -d"}
+}
+
+// CurrentCompression returns the codec selected by the compression and
+// compression_level settings. Valid codecs are gzip (the default), zstd,
+// and none.
+func CurrentCompression() CompressionCodec {
+	name := operatorConfig.GetString("compression")
+	level := operatorConfig.GetString("compression_level")
+
+	switch name {
+	case "", "gzip":
+		program := "gzip"
+		if level != "" {
+			program = fmt.Sprintf("gzip -%v", level)
+		}
+		return CompressionCodec{Name: "gzip", Extension: ".tar.gz", program: program}
+	case "zstd":
+		program := "zstd"
+		if level != "" {
+			program = fmt.Sprintf("zstd -%v", level)
+		}
+		return CompressionCodec{Name: "zstd", Extension: ".tar.zst", program: program}
+	case "none":
+		return CompressionCodec{Name: "none", Extension: ".tar"}
+	default:
+		fmt.Printf("Unknown compression codec %v, falling back to gzip\n", name)
+		return CompressionCodec{Name: "gzip", Extension: ".tar.gz", program: "gzip"}
+	}
+}
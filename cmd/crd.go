@@ -0,0 +1,87 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// API group and version for the operator's custom resources. The CRD
+// manifests in manifests/ must agree with these.
+const (
+	CRDGroup   = "gitlab.samsung-cnct.io"
+	CRDVersion = "v1alpha1"
+)
+
+// NewDynamicResourceClient returns a dynamic client scoped to an arbitrary
+// namespaced resource, for API groups we have no typed client for.
+func NewDynamicResourceClient(group, version, resource, namespace string) (dynamic.ResourceInterface, error) {
+	config, _, err := GetInCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	config.GroupVersion = &schema.GroupVersion{Group: group, Version: version}
+	config.APIPath = "/apis"
+
+	client, err := dynamic.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	apiResource := &metav1.APIResource{Name: resource, Namespaced: true}
+	return client.Resource(apiResource, namespace), nil
+}
+
+// NewCRDClient returns a dynamic client scoped to one of the operator's
+// custom resources (by plural resource name) in the given namespace.
+func NewCRDClient(resource, namespace string) (dynamic.ResourceInterface, error) {
+	return NewDynamicResourceClient(CRDGroup, CRDVersion, resource, namespace)
+}
+
+// GetSpecString returns spec.<field> of a custom resource, or "" when the
+// field is absent.
+func GetSpecString(obj *unstructured.Unstructured, field string) string {
+	value, _, _ := unstructured.NestedString(obj.Object, "spec", field)
+	return value
+}
+
+// GetSpecBool returns spec.<field> of a custom resource, or false when the
+// field is absent.
+func GetSpecBool(obj *unstructured.Unstructured, field string) bool {
+	value, _, _ := unstructured.NestedBool(obj.Object, "spec", field)
+	return value
+}
+
+// SetStatusField sets status.<field> on a custom resource and updates it in
+// the cluster. The passed in object is refreshed with the server's copy so
+// callers can make further updates without conflicting.
+func SetStatusField(client dynamic.ResourceInterface, obj *unstructured.Unstructured, field string, value interface{}) error {
+	err := unstructured.SetNestedField(obj.Object, value, "status", field)
+	if err != nil {
+		return err
+	}
+
+	updated, err := client.Update(obj)
+	if err != nil {
+		return err
+	}
+
+	obj.Object = updated.Object
+	return nil
+}
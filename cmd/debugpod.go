@@ -0,0 +1,159 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CopyFromPod needs tar inside the target container, which distroless
+// images (notably Gitaly's) do not carry. When tar is missing a
+// short-lived busybox helper pod is started on the same node with the
+// target's volumes mounted at the same paths, and the copy streams
+// through it instead. Override the helper image with debug_image.
+const (
+	DebugImageSetting = "debug_image"
+	DefaultDebugImage = "busybox:1.29"
+)
+
+var (
+	tarCheckMutex sync.Mutex
+	tarChecked    = map[string]bool{}
+)
+
+// Reports whether the container has tar on its PATH. Results are cached
+// per pod so repeated copies cost one probe, not one per file.
+func hasTar(namespace, podName, containerName string) bool {
+	cacheKey := namespace + "/" + podName + "/" + containerName
+
+	tarCheckMutex.Lock()
+	present, found := tarChecked[cacheKey]
+	tarCheckMutex.Unlock()
+	if found {
+		return present
+	}
+
+	_, _, err := ExecWithOutput(ExecOptions{
+		Command:       []string{"tar", "--version"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: containerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	})
+	present = err == nil
+
+	tarCheckMutex.Lock()
+	tarChecked[cacheKey] = present
+	tarCheckMutex.Unlock()
+	return present
+}
+
+// startDebugPod starts the helper pod next to the target, mounting the
+// target's volumes at their original paths. Returns the helper's name;
+// the caller deletes it.
+func startDebugPod(namespace, targetPodName string) (string, error) {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return "", err
+	}
+
+	target, err := clientset.Core().Pods(namespace).Get(targetPodName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	image := operatorConfig.GetString(DebugImageSetting)
+	if image == "" {
+		image = DefaultDebugImage
+	}
+
+	// Mirror every container's mounts, first mount of a path wins.
+	var mounts []v1.VolumeMount
+	seen := map[string]bool{}
+	for _, container := range target.Spec.Containers {
+		for _, mount := range container.VolumeMounts {
+			if seen[mount.MountPath] {
+				continue
+			}
+			seen[mount.MountPath] = true
+			mounts = append(mounts, mount)
+		}
+	}
+
+	podName := fmt.Sprintf("%v-debug-%v", targetPodName, time.Now().Unix())
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   podName,
+			Labels: map[string]string{"component": "gitlab-operator-debug"},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			NodeName:      target.Spec.NodeName,
+			Volumes:       target.Spec.Volumes,
+			Containers: []v1.Container{{
+				Name:         "debug",
+				Image:        image,
+				Command:      []string{"sleep", "3600"},
+				VolumeMounts: mounts,
+			}},
+		},
+	}
+
+	fmt.Printf("Starting debug pod %v for %v/%v (no tar in target)\n", podName, namespace, targetPodName)
+	_, err = clientset.Core().Pods(namespace).Create(pod)
+	if err != nil {
+		return "", fmt.Errorf("unable to create debug pod: %v", err)
+	}
+
+	err = waitForPodReady(clientset, namespace, podName, 5*time.Minute)
+	if err != nil {
+		clientset.Core().Pods(namespace).Delete(podName, &metav1.DeleteOptions{})
+		return "", err
+	}
+
+	return podName, nil
+}
+
+// Deletes the helper pod. Best effort.
+func deleteDebugPod(namespace, podName string) {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return
+	}
+	err = clientset.Core().Pods(namespace).Delete(podName, &metav1.DeleteOptions{})
+	if err != nil {
+		fmt.Printf("unable to delete debug pod %v: %v\n", podName, err)
+	}
+}
+
+// copyViaDebugPod copies a file out of a tar-less pod by streaming it
+// through a helper pod that mounts the same volumes.
+func copyViaDebugPod(src, dest fileSpec) error {
+	debugPodName, err := startDebugPod(src.PodNamespace, src.PodName)
+	if err != nil {
+		return err
+	}
+	defer deleteDebugPod(src.PodNamespace, debugPodName)
+
+	return CopyFromPod(
+		fileSpec{PodNamespace: src.PodNamespace, PodName: debugPodName, File: src.File},
+		dest)
+}
@@ -0,0 +1,142 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// A drain or cluster-autoscaler scale-down that evicts the GitLab pod in
+// the middle of a backup corrupts the run. While an operation is active
+// the pod is annotated as not-safe-to-evict, and with disruption_pdb set
+// a temporary PodDisruptionBudget is held over it as well; both are
+// removed when the operation finishes.
+const (
+	DisruptionPDBSetting = "disruption_pdb"
+
+	// Records which operation is holding the protection.
+	OperationAnnotation = "gitlab-operator/operation-in-progress"
+
+	// Honored by cluster autoscaler when considering scale-down.
+	SafeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+)
+
+// Name of the temporary PDB guarding a pod.
+func disruptionPDBName(podName string) string {
+	return podName + "-operator-guard"
+}
+
+// Sets or removes the protection annotations on the pod.
+func setProtectionAnnotations(namespace, podName, operation string) error {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	pods := clientset.Core().Pods(namespace)
+	pod, err := pods.Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	if operation == "" {
+		delete(pod.Annotations, OperationAnnotation)
+		delete(pod.Annotations, SafeToEvictAnnotation)
+	} else {
+		pod.Annotations[OperationAnnotation] = operation
+		pod.Annotations[SafeToEvictAnnotation] = "false"
+	}
+
+	_, err = pods.Update(pod)
+	return err
+}
+
+// ProtectPodFromDisruption marks the pod as mid-operation so drains and
+// the cluster autoscaler leave it alone. Best effort: a backup proceeds
+// even when the protection cannot be applied.
+func ProtectPodFromDisruption(namespace, podName, operation string) {
+	if DryRun {
+		fmt.Printf("Dry run: would protect pod %v/%v during %v\n", namespace, podName, operation)
+		return
+	}
+
+	err := setProtectionAnnotations(namespace, podName, operation)
+	if err != nil {
+		fmt.Printf("unable to annotate pod %v against eviction: %v\n", podName, err)
+	}
+
+	if !operatorConfig.GetBool(DisruptionPDBSetting) {
+		return
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return
+	}
+
+	pod, err := clientset.Core().Pods(namespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		fmt.Printf("unable to create disruption budget for %v: %v\n", podName, err)
+		return
+	}
+
+	minAvailable := intstr.FromInt(1)
+	pdb := &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Name: disruptionPDBName(podName)},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector:     &metav1.LabelSelector{MatchLabels: pod.Labels},
+		},
+	}
+	_, err = clientset.PolicyV1beta1().PodDisruptionBudgets(namespace).Create(pdb)
+	if err != nil && !errors.IsAlreadyExists(err) {
+		fmt.Printf("unable to create disruption budget for %v: %v\n", podName, err)
+	}
+}
+
+// UnprotectPodFromDisruption removes the protection once the operation is
+// done, so normal drains work again. Best effort.
+func UnprotectPodFromDisruption(namespace, podName string) {
+	if DryRun {
+		fmt.Printf("Dry run: would unprotect pod %v/%v\n", namespace, podName)
+		return
+	}
+
+	err := setProtectionAnnotations(namespace, podName, "")
+	if err != nil {
+		fmt.Printf("unable to remove eviction annotations from pod %v: %v\n", podName, err)
+	}
+
+	if !operatorConfig.GetBool(DisruptionPDBSetting) {
+		return
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return
+	}
+	err = clientset.PolicyV1beta1().PodDisruptionBudgets(namespace).Delete(disruptionPDBName(podName), &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		fmt.Printf("unable to delete disruption budget for %v: %v\n", podName, err)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/juju/ratelimit"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Download path mirroring the uploader: ranged GETs that resume a failed
+// part instead of starting the whole transfer over, an optional
+// download_rate_limit in bytes/sec, and a streaming mode that pipes the
+// backup straight into the pod without buffering it on the operator's
+// disk (stream_restore).
+const (
+	DownloadRateLimitSetting = "download_rate_limit"
+	DownloadPartSizeSetting  = "download_part_size"
+	StreamRestoreSetting     = "stream_restore"
+
+	defaultDownloadPartSize = int64(8 << 20)
+	downloadPartRetries     = 3
+)
+
+// The configured ranged GET part size.
+func downloadPartSize() int64 {
+	size := operatorConfig.GetInt64(DownloadPartSizeSetting)
+	if size <= 0 {
+		size = defaultDownloadPartSize
+	}
+	return size
+}
+
+// throttledWriter wraps a download destination with the configured
+// download rate limit. With no limit configured the writer is returned
+// unchanged.
+func throttledWriter(writer io.Writer) io.Writer {
+	limit := operatorConfig.GetInt64(DownloadRateLimitSetting)
+	if limit <= 0 {
+		return writer
+	}
+
+	fmt.Printf("Limiting download rate to %v bytes/sec\n", limit)
+	bucket := ratelimit.NewBucketWithRate(float64(limit), limit)
+	return ratelimit.Writer(writer, bucket)
+}
+
+// Fetches one byte range of the object into the writer, verifying the
+// part is complete and the object has not changed underneath us.
+func downloadPart(svc *s3.S3, s3Bucket, key, etag string, start, end int64, writer io.Writer) error {
+	object, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket:  aws.String(s3Bucket),
+		Key:     aws.String(key),
+		Range:   aws.String(fmt.Sprintf("bytes=%v-%v", start, end)),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	copied, err := io.Copy(writer, object.Body)
+	if err != nil {
+		return err
+	}
+	if expected := end - start + 1; copied != expected {
+		return fmt.Errorf("part was %v bytes, expected %v", copied, expected)
+	}
+	return nil
+}
+
+// RangedDownload streams an object into the writer with ranged GETs,
+// retrying each part on failure so a flaky connection resumes mid-object
+// instead of starting over. Returns the SHA-256 of the streamed bytes.
+func RangedDownload(s3Bucket, key string, writer io.Writer) (string, error) {
+	// Archived objects must be thawed before they can be read.
+	err := EnsureObjectRestorable(s3Bucket, key)
+	if err != nil {
+		return "", err
+	}
+
+	sess, err := newAWSSession()
+	if err != nil {
+		return "", err
+	}
+	svc := s3.New(sess)
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to inspect %v: %v", key, err)
+	}
+	size := aws.Int64Value(head.ContentLength)
+	etag := aws.StringValue(head.ETag)
+
+	tracker := NewProgressTracker("download "+key, size)
+	defer tracker.Done()
+
+	hash := sha256.New()
+	destination := throttledWriter(tracker.WrapWriter(io.MultiWriter(writer, hash)))
+
+	partSize := downloadPartSize()
+	for start := int64(0); start < size; start += partSize {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		var partErr error
+		for attempt := 1; attempt <= downloadPartRetries; attempt++ {
+			partErr = downloadPart(svc, s3Bucket, key, etag, start, end, destination)
+			if partErr == nil {
+				break
+			}
+			fmt.Printf("download of %v bytes %v-%v failed (attempt %v of %v): %v\n",
+				key, start, end, attempt, downloadPartRetries, partErr)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if partErr != nil {
+			return "", fmt.Errorf("failed to download %v: %v", key, partErr)
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// StreamRestoreToPod pipes a backup straight from the bucket into
+// `tar xf -` in the pod, so restores on operators with small disks never
+// buffer the tarball locally. The stream's checksum is verified against
+// the backup metadata after the fact; a mismatch fails the restore before
+// the rake task runs.
+func StreamRestoreToPod(namespace, podName, s3Bucket, key string) error {
+	if DryRun {
+		fmt.Printf("Dry run: would stream %v from %v into %v/%v\n", key, s3Bucket, namespace, podName)
+		return nil
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+	pod, err := clientset.Core().Pods(namespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	containerName := pod.Spec.Containers[0].Name
+
+	fmt.Printf("Streaming %v from %v into %v/%v\n", key, s3Bucket, namespace, podName)
+
+	command := []string{"tar", "-x", "-f", "-"}
+	command = append(command, CurrentCompression().TarExtractArgs()...)
+	command = append(command, tarOwnershipArgs()...)
+	command = append(command, "-C", "/")
+
+	reader, writer := io.Pipe()
+	checksum := make(chan string, 1)
+	go func() {
+		sum, err := RangedDownload(s3Bucket, key, writer)
+		checksum <- sum
+		writer.CloseWithError(err)
+	}()
+
+	start := time.Now()
+	err = podExecutor.Execute(namespace, podName, containerName, command, reader, nil, nil)
+	auditExec(namespace, podName, containerName, command, start, err)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("failed to stream %v into pod %v: %v", key, podName, err)
+	}
+
+	if metadata, found := fetchBackupMetadata(s3Bucket, key); found && metadata.Checksum != "" {
+		if sum := <-checksum; sum != metadata.Checksum {
+			return fmt.Errorf("streamed backup %v failed verification: checksum %v, expected %v",
+				key, sum, metadata.Checksum)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Disaster recovery drills. A drill restores the latest backup into a
+// dedicated drill instance (drill_namespace, which must host a GitLab
+// instance like any clone target), measures how long the restore took (the
+// achieved RTO), and compares the restored data against the source: total
+// project count, and the head commit of a sample of projects, both through
+// the GitLab API (api_url for the source, drill_api_url for the drill
+// instance; comparison is skipped when drill_api_url is unset). The report
+// lands in the bucket under gitlab-drill-reports/ and in the status
+// ConfigMap. Setting drill_interval (e.g. 720h for monthly) runs drills on
+// a schedule.
+const (
+	DrillIntervalSetting    = "drill_interval"
+	DrillNamespaceSetting   = "drill_namespace"
+	DrillExternalURLSetting = "drill_external_url"
+	DrillAPIURLSetting      = "drill_api_url"
+
+	DrillReportPrefix = "gitlab-drill-reports/"
+
+	// How many projects have their head commit compared per drill.
+	drillCommitSample = 10
+)
+
+// drillReport is what a drill files into the bucket.
+type drillReport struct {
+	Timestamp      time.Time     `json:"timestamp"`
+	BackupKey      string        `json:"backupKey"`
+	Succeeded      bool          `json:"succeeded"`
+	RTO            time.Duration `json:"rto"`
+	SourceProjects int           `json:"sourceProjects,omitempty"`
+	DrillProjects  int           `json:"drillProjects,omitempty"`
+	CommitsChecked int           `json:"commitsChecked,omitempty"`
+	CommitMismatch []string      `json:"commitMismatch,omitempty"`
+	ComparisonMade bool          `json:"comparisonMade"`
+	Message        string        `json:"message,omitempty"`
+}
+
+// One commit as returned by the repository commits API.
+type apiCommit struct {
+	ID string `json:"id"`
+}
+
+// Head commit sha of a project's default branch, or "" when the project
+// has no commits.
+func (g *GitLabAPIClient) headCommit(projectID int) (string, error) {
+	var commits []apiCommit
+	err := g.do("GET", fmt.Sprintf("/projects/%v/repository/commits?per_page=1", projectID), nil, &commits)
+	if err != nil {
+		return "", err
+	}
+	if len(commits) == 0 {
+		return "", nil
+	}
+	return commits[0].ID, nil
+}
+
+// Compares the drill instance against the source and fills in the
+// comparison fields of the report. Returns an error only for mismatches;
+// an unreachable API just leaves the comparison out of the report.
+func compareDrillInstance(report *drillReport) error {
+	drillAPIURL := operatorConfig.GetString(DrillAPIURLSetting)
+	if drillAPIURL == "" {
+		return nil
+	}
+
+	source, err := NewGitLabAPIClient(operatorConfig.GetString("api_url"))
+	if err != nil {
+		fmt.Printf("drill comparison skipped: %v\n", err)
+		return nil
+	}
+	drill, err := NewGitLabAPIClient(drillAPIURL)
+	if err != nil {
+		fmt.Printf("drill comparison skipped: %v\n", err)
+		return nil
+	}
+
+	sourceProjects, err := source.Projects()
+	if err != nil {
+		fmt.Printf("drill comparison skipped: %v\n", err)
+		return nil
+	}
+	drillProjects, err := drill.Projects()
+	if err != nil {
+		fmt.Printf("drill comparison skipped: %v\n", err)
+		return nil
+	}
+
+	report.ComparisonMade = true
+	report.SourceProjects = len(sourceProjects)
+	report.DrillProjects = len(drillProjects)
+
+	// Index the drill's projects by path, then spot-check head commits.
+	// The drill was restored from a backup taken earlier, so commits that
+	// landed on the source since then are tolerated; a drill project ahead
+	// of the source is not.
+	drillByPath := map[string]int{}
+	for _, project := range drillProjects {
+		drillByPath[project.PathWithNamespace] = project.ID
+	}
+
+	for _, project := range sourceProjects {
+		if report.CommitsChecked >= drillCommitSample {
+			break
+		}
+		drillID, found := drillByPath[project.PathWithNamespace]
+		if !found {
+			report.CommitMismatch = append(report.CommitMismatch, project.PathWithNamespace+" (missing)")
+			continue
+		}
+
+		drillHead, err := drill.headCommit(drillID)
+		if err != nil {
+			continue
+		}
+		report.CommitsChecked++
+		if drillHead == "" {
+			continue
+		}
+		// The drill's head must exist on the source; look it up directly.
+		var commit apiCommit
+		err = source.do("GET",
+			fmt.Sprintf("/projects/%v/repository/commits/%v", project.ID, drillHead), nil, &commit)
+		if err != nil {
+			report.CommitMismatch = append(report.CommitMismatch, project.PathWithNamespace)
+		}
+	}
+
+	if len(drillProjects) < len(sourceProjects) {
+		return fmt.Errorf("drill instance has %v projects, source has %v",
+			len(drillProjects), len(sourceProjects))
+	}
+	if len(report.CommitMismatch) > 0 {
+		return fmt.Errorf("head commits of %v do not exist on the source", report.CommitMismatch)
+	}
+
+	return nil
+}
+
+// Files the report into the bucket and the status ConfigMap. Best effort.
+func recordDrillReport(s3Bucket string, report drillReport) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Printf("unable to record drill report: %v\n", err)
+		return
+	}
+
+	localFilename := "drill-report.json"
+	err = ioutil.WriteFile(localFilename, data, 0600)
+	if err != nil {
+		fmt.Printf("unable to record drill report: %v\n", err)
+		return
+	}
+	defer os.Remove(localFilename)
+
+	key := DrillReportPrefix + report.Timestamp.UTC().Format(time.RFC3339) + ".json"
+	err = UploadFileToS3(s3Bucket, key, localFilename)
+	if err != nil {
+		fmt.Printf("unable to record drill report: %v\n", err)
+	}
+
+	RecordStatus(map[string]string{
+		"lastDrillTimestamp": report.Timestamp.UTC().Format(time.RFC3339),
+		"lastDrillSucceeded": strconv.FormatBool(report.Succeeded),
+		"lastDrillRTO":       report.RTO.Round(time.Second).String(),
+		"lastDrillReport":    s3Bucket + "/" + key,
+	})
+}
+
+// RunDrill performs one disaster recovery drill and files its report.
+func RunDrill(s3Bucket string) error {
+	drillNamespace := operatorConfig.GetString(DrillNamespaceSetting)
+	if drillNamespace == "" {
+		return fmt.Errorf("drill_namespace is not configured")
+	}
+
+	backupKey, err := resolveBackupKey(s3Bucket, "latest")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Begining disaster recovery drill of %v into namespace %v\n", backupKey, drillNamespace)
+	report := drillReport{
+		Timestamp: time.Now().UTC(),
+		BackupKey: backupKey,
+	}
+	start := time.Now()
+
+	err = CloneInstance(s3Bucket, "latest", drillNamespace,
+		operatorConfig.GetString(DrillExternalURLSetting))
+	report.RTO = time.Since(start)
+	if err == nil {
+		err = compareDrillInstance(&report)
+	}
+
+	if err != nil {
+		report.Message = err.Error()
+		recordDrillReport(s3Bucket, report)
+		SendNotification(Notification{
+			Operation:   "drill",
+			Succeeded:   false,
+			Duration:    report.RTO,
+			Destination: drillNamespace,
+			Message:     err.Error(),
+		})
+		return err
+	}
+
+	report.Succeeded = true
+	recordDrillReport(s3Bucket, report)
+
+	fmt.Printf("Finished disaster recovery drill: restored %v in %v\n",
+		backupKey, report.RTO.Round(time.Second))
+	SendNotification(Notification{
+		Operation:   "drill",
+		Succeeded:   true,
+		Duration:    report.RTO,
+		Destination: drillNamespace,
+	})
+
+	return nil
+}
+
+// Runs drills at the configured interval. Disabled unless drill_interval
+// is set.
+func runDrillController(stop <-chan struct{}) {
+	interval := operatorConfig.GetDuration(DrillIntervalSetting)
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		EnqueueOperation("disaster recovery drill", func() error {
+			return RunDrill(operatorConfig.GetString("s3"))
+		})
+	}
+}
+
+// drillCmd represents the drill command
+var drillCmd = &cobra.Command{
+	Use:          "drill [-s bucket]",
+	Short:        "Runs a disaster recovery drill",
+	SilenceUsage: true,
+	Long: `Restores the latest backup into the drill instance in drill_namespace,
+measures the achieved recovery time, compares project counts and head
+commits against the source through the GitLab API, and files a report into
+the bucket and the operator's status ConfigMap.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := RunDrill(operatorConfig.GetString("s3"))
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(drillCmd)
+	RegisterController(runDrillController)
+}
@@ -0,0 +1,102 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Reads one key out of a Secret in the namespace.
+func readSecretKey(namespace, name, key string) (string, error) {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := clientset.Core().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret %v: %v", name, err)
+	}
+
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("secret %v has no %v key", name, key)
+	}
+
+	return string(value), nil
+}
+
+// emailOmnibusSettings translates a GitLab resource's spec.smtp and
+// spec.incomingEmail fields into omnibus settings, resolving passwords
+// from the referenced Secrets (key "password"). The result merges into
+// the settings rendered into gitlab.rb, so email setup is declarative
+// like the rest of the omnibus configuration.
+func emailOmnibusSettings(obj *unstructured.Unstructured) (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+	namespace := obj.GetNamespace()
+
+	smtp, found, err := unstructured.NestedMap(obj.Object, "spec", "smtp")
+	if err == nil && found && len(smtp) > 0 {
+		settings["gitlab_rails['smtp_enable']"] = true
+		copySetting(settings, smtp, "host", "gitlab_rails['smtp_address']")
+		copySetting(settings, smtp, "port", "gitlab_rails['smtp_port']")
+		copySetting(settings, smtp, "username", "gitlab_rails['smtp_user_name']")
+		copySetting(settings, smtp, "domain", "gitlab_rails['smtp_domain']")
+		copySetting(settings, smtp, "tls", "gitlab_rails['smtp_tls']")
+		if secretName, ok := smtp["passwordSecret"].(string); ok && secretName != "" {
+			password, err := readSecretKey(namespace, secretName, "password")
+			if err != nil {
+				return nil, fmt.Errorf("smtp: %v", err)
+			}
+			settings["gitlab_rails['smtp_password']"] = password
+			settings["gitlab_rails['smtp_authentication']"] = "login"
+		}
+	}
+
+	incoming, found, err := unstructured.NestedMap(obj.Object, "spec", "incomingEmail")
+	if err == nil && found && len(incoming) > 0 {
+		settings["gitlab_rails['incoming_email_enabled']"] = true
+		copySetting(settings, incoming, "address", "gitlab_rails['incoming_email_address']")
+		copySetting(settings, incoming, "host", "gitlab_rails['incoming_email_host']")
+		copySetting(settings, incoming, "port", "gitlab_rails['incoming_email_port']")
+		copySetting(settings, incoming, "username", "gitlab_rails['incoming_email_email']")
+		copySetting(settings, incoming, "mailbox", "gitlab_rails['incoming_email_mailbox_name']")
+		if secretName, ok := incoming["passwordSecret"].(string); ok && secretName != "" {
+			password, err := readSecretKey(namespace, secretName, "password")
+			if err != nil {
+				return nil, fmt.Errorf("incomingEmail: %v", err)
+			}
+			settings["gitlab_rails['incoming_email_password']"] = password
+		}
+	}
+
+	return settings, nil
+}
+
+// Copies one field of a CR sub-object into the omnibus settings map under
+// its gitlab.rb name, when the field is set.
+func copySetting(settings map[string]interface{}, source map[string]interface{}, field, target string) {
+	value, ok := source[field]
+	if !ok || value == nil {
+		return
+	}
+	if text, ok := value.(string); ok && text == "" {
+		return
+	}
+	settings[target] = value
+}
@@ -0,0 +1,89 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Event reasons recorded against the GitLab pod so `kubectl describe pod`
+// shows operator activity.
+const (
+	EventBackupStarted   = "BackupStarted"
+	EventBackupSucceeded = "BackupSucceeded"
+	EventBackupFailed    = "BackupFailed"
+	EventUploadFailed    = "UploadFailed"
+	EventRestoreStarted  = "RestoreStarted"
+	EventRestoreComplete = "RestoreComplete"
+	EventRestoreFailed   = "RestoreFailed"
+)
+
+// EmitNormalEvent records a Normal Event against the named pod.
+func EmitNormalEvent(namespace, podName, reason, message string) {
+	EmitPodEvent(namespace, podName, v1.EventTypeNormal, reason, message)
+}
+
+// EmitWarningEvent records a Warning Event against the named pod.
+func EmitWarningEvent(namespace, podName, reason, message string) {
+	EmitPodEvent(namespace, podName, v1.EventTypeWarning, reason, message)
+}
+
+// EmitPodEvent records an Event against the named pod. Event delivery is
+// best effort: failures are logged and otherwise ignored so an unreachable
+// events API never aborts a backup.
+func EmitPodEvent(namespace, podName, eventType, reason, message string) {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		fmt.Printf("unable to emit event %v: %v\n", reason, err)
+		return
+	}
+
+	pod, err := clientset.Core().Pods(namespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		fmt.Printf("unable to emit event %v: %v\n", reason, err)
+		return
+	}
+
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "gitlab-operator-",
+			Namespace:    namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "Pod",
+			Namespace:       namespace,
+			Name:            pod.Name,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			APIVersion:      "v1",
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: "gitlab-operator"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	_, err = clientset.Core().Events(namespace).Create(event)
+	if err != nil {
+		fmt.Printf("unable to emit event %v: %v\n", reason, err)
+	}
+}
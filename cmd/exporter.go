@@ -0,0 +1,185 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// GitLab health exporter. The operator periodically probes the managed
+// instance (readiness endpoint, sidekiq queue depth, pending migrations)
+// and serves the results in Prometheus text format on /metrics, alongside
+// the transfer progress gauges. The same values land in the GitLab CR's
+// status so kubectl shows them too. Probe cadence is health_probe_interval
+// (default 60s).
+const (
+	HealthProbeIntervalSetting = "health_probe_interval"
+	DefaultHealthProbeInterval = 60 * time.Second
+)
+
+var metricsMutex sync.Mutex
+var healthMetrics = map[string]float64{}
+
+// setHealthMetric records one gauge for the /metrics endpoint.
+func setHealthMetric(name string, value float64) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	healthMetrics[name] = value
+}
+
+// Serves the collected gauges in Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsMutex.Lock()
+	names := make([]string, 0, len(healthMetrics))
+	for name := range healthMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%v %v", name, healthMetrics[name]))
+	}
+	metricsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+
+	// Bytes moved by in-flight uploads, downloads, and pod copies.
+	for name, bytes := range TransferProgress() {
+		fmt.Fprintf(w, "gitlab_operator_transfer_bytes{transfer=%q} %v\n", name, bytes)
+	}
+}
+
+// Probes the instance's readiness endpoint from inside the pod. Returns 1
+// when ready, 0 otherwise.
+func probeReadiness(namespace, podName string) float64 {
+	options := ExecOptions{
+		Command: []string{"sh", "-c",
+			"curl -s -o /dev/null -w '%{http_code}' http://localhost/-/readiness"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err == nil && strings.TrimSpace(stdout) == "200" {
+		return 1
+	}
+	return 0
+}
+
+// Reads the total sidekiq queue depth through the rails console. Returns
+// -1 when the probe fails so a dead console is distinguishable from an
+// empty queue.
+func probeSidekiqDepth(namespace, podName string) float64 {
+	options := ExecOptions{
+		Command: []string{"gitlab-rails", "runner",
+			"puts Sidekiq::Stats.new.enqueued"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return -1
+	}
+
+	var depth float64
+	_, err = fmt.Sscanf(strings.TrimSpace(stdout), "%f", &depth)
+	if err != nil {
+		return -1
+	}
+	return depth
+}
+
+// Probes one namespace's GitLab instance and publishes the results as
+// metrics and, when a GitLab CR exists for the instance, as status fields.
+func probeGitLabHealth(namespace string) {
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		setHealthMetric("gitlab_operator_instance_up", 0)
+		return
+	}
+
+	ready := probeReadiness(namespace, podName)
+	sidekiq := probeSidekiqDepth(namespace, podName)
+	pending, err := pendingMigrations(namespace, podName)
+	if err != nil {
+		pending = -1
+	}
+
+	setHealthMetric("gitlab_operator_instance_up", ready)
+	setHealthMetric("gitlab_operator_sidekiq_queue_depth", sidekiq)
+	setHealthMetric("gitlab_operator_pending_migrations", float64(pending))
+
+	client, err := NewCRDClient("gitlabs", namespace)
+	if err != nil {
+		return
+	}
+	list, err := client.List(metav1.ListOptions{})
+	items, ok := list.(*unstructured.UnstructuredList)
+	if err != nil || !ok {
+		return
+	}
+	for i := range items.Items {
+		obj := &items.Items[i]
+		SetStatusField(client, obj, "ready", ready == 1)
+		SetStatusField(client, obj, "sidekiqQueueDepth", int64(sidekiq))
+		SetStatusField(client, obj, "pendingMigrations", int64(pending))
+	}
+}
+
+// Probes instance health at the configured interval in every watched
+// namespace.
+func runHealthExporter(stop <-chan struct{}) {
+	interval := operatorConfig.GetDuration(HealthProbeIntervalSetting)
+	if interval <= 0 {
+		interval = DefaultHealthProbeInterval
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		namespaces, err := WatchNamespaces()
+		if err != nil {
+			fmt.Printf("health exporter: %v\n", err)
+			continue
+		}
+		for _, namespace := range namespaces {
+			probeGitLabHealth(namespace)
+		}
+	}
+}
+
+func init() {
+	RegisterController(runHealthExporter)
+}
@@ -0,0 +1,151 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+// useFakeCluster points the cluster client seam at a fake clientset seeded
+// with the given objects. Returns the clientset for assertions and a
+// restore func the caller must defer.
+func useFakeCluster(objects ...runtime.Object) (*fake.Clientset, func()) {
+	clientset := fake.NewSimpleClientset(objects...)
+	previous := newClusterClient
+	newClusterClient = func() (*rest.Config, kubernetes.Interface, error) {
+		return &rest.Config{}, clientset, nil
+	}
+	return clientset, func() { newClusterClient = previous }
+}
+
+// fakeExecution records one command run through fakePodExecutor.
+type fakeExecution struct {
+	Namespace     string
+	PodName       string
+	ContainerName string
+	Command       []string
+}
+
+// fakePodExecutor scripts pod exec without a cluster: each entry in stdout
+// maps a substring of the joined command line to the output it produces.
+// Safe for concurrent use, since ExecOnPods fans out across goroutines.
+type fakePodExecutor struct {
+	mutex      sync.Mutex
+	executions []fakeExecution
+	stdout     map[string]string
+	err        error
+}
+
+func (f *fakePodExecutor) Execute(namespace, podName, containerName string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	f.mutex.Lock()
+	f.executions = append(f.executions, fakeExecution{
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: containerName,
+		Command:       command,
+	})
+	f.mutex.Unlock()
+
+	if stdin != nil {
+		// Drain stdin the way a real remote command would.
+		_, _ = ioutil.ReadAll(stdin)
+	}
+
+	joined := strings.Join(command, " ")
+	for substring, output := range f.stdout {
+		if strings.Contains(joined, substring) && stdout != nil {
+			_, _ = io.WriteString(stdout, output)
+		}
+	}
+
+	return f.err
+}
+
+// usePodExecutor points the executor seam at the given executor and
+// returns a restore func the caller must defer.
+func usePodExecutor(executor PodExecutor) func() {
+	previous := podExecutor
+	podExecutor = executor
+	return func() { podExecutor = previous }
+}
+
+// memoryObjectStore is an in-memory ObjectStore keyed bucket -> key ->
+// content, standing in for S3 in tests.
+type memoryObjectStore struct {
+	objects map[string]map[string][]byte
+}
+
+func newMemoryObjectStore() *memoryObjectStore {
+	return &memoryObjectStore{objects: map[string]map[string][]byte{}}
+}
+
+// useObjectStore points the object store seam at the given store and
+// returns a restore func the caller must defer.
+func useObjectStore(store ObjectStore) func() {
+	previous := objectStore
+	objectStore = store
+	return func() { objectStore = previous }
+}
+
+// put seeds an object directly, without going through a local file.
+func (m *memoryObjectStore) put(bucket, key string, content []byte) {
+	if m.objects[bucket] == nil {
+		m.objects[bucket] = map[string][]byte{}
+	}
+	m.objects[bucket][key] = content
+}
+
+func (m *memoryObjectStore) Upload(bucket, key, filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	m.put(bucket, key, content)
+	return nil
+}
+
+func (m *memoryObjectStore) Download(bucket, key, filename string) error {
+	content, found := m.objects[bucket][key]
+	if !found {
+		return fmt.Errorf("no such object %v/%v", bucket, key)
+	}
+	return ioutil.WriteFile(filename, content, 0600)
+}
+
+func (m *memoryObjectStore) Delete(bucket, key string) error {
+	delete(m.objects[bucket], key)
+	return nil
+}
+
+func (m *memoryObjectStore) List(bucket, prefix string) ([]string, error) {
+	var keys []string
+	for key := range m.objects[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,149 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Extra backup destinations. backup_destinations is a comma separated
+// list of "bucket" or "bucket@endpoint" entries (an endpoint for
+// S3-compatible stores like an in-cluster MinIO); each finished backup is
+// uploaded to the primary bucket and every destination, and the outcomes
+// are recorded independently — one broken target does not fail the
+// backup as long as another accepted it.
+const BackupDestinationsSetting = "backup_destinations"
+
+// backupDestination is one extra target for finished backups.
+type backupDestination struct {
+	Bucket   string
+	Endpoint string
+}
+
+func (d backupDestination) String() string {
+	if d.Endpoint == "" {
+		return d.Bucket
+	}
+	return d.Bucket + "@" + d.Endpoint
+}
+
+// Parses the backup_destinations setting.
+func parseBackupDestinations() []backupDestination {
+	var destinations []backupDestination
+	for _, entry := range strings.Split(operatorConfig.GetString(BackupDestinationsSetting), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		destination := backupDestination{Bucket: entry}
+		if index := strings.Index(entry, "@"); index >= 0 {
+			destination.Bucket = entry[:index]
+			destination.Endpoint = entry[index+1:]
+		}
+		destinations = append(destinations, destination)
+	}
+	return destinations
+}
+
+// Uploads a local file to one extra destination. Endpoint destinations
+// use path-style addressing, which S3-compatible stores expect.
+func uploadToDestination(destination backupDestination, key, filename string) error {
+	if destination.Endpoint == "" {
+		return UploadFileToS3(destination.Bucket, key, filename)
+	}
+
+	if DryRun {
+		fmt.Printf("Dry run: would upload %v to %v\n", filename, destination)
+		return nil
+	}
+
+	fmt.Printf("Uploading %v to %v\n", filename, destination)
+
+	sess, err := newAWSSession()
+	if err != nil {
+		return err
+	}
+	config := aws.NewConfig().
+		WithEndpoint(destination.Endpoint).
+		WithS3ForcePathStyle(true)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q, %v", filename, err)
+	}
+	defer file.Close()
+
+	uploader := s3manager.NewUploader(sess.Copy(config))
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(destination.Bucket),
+		Key:    aws.String(key),
+		Body:   file,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload to %v, %v", destination, err)
+	}
+
+	fmt.Printf("Finished uploading to %v/%v\n", destination, key)
+	return nil
+}
+
+// UploadBackupEverywhere stores a finished backup in the primary bucket
+// and every configured extra destination. Per-destination outcomes are
+// recorded in the status ConfigMap; the upload as a whole only fails when
+// no destination accepted the backup.
+func UploadBackupEverywhere(s3Bucket, key, filename string) error {
+	var outcomes []string
+	var firstErr error
+	succeeded := 0
+
+	err := uploadBackup(s3Bucket, key, filename)
+	if err != nil {
+		fmt.Printf("upload to %v failed: %v\n", s3Bucket, err)
+		outcomes = append(outcomes, s3Bucket+"=failed")
+		firstErr = err
+	} else {
+		outcomes = append(outcomes, s3Bucket+"=ok")
+		succeeded++
+	}
+
+	for _, destination := range parseBackupDestinations() {
+		err := uploadToDestination(destination, key, filename)
+		if err != nil {
+			fmt.Printf("upload to %v failed: %v\n", destination, err)
+			outcomes = append(outcomes, destination.String()+"=failed")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		outcomes = append(outcomes, destination.String()+"=ok")
+		succeeded++
+	}
+
+	RecordStatus(map[string]string{
+		"lastBackupDestinations": strings.Join(outcomes, ","),
+	})
+
+	if succeeded == 0 {
+		return firstErr
+	}
+	return nil
+}
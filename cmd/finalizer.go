@@ -0,0 +1,167 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// Finalization of the operator's custom resources. The operator puts its
+// finalizer on every GitLab resource it reconciles, so deleting one
+// triggers orderly cleanup instead of leaving orphans: the running backup
+// (if it is this instance's) is canceled, the instance's runners are
+// deregistered, the staging PVC is removed, and — only when
+// delete_backups_on_removal says so — the instance's backups are deleted
+// from the bucket. Backups are kept by default; they are usually the only
+// thing left of a deleted instance.
+const (
+	OperatorFinalizer             = "gitlab-operator/cleanup"
+	DeleteBackupsOnRemovalSetting = "delete_backups_on_removal"
+)
+
+func hasFinalizer(obj *unstructured.Unstructured) bool {
+	for _, finalizer := range obj.GetFinalizers() {
+		if finalizer == OperatorFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureFinalizer puts the operator's finalizer on the resource so its
+// deletion waits for cleanup.
+func ensureFinalizer(client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	if hasFinalizer(obj) {
+		return nil
+	}
+	obj.SetFinalizers(append(obj.GetFinalizers(), OperatorFinalizer))
+	updated, err := client.Update(obj)
+	if err != nil {
+		return fmt.Errorf("unable to add finalizer to %v: %v", obj.GetName(), err)
+	}
+	*obj = *updated
+	return nil
+}
+
+// removeFinalizer releases the resource for actual deletion once cleanup
+// has run.
+func removeFinalizer(client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	var finalizers []string
+	for _, finalizer := range obj.GetFinalizers() {
+		if finalizer != OperatorFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	obj.SetFinalizers(finalizers)
+	_, err := client.Update(obj)
+	if err != nil {
+		return fmt.Errorf("unable to remove finalizer from %v: %v", obj.GetName(), err)
+	}
+	return nil
+}
+
+// Deregisters the instance's CI runners so the fleet does not keep polling
+// a GitLab that is going away. Best effort: the pod may already be gone.
+func deregisterRunners(namespace string) {
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return
+	}
+
+	options := ExecOptions{
+		Command:       []string{"gitlab-rails", "runner", "Ci::Runner.delete_all"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	err = ExecWithOptions(options)
+	if err != nil {
+		fmt.Printf("unable to deregister runners: %v\n", err)
+	}
+}
+
+// Deletes every backup object belonging to the instance from the bucket.
+// Only runs when delete_backups_on_removal is set.
+func deleteInstanceBackups(s3Bucket string) {
+	if !operatorConfig.GetBool(DeleteBackupsOnRemovalSetting) || s3Bucket == "" {
+		return
+	}
+
+	keys, err := ListS3Objects(s3Bucket, backupSearchPrefix())
+	if err != nil {
+		fmt.Printf("unable to list backups for deletion: %v\n", err)
+		return
+	}
+	keys = append(keys, chunkedBackupKeys(s3Bucket)...)
+
+	for _, key := range keys {
+		err = DeleteS3Object(s3Bucket, key)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			continue
+		}
+		if err = DeleteS3Object(s3Bucket, backupMetadataKey(key)); err == nil {
+			fmt.Printf("Deleted backup %v and its metadata\n", key)
+		}
+	}
+}
+
+// FinalizeGitLab runs the cleanup for a GitLab resource that is being
+// deleted, then releases the finalizer.
+func FinalizeGitLab(client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	namespace := obj.GetNamespace()
+	fmt.Printf("Finalizing GitLab instance %v/%v\n", namespace, obj.GetName())
+
+	// Stop any backup still running against the doomed instance.
+	if err := CancelActiveBackup(); err == nil {
+		fmt.Printf("Canceled the running backup of %v\n", obj.GetName())
+	}
+
+	if DryRun {
+		fmt.Printf("Dry run: would deregister runners and clean up for %v\n", obj.GetName())
+		return removeFinalizer(client, obj)
+	}
+
+	deregisterRunners(namespace)
+
+	s3Bucket := GetSpecString(obj, "s3")
+	if s3Bucket == "" {
+		s3Bucket = operatorConfig.GetString("s3")
+	}
+	deleteInstanceBackups(s3Bucket)
+
+	// The staging PVC is per-operator, not per-instance; remove it only
+	// when this instance was the last one.
+	if pvcName := operatorConfig.GetString(StagingPVCSetting); pvcName != "" {
+		if _, clientset, err := GetInCluster(); err == nil {
+			list, err := client.List(metav1.ListOptions{})
+			items, ok := list.(*unstructured.UnstructuredList)
+			if err == nil && ok && len(items.Items) <= 1 {
+				err = clientset.Core().PersistentVolumeClaims(namespace).Delete(pvcName, &metav1.DeleteOptions{})
+				if err != nil {
+					fmt.Printf("unable to delete staging PVC %v: %v\n", pvcName, err)
+				}
+			}
+		}
+	}
+
+	return removeFinalizer(client, obj)
+}
@@ -0,0 +1,228 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Promotion of a GitLab Geo secondary to primary, for failing over after
+// the primary site is lost. The workflow follows the documented manual
+// steps: verify the secondary's replication lag is within bounds, run
+// gitlab-ctl promote-to-primary-node on it, then repoint external DNS at
+// the promoted site.
+//
+// DNS is repointed two ways, both optional: when geo_dns_service names a
+// Service in the namespace, its external-dns hostname annotation is set to
+// geo_dns_hostname so the external-dns controller updates the provider;
+// and when post_promote_hook is configured it is exec'd in the promoted
+// pod, for sites that script their DNS provider directly.
+const (
+	GeoMaxLagSetting      = "geo_max_replication_lag"
+	GeoDNSServiceSetting  = "geo_dns_service"
+	GeoDNSHostnameSetting = "geo_dns_hostname"
+	HookPostPromote       = "post_promote_hook"
+
+	// external-dns reads this annotation to decide which record a Service
+	// should own.
+	ExternalDNSHostnameAnnotation = "external-dns.alpha.kubernetes.io/hostname"
+
+	// Replication lag above this aborts the promotion unless overridden
+	// with geo_max_replication_lag.
+	DefaultGeoMaxLag = time.Minute
+)
+
+// Seconds the secondary's replayed transaction log trails behind the last
+// received one. Zero when replay is caught up.
+func replicationLag(namespace, podName string) (time.Duration, error) {
+	output, err := gitlabPSQL(namespace, podName,
+		"SELECT COALESCE(EXTRACT(EPOCH FROM (now() - pg_last_xact_replay_timestamp()))::int, 0)")
+	if err != nil {
+		return 0, fmt.Errorf("unable to check replication lag: %v", err)
+	}
+
+	seconds, err := strconv.Atoi(output)
+	if err != nil {
+		return 0, fmt.Errorf("unable to check replication lag: unexpected output %q", output)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Points the configured Service's external-dns annotation at the promoted
+// site so the DNS provider follows. Best effort.
+func updateGeoDNS(namespace string) {
+	serviceName := operatorConfig.GetString(GeoDNSServiceSetting)
+	hostname := operatorConfig.GetString(GeoDNSHostnameSetting)
+	if serviceName == "" || hostname == "" {
+		return
+	}
+	if DryRun {
+		fmt.Printf("Dry run: would point %v at service %v\n", hostname, serviceName)
+		return
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		fmt.Printf("unable to update geo DNS: %v\n", err)
+		return
+	}
+
+	service, err := clientset.Core().Services(namespace).Get(serviceName, metav1.GetOptions{})
+	if err != nil {
+		fmt.Printf("unable to update geo DNS: %v\n", err)
+		return
+	}
+	if service.Annotations == nil {
+		service.Annotations = map[string]string{}
+	}
+	service.Annotations[ExternalDNSHostnameAnnotation] = hostname
+
+	_, err = clientset.Core().Services(namespace).Update(service)
+	if err != nil {
+		fmt.Printf("unable to update geo DNS: %v\n", err)
+		return
+	}
+	fmt.Printf("Pointed %v at service %v\n", hostname, serviceName)
+}
+
+// PromoteSecondary promotes the Geo secondary in the namespace to primary.
+// Refuses to run while replication lag exceeds geo_max_replication_lag,
+// since transactions the secondary has not replayed are lost at promotion.
+func PromoteSecondary(namespace string) error {
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	lag, err := replicationLag(namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	maxLag := operatorConfig.GetDuration(GeoMaxLagSetting)
+	if maxLag == 0 {
+		maxLag = DefaultGeoMaxLag
+	}
+	if lag > maxLag {
+		return fmt.Errorf("replication lag is %v, above the %v limit; data not yet replayed would be lost", lag, maxLag)
+	}
+
+	fmt.Printf("Begining promotion of Geo secondary %v, %v (replication lag %v)\n", namespace, podName, lag)
+	EmitNormalEvent(namespace, podName, "GeoPromotionStarted",
+		fmt.Sprintf("Geo promotion to primary started with replication lag %v", lag))
+
+	options := ExecOptions{
+		Command:       []string{"gitlab-ctl", "promote-to-primary-node", "-f"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	err = ExecWithOptions(options)
+	if err != nil {
+		EmitWarningEvent(namespace, podName, "GeoPromotionFailed",
+			fmt.Sprintf("Geo promotion failed: %v", err))
+		return fmt.Errorf("unable to promote secondary: %v", err)
+	}
+
+	updateGeoDNS(namespace)
+
+	err = RunHook(HookPostPromote, namespace, podName, GitLabContainerName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished promotion of Geo secondary\n")
+	EmitNormalEvent(namespace, podName, "GeoPromotionComplete", "Geo promotion to primary complete")
+	RecordStatus(map[string]string{
+		"lastPromotionTimestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	SendNotification(Notification{
+		Operation:   "promote-secondary",
+		Succeeded:   true,
+		Destination: namespace,
+	})
+
+	return nil
+}
+
+var PromoteConfirmed bool
+
+// promoteSecondaryCmd represents the promote-secondary command
+var promoteSecondaryCmd = &cobra.Command{
+	Use:          "promote-secondary",
+	Short:        "Promotes a GitLab Geo secondary to primary",
+	SilenceUsage: true,
+	Long: `Promotes the GitLab Geo secondary in the target namespace to primary:
+checks that replication has caught up, runs gitlab-ctl
+promote-to-primary-node, and repoints external DNS at the promoted site.
+Promotion is irreversible; the old primary must be rebuilt as a secondary
+afterwards. Pass --yes to skip the confirmation prompt.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		namespace, err := GetNamespace()
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		if !PromoteConfirmed && !DryRun {
+			fmt.Printf("About to promote the Geo secondary in %v to primary. This cannot be undone.\n", namespace)
+			fmt.Printf("Type the namespace to confirm: ")
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if strings.TrimSpace(answer) != namespace {
+				fmt.Println("promotion aborted")
+				ExitCode = 1
+				return
+			}
+		}
+
+		err = PromoteSecondary(namespace)
+		if err != nil {
+			fmt.Println(err)
+			SendNotification(Notification{
+				Operation:   "promote-secondary",
+				Succeeded:   false,
+				Destination: namespace,
+				Message:     err.Error(),
+			})
+			ExitCode = 1
+			return
+		}
+
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(promoteSecondaryCmd)
+
+	promoteSecondaryCmd.Flags().BoolVar(
+		&PromoteConfirmed,
+		"yes",
+		false,
+		"skip the interactive confirmation prompt")
+}
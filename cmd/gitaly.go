@@ -0,0 +1,193 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Gitaly-aware backups. Installs that shard repositories across several
+// Gitaly pods cannot be backed up from one pod: each storage's
+// repositories only exist on its own Gitaly. The gitaly strategy
+// enumerates the Gitaly pods, copies each storage's repositories from the
+// pod that holds them, and merges the uploads into one manifest. The rake
+// backup still covers the database and object-storage directories.
+const (
+	GitalySelectorSetting  = "gitaly_selector"
+	DefaultGitalySelector  = "app=gitaly"
+	GitalyStorageLabel     = "storage"
+	GitalyRepositoriesDir  = "/home/git/repositories"
+	// Outside the gitlab-backup- key space so per-storage component
+	// objects never resolve as the "latest" full backup.
+	GitalyBackupPrefixBase = "gitlab-gitaly-"
+)
+
+// One Gitaly storage and the pod serving it.
+type gitalyStorage struct {
+	Name    string
+	PodName string
+}
+
+// Enumerates the Gitaly storages in the namespace from the ready Gitaly
+// pods. The storage name comes from the pod's "storage" label, falling
+// back to the pod name for installs that do not label their Gitalys.
+func gitalyStorages(namespace string) ([]gitalyStorage, error) {
+	selector := operatorConfig.GetString(GitalySelectorSetting)
+	if selector == "" {
+		selector = DefaultGitalySelector
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := clientset.Core().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list gitaly pods: %v", err)
+	}
+
+	var storages []gitalyStorage
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || !isPodReady(pod) {
+			continue
+		}
+		name := pod.Labels[GitalyStorageLabel]
+		if name == "" {
+			name = pod.Name
+		}
+		storages = append(storages, gitalyStorage{Name: name, PodName: pod.Name})
+	}
+
+	if len(storages) == 0 {
+		return nil, fmt.Errorf("no ready gitaly pods match selector %v in namespace %v", selector, namespace)
+	}
+	return storages, nil
+}
+
+// Copies one storage's repositories out of its Gitaly pod and uploads
+// them under the backup's prefix.
+func backupGitalyStorage(namespace string, storage gitalyStorage, s3Bucket, prefix string) (BackupComponent, error) {
+	component := BackupComponent{
+		Name: storage.Name,
+		Key:  prefix + "/" + storage.Name + ".tar.gz",
+	}
+
+	localFilename := storage.Name + ".tar.gz"
+	src := fileSpec{
+		PodNamespace: namespace,
+		PodName:      storage.PodName,
+		File:         GitalyRepositoriesDir,
+	}
+	dest := fileSpec{File: localFilename}
+	err := CopyFromPod(src, dest)
+	if err != nil {
+		return component, fmt.Errorf("unable to copy storage %v from %v: %v", storage.Name, storage.PodName, err)
+	}
+	defer os.Remove(localFilename)
+
+	if info, err := os.Stat(localFilename); err == nil {
+		component.Size = info.Size()
+	}
+
+	err = UploadFileToS3(s3Bucket, component.Key, localFilename)
+	if err != nil {
+		return component, err
+	}
+
+	return component, nil
+}
+
+// BackupGitaly backs up every Gitaly storage's repositories from the pod
+// that holds them, in parallel, plus the database through gitlab-rake, and
+// merges everything into one manifest.
+func BackupGitaly(s3Bucket string) error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+
+	storages, err := gitalyStorages(namespace)
+	if err != nil {
+		return err
+	}
+
+	gitlabPod, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	prefix := GitalyBackupPrefixBase + timestamp
+	fmt.Printf("Begining gitaly-aware backup of %v storages in namespace %v\n", len(storages), namespace)
+	EmitNormalEvent(namespace, gitlabPod, EventBackupStarted,
+		fmt.Sprintf("Gitaly-aware GitLab backup of %v storages started", len(storages)))
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	manifest := BackupManifest{Timestamp: timestamp}
+	var failures []error
+
+	record := func(component BackupComponent, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%v: %v", component.Name, err))
+			return
+		}
+		manifest.Components = append(manifest.Components, component)
+	}
+
+	// The database and non-repository data still come from the GitLab pod;
+	// repositories are skipped there because the Gitaly pods own them.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		component, err := backupDatabase(namespace, gitlabPod, s3Bucket, prefix)
+		record(component, err)
+	}()
+
+	for _, storage := range storages {
+		wg.Add(1)
+		go func(storage gitalyStorage) {
+			defer wg.Done()
+			component, err := backupGitalyStorage(namespace, storage, s3Bucket, prefix)
+			record(component, err)
+		}(storage)
+	}
+
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return fmt.Errorf("gitaly-aware backup failed: %v", failures)
+	}
+
+	err = uploadManifest(s3Bucket, prefix, manifest)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished gitaly-aware backup of GitLab instance\n")
+	EmitNormalEvent(namespace, gitlabPod, EventBackupSucceeded,
+		fmt.Sprintf("Gitaly-aware GitLab backup uploaded to %v/%v", s3Bucket, prefix))
+
+	return nil
+}
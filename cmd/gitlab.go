@@ -0,0 +1,368 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Spec of a GitLab custom resource, read out of the unstructured object.
+type GitLabSpec struct {
+	Version     string
+	ExternalURL string
+	Storage     string
+	CPU         string
+	Memory      string
+}
+
+func gitLabSpecFrom(obj *unstructured.Unstructured) GitLabSpec {
+	spec := GitLabSpec{
+		Version:     GetSpecString(obj, "version"),
+		ExternalURL: GetSpecString(obj, "externalURL"),
+		Storage:     GetSpecString(obj, "storage"),
+		CPU:         GetSpecString(obj, "cpu"),
+		Memory:      GetSpecString(obj, "memory"),
+	}
+	if spec.Version == "" {
+		spec.Version = "latest"
+	}
+	if spec.Storage == "" {
+		spec.Storage = "50Gi"
+	}
+	return spec
+}
+
+func gitLabLabels(name string) map[string]string {
+	return map[string]string{
+		GitLabLabelKey: GitLabLabelValue,
+		"instance":     name,
+	}
+}
+
+// Parses the CPU and memory requests out of the spec. The quantities come
+// straight from a user-supplied resource, so a bad value is a reconcile
+// error for that resource, not a panic.
+func gitLabResources(spec GitLabSpec) (v1.ResourceRequirements, error) {
+	requests := v1.ResourceList{}
+	if spec.CPU != "" {
+		cpu, err := resource.ParseQuantity(spec.CPU)
+		if err != nil {
+			return v1.ResourceRequirements{}, fmt.Errorf("unable to parse cpu %q: %v", spec.CPU, err)
+		}
+		requests[v1.ResourceCPU] = cpu
+	}
+	if spec.Memory != "" {
+		memory, err := resource.ParseQuantity(spec.Memory)
+		if err != nil {
+			return v1.ResourceRequirements{}, fmt.Errorf("unable to parse memory %q: %v", spec.Memory, err)
+		}
+		requests[v1.ResourceMemory] = memory
+	}
+	return v1.ResourceRequirements{Requests: requests}, nil
+}
+
+// Reconciles the PersistentVolumeClaim holding the instance's data.
+func reconcilePVC(clientset kubernetes.Interface, namespace, name string, spec GitLabSpec) error {
+	storage, err := resource.ParseQuantity(spec.Storage)
+	if err != nil {
+		return fmt.Errorf("unable to parse storage %q: %v", spec.Storage, err)
+	}
+
+	pvcs := clientset.CoreV1().PersistentVolumeClaims(namespace)
+	_, err = pvcs.Get(name+"-data", metav1.GetOptions{})
+	if err == nil {
+		// Volume resizing is not supported; leave the existing claim alone.
+		return nil
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name + "-data", Labels: gitLabLabels(name)},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: storage,
+				},
+			},
+		},
+	}
+	_, err = pvcs.Create(pvc)
+	return err
+}
+
+// Reconciles the Deployment running the Omnibus GitLab container.
+func reconcileDeployment(clientset kubernetes.Interface, namespace, name string, spec GitLabSpec) error {
+	resources, err := gitLabResources(spec)
+	if err != nil {
+		return err
+	}
+
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: gitLabLabels(name)},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: gitLabLabels(name)},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: gitLabLabels(name)},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  GitLabContainerName,
+						Image: "gitlab/gitlab-ce:" + spec.Version,
+						Env: []v1.EnvVar{{
+							Name:  "GITLAB_OMNIBUS_CONFIG",
+							Value: fmt.Sprintf("external_url '%v'", spec.ExternalURL),
+						}},
+						Ports: []v1.ContainerPort{
+							{Name: "http", ContainerPort: 80},
+							{Name: "https", ContainerPort: 443},
+							{Name: "ssh", ContainerPort: 22},
+						},
+						Resources: resources,
+						VolumeMounts: []v1.VolumeMount{{
+							Name:      "data",
+							MountPath: "/var/opt/gitlab",
+						}},
+					}},
+					Volumes: []v1.Volume{{
+						Name: "data",
+						VolumeSource: v1.VolumeSource{
+							PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+								ClaimName: name + "-data",
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	deployments := clientset.AppsV1().Deployments(namespace)
+	existing, err := deployments.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = deployments.Create(deployment)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	existing.Spec = deployment.Spec
+	_, err = deployments.Update(existing)
+	return err
+}
+
+// Reconciles the Service and Ingress exposing the instance.
+func reconcileService(clientset kubernetes.Interface, namespace, name string, spec GitLabSpec) error {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: gitLabLabels(name)},
+		Spec: v1.ServiceSpec{
+			Selector: gitLabLabels(name),
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt(80)},
+				{Name: "https", Port: 443, TargetPort: intstr.FromInt(443)},
+				{Name: "ssh", Port: 22, TargetPort: intstr.FromInt(22)},
+			},
+		},
+	}
+
+	services := clientset.CoreV1().Services(namespace)
+	_, err := services.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = services.Create(service)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if spec.ExternalURL == "" {
+		return nil
+	}
+
+	host := hostFromURL(spec.ExternalURL)
+
+	// OpenShift routers do not watch Ingresses; expose the instance with a
+	// Route there instead.
+	if isOpenShift() {
+		return reconcileRoute(namespace, name, host)
+	}
+
+	ingress := &extensionsv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: gitLabLabels(name)},
+		Spec: extensionsv1beta1.IngressSpec{
+			Rules: []extensionsv1beta1.IngressRule{{
+				Host: host,
+				IngressRuleValue: extensionsv1beta1.IngressRuleValue{
+					HTTP: &extensionsv1beta1.HTTPIngressRuleValue{
+						Paths: []extensionsv1beta1.HTTPIngressPath{{
+							Backend: extensionsv1beta1.IngressBackend{
+								ServiceName: name,
+								ServicePort: intstr.FromInt(80),
+							},
+						}},
+					},
+				},
+			}},
+		},
+	}
+
+	// Terminate TLS with the cert-manager certificate when an issuer is
+	// configured.
+	if operatorConfig.GetString(CertIssuerSetting) != "" {
+		ingress.Spec.TLS = []extensionsv1beta1.IngressTLS{{
+			Hosts:      []string{host},
+			SecretName: certificateSecretName(name),
+		}}
+	}
+
+	ingresses := clientset.ExtensionsV1beta1().Ingresses(namespace)
+	existing, err := ingresses.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = ingresses.Create(ingress)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	existing.Spec = ingress.Spec
+	_, err = ingresses.Update(existing)
+	return err
+}
+
+// ReconcileGitLab brings the cluster objects for a GitLab custom resource
+// in line with its spec.
+func ReconcileGitLab(client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	namespace := obj.GetNamespace()
+	name := obj.GetName()
+	spec := gitLabSpecFrom(obj)
+
+	// A resource on its way out gets cleanup instead of reconciliation;
+	// everything else carries the finalizer that guarantees that cleanup.
+	if obj.GetDeletionTimestamp() != nil {
+		return FinalizeGitLab(client, obj)
+	}
+	err = ensureFinalizer(client, obj)
+	if err != nil {
+		return err
+	}
+
+	// A version change on an existing instance is an upgrade, which has
+	// its own orchestration (pre-upgrade backup, migration gating, and
+	// rollback) rather than a plain Deployment update.
+	previousVersion, _, _ := unstructured.NestedString(obj.Object, "status", "deployedVersion")
+	if previousVersion != "" && previousVersion != spec.Version {
+		return UpgradeGitLab(client, obj, previousVersion)
+	}
+
+	if DryRun {
+		fmt.Printf("Dry run: would reconcile GitLab instance %v/%v at version %v\n", namespace, name, spec.Version)
+		return nil
+	}
+
+	fmt.Printf("Reconciling GitLab instance %v/%v at version %v\n", namespace, name, spec.Version)
+
+	err = reconcilePVC(clientset, namespace, name, spec)
+	if err != nil {
+		return err
+	}
+	err = reconcileDeployment(clientset, namespace, name, spec)
+	if err != nil {
+		return err
+	}
+	err = reconcileService(clientset, namespace, name, spec)
+	if err != nil {
+		return err
+	}
+	err = ReconcileCertificates(client, obj)
+	if err != nil {
+		return err
+	}
+	err = ReconcileOmnibusConfig(client, obj)
+	if err != nil {
+		return err
+	}
+
+	return SetStatusField(client, obj, "deployedVersion", spec.Version)
+}
+
+// Periodically reconciles every GitLab resource in the configured
+// namespaces. A poll loop rather than a watch so that drift in the
+// managed objects is also repaired.
+func runGitLabController(stop <-chan struct{}) {
+	namespaces, err := WatchNamespaces()
+	if err != nil {
+		fmt.Printf("gitlab controller: %v\n", err)
+		return
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(30 * time.Second):
+		}
+
+		for _, namespace := range namespaces {
+			client, err := NewCRDClient("gitlabs", namespace)
+			if err != nil {
+				fmt.Printf("gitlab controller: %v\n", err)
+				continue
+			}
+
+			list, err := client.List(metav1.ListOptions{})
+			if err != nil {
+				fmt.Printf("unable to list gitlabs: %v\n", err)
+				continue
+			}
+
+			items, ok := list.(*unstructured.UnstructuredList)
+			if !ok {
+				continue
+			}
+			for i := range items.Items {
+				obj := &items.Items[i]
+				err = ReconcileGitLab(client, obj)
+				if err != nil {
+					fmt.Printf("unable to reconcile GitLab %v: %v\n", obj.GetName(), err)
+					SetStatusField(client, obj, "reason", err.Error())
+				}
+			}
+		}
+	}
+}
+
+func init() {
+	RegisterController(runGitLabController)
+}
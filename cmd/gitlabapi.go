@@ -0,0 +1,165 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Name of the Secret holding an admin API token under the key "token",
+// overridable with the api_token_secret setting.
+const DefaultAPITokenSecret = "gitlab-api-token"
+
+// GitLabAPIClient talks to a GitLab instance's REST API. The operator uses
+// it to coordinate with the application before destructive operations:
+// maintenance messaging before restores, version compatibility checks, and
+// background migration status before upgrades.
+type GitLabAPIClient struct {
+	BaseURL string
+	Token   string
+
+	client *http.Client
+}
+
+// NewGitLabAPIClient builds an API client for the instance at baseURL,
+// reading the admin token from the configured Secret in this namespace.
+func NewGitLabAPIClient(baseURL string) (*GitLabAPIClient, error) {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return nil, err
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	secretName := operatorConfig.GetString("api_token_secret")
+	if secretName == "" {
+		secretName = DefaultAPITokenSecret
+	}
+
+	secret, err := clientset.Core().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read api token secret %v: %v", secretName, err)
+	}
+	token, ok := secret.Data["token"]
+	if !ok {
+		return nil, fmt.Errorf("secret %v has no token key", secretName)
+	}
+
+	return &GitLabAPIClient{
+		BaseURL: baseURL,
+		Token:   string(token),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// do performs an authenticated request against the v4 API and decodes the
+// JSON response into out when out is non-nil.
+func (g *GitLabAPIClient) do(method, path string, body interface{}, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, g.BaseURL+"/api/v4"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("PRIVATE-TOKEN", g.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%v %v returned %v: %v", method, path, resp.Status, string(data))
+	}
+
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// Version returns the running GitLab version.
+func (g *GitLabAPIClient) Version() (string, error) {
+	var result struct {
+		Version string `json:"version"`
+	}
+	err := g.do("GET", "/version", nil, &result)
+	if err != nil {
+		return "", err
+	}
+	return result.Version, nil
+}
+
+// SetMaintenanceMessage puts a banner in front of users, e.g. before a
+// restore makes the instance read-only. An empty message clears it.
+func (g *GitLabAPIClient) SetMaintenanceMessage(message string) error {
+	if message == "" {
+		return g.do("DELETE", "/broadcast_messages/last", nil, nil)
+	}
+	return g.do("POST", "/broadcast_messages", map[string]string{"message": message}, nil)
+}
+
+// BackgroundMigrationsPending reports whether the instance still has
+// unfinished background migrations, which must drain before an upgrade.
+func (g *GitLabAPIClient) BackgroundMigrationsPending() (bool, error) {
+	var stats struct {
+		Enqueued int `json:"enqueued"`
+	}
+	err := g.do("GET", "/sidekiq/job_stats", nil, &stats)
+	if err != nil {
+		return false, err
+	}
+	return stats.Enqueued > 0, nil
+}
+
+// CheckVersionCompatibility fails when the backup's GitLab version differs
+// from the running instance; gitlab-rake refuses cross-version restores.
+func (g *GitLabAPIClient) CheckVersionCompatibility(backupVersion string) error {
+	version, err := g.Version()
+	if err != nil {
+		return err
+	}
+	if backupVersion != "" && backupVersion != version {
+		return fmt.Errorf("backup was taken on GitLab %v but the instance runs %v", backupVersion, version)
+	}
+	return nil
+}
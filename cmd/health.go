@@ -0,0 +1,101 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+)
+
+// Default address the operator's HTTP server listens on; override with the
+// listen_addr setting.
+const DefaultListenAddr = ":8080"
+
+// Checks that the Kubernetes API is reachable from this pod.
+func checkKubernetesAPI() error {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.Discovery().ServerVersion()
+	if err != nil {
+		return fmt.Errorf("kubernetes api unreachable: %v", err)
+	}
+	return nil
+}
+
+// Checks that object store credentials can be resolved. This does not
+// guarantee the bucket is writable, but catches missing or malformed
+// credentials at startup instead of three hours into a backup.
+func checkObjectStoreCredentials() error {
+	sess, err := newAWSSession()
+	if err != nil {
+		return err
+	}
+
+	_, err = sess.Config.Credentials.Get()
+	if err != nil {
+		return fmt.Errorf("object store credentials unavailable: %v", err)
+	}
+	return nil
+}
+
+// healthzHandler reports liveness. It always succeeds while the process
+// can serve HTTP; Kubernetes restarts the operator when it stops
+// responding (e.g., a wedged SPDY stream blocking the whole process).
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports readiness: the Kubernetes API must be reachable
+// and object store credentials resolvable.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	for _, check := range []func() error{checkKubernetesAPI, checkObjectStoreCredentials} {
+		err := check()
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// StartHealthServer serves /healthz and /readyz in the background so
+// Kubernetes probes can watch the operator.
+func StartHealthServer() {
+	addr := operatorConfig.GetString("listen_addr")
+	if addr == "" {
+		addr = DefaultListenAddr
+	}
+
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/hooks/backup", hookBackupHandler)
+
+	go func() {
+		fmt.Printf("Serving health endpoints on %v\n", addr)
+		err := http.ListenAndServe(addr, nil)
+		if err != nil {
+			fmt.Printf("health server failed: %v\n", err)
+		}
+	}()
+}
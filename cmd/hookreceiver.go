@@ -0,0 +1,97 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Inbound webhook that triggers an on-demand backup: point a GitLab
+// system hook (or any automation that can POST with the shared secret in
+// X-Gitlab-Token) at /hooks/backup on the operator's HTTP port for
+// "backup before risky change" workflows. Disabled unless
+// hook_secret_token is set. Triggers within the cooldown of a previous
+// one are coalesced so a burst of system hook events queues one backup,
+// not dozens.
+const (
+	HookSecretSetting = "hook_secret_token"
+
+	hookBackupCooldown = 10 * time.Minute
+)
+
+var (
+	hookMutex          sync.Mutex
+	lastHookBackupTime time.Time
+)
+
+// The event_name field of a GitLab system hook payload; generic POSTs
+// may omit the body entirely.
+type systemHookPayload struct {
+	EventName string `json:"event_name"`
+}
+
+// hookBackupHandler authenticates the shared secret and enqueues a
+// backup.
+func hookBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := operatorConfig.GetString(HookSecretSetting)
+	if secret == "" {
+		http.Error(w, "hook receiver not configured", http.StatusNotFound)
+		return
+	}
+	token := r.Header.Get("X-Gitlab-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	event := "webhook"
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil && len(body) > 0 {
+		var payload systemHookPayload
+		if json.Unmarshal(body, &payload) == nil && payload.EventName != "" {
+			event = payload.EventName
+		}
+	}
+
+	hookMutex.Lock()
+	if time.Since(lastHookBackupTime) < hookBackupCooldown {
+		hookMutex.Unlock()
+		fmt.Printf("Hook %v within cooldown of previous trigger; not queueing another backup\n", event)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "coalesced with recent backup")
+		return
+	}
+	lastHookBackupTime = time.Now()
+	hookMutex.Unlock()
+
+	fmt.Printf("Queueing backup triggered by hook %v\n", event)
+	EnqueueOperation("hook backup ("+event+")", func() error {
+		return Backup(operatorConfig.GetString("s3"), nil)
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "backup queued")
+}
@@ -0,0 +1,63 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+)
+
+// Hook stages. Each stage maps to a setting of the same name holding a
+// shell command exec'd in the target pod, e.g.
+// GITLAB_OPERATOR_PRE_BACKUP_HOOK="gitlab-ctl stop sidekiq". Whether a
+// failing hook aborts the operation or merely warns is controlled by
+// hook_failure_policy ("abort", the default, or "warn").
+const (
+	HookPreBackup   = "pre_backup_hook"
+	HookPostBackup  = "post_backup_hook"
+	HookPreRestore  = "pre_restore_hook"
+	HookPostRestore = "post_restore_hook"
+)
+
+// RunHook execs the configured hook command for a stage in the target
+// pod. Returns nil when no hook is configured, and also when the hook
+// fails but the failure policy is "warn".
+func RunHook(stage, namespace, podName, containerName string) error {
+	command := operatorConfig.GetString(stage)
+	if command == "" {
+		return nil
+	}
+
+	fmt.Printf("Running %v hook: %v\n", stage, command)
+
+	options := ExecOptions{
+		Command:       []string{"sh", "-c", command},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: containerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	err := ExecWithOptions(options)
+	if err == nil {
+		return nil
+	}
+
+	if operatorConfig.GetString("hook_failure_policy") == "warn" {
+		fmt.Printf("%v hook failed (continuing per hook_failure_policy): %v\n", stage, err)
+		return nil
+	}
+
+	return fmt.Errorf("%v hook failed: %v", stage, err)
+}
@@ -0,0 +1,173 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Repository housekeeping. GitLab's per-project housekeeping (git gc and
+// repack) is triggered through the API for every project, paced by
+// housekeeping_pause between projects so Gitaly is not saturated. Setting
+// housekeeping_interval to a duration runs it periodically, outside the
+// upload_day_window so the repacking happens off-hours.
+const (
+	HousekeepingIntervalSetting = "housekeeping_interval"
+	HousekeepingPauseSetting    = "housekeeping_pause"
+	DefaultHousekeepingPause    = 10 * time.Second
+)
+
+// One project as returned by the projects API.
+type apiProject struct {
+	ID                int    `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+// Lists every project on the instance, one page at a time.
+func (g *GitLabAPIClient) Projects() ([]apiProject, error) {
+	var projects []apiProject
+	for page := 1; ; page++ {
+		var batch []apiProject
+		err := g.do("GET", fmt.Sprintf("/projects?per_page=100&page=%v", page), nil, &batch)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		projects = append(projects, batch...)
+	}
+	return projects, nil
+}
+
+// TriggerHousekeeping starts housekeeping for one project.
+func (g *GitLabAPIClient) TriggerHousekeeping(projectID int) error {
+	return g.do("POST", fmt.Sprintf("/projects/%v/housekeeping", projectID), nil, nil)
+}
+
+// RunHousekeeping triggers housekeeping across every project on the
+// instance, pausing between projects, and records how many repositories
+// were processed.
+func RunHousekeeping() error {
+	client, err := NewGitLabAPIClient(operatorConfig.GetString("api_url"))
+	if err != nil {
+		return err
+	}
+
+	pause := operatorConfig.GetDuration(HousekeepingPauseSetting)
+	if pause <= 0 {
+		pause = DefaultHousekeepingPause
+	}
+
+	projects, err := client.Projects()
+	if err != nil {
+		return fmt.Errorf("unable to list projects: %v", err)
+	}
+
+	fmt.Printf("Begining housekeeping of %v projects\n", len(projects))
+	start := time.Now()
+
+	processed := 0
+	var failed []string
+	for index, project := range projects {
+		if index > 0 {
+			time.Sleep(pause)
+		}
+
+		if DryRun {
+			fmt.Printf("Dry run: would trigger housekeeping of %v\n", project.PathWithNamespace)
+			continue
+		}
+
+		err = client.TriggerHousekeeping(project.ID)
+		if err != nil {
+			fmt.Printf("housekeeping of %v failed: %v\n", project.PathWithNamespace, err)
+			failed = append(failed, project.PathWithNamespace)
+			continue
+		}
+		processed++
+	}
+
+	fmt.Printf("Finished housekeeping: %v of %v projects processed in %v\n",
+		processed, len(projects), time.Since(start).Round(time.Second))
+	RecordStatus(map[string]string{
+		"lastHousekeepingTimestamp": start.UTC().Format(time.RFC3339),
+		"lastHousekeepingProjects":  strconv.Itoa(processed),
+	})
+
+	if len(failed) > 0 {
+		return fmt.Errorf("housekeeping failed for %v projects: %v", len(failed), failed)
+	}
+	return nil
+}
+
+// Runs housekeeping at the configured interval, skipping runs that would
+// land inside the daytime window. Disabled unless housekeeping_interval is
+// set.
+func runHousekeepingController(stop <-chan struct{}) {
+	interval := operatorConfig.GetDuration(HousekeepingIntervalSetting)
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if inDayWindow(time.Now()) {
+			fmt.Printf("Skipping housekeeping run inside the daytime window\n")
+			continue
+		}
+
+		err := RunHousekeeping()
+		if err != nil {
+			fmt.Printf("housekeeping run failed: %v\n", err)
+		}
+	}
+}
+
+// housekeepingCmd represents the housekeeping command
+var housekeepingCmd = &cobra.Command{
+	Use:          "housekeeping",
+	Short:        "Triggers repository housekeeping across all projects",
+	SilenceUsage: true,
+	Long: `Triggers GitLab housekeeping (git gc and repack) for every project
+through the API, pausing between projects to limit Gitaly load.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := RunHousekeeping()
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(housekeepingCmd)
+	RegisterController(runHousekeepingController)
+}
@@ -0,0 +1,262 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	GitLabRepositoryDir = "/var/opt/gitlab/git-data/repositories"
+
+	// Key prefix for incremental bundle backups in the bucket, outside
+	// the gitlab-backup- key space so bundles never resolve as the
+	// "latest" full backup.
+	IncrementalBackupPrefix = "gitlab-bundles"
+
+	// A full bundle of every repository is taken this often; in between,
+	// bundles contain only changes since the recorded ref tips.
+	IncrementalFullInterval = 7 * 24 * time.Hour
+)
+
+// IncrementalManifest records, per repository, the ref tips contained in
+// the bundles uploaded so far, so the next run can bundle only new
+// commits. Full backups reset the manifest.
+type IncrementalManifest struct {
+	// Timestamp of the last full bundle run, RFC3339.
+	LastFull string `json:"lastFull"`
+	// Repository path (relative to GitLabRepositoryDir) to the ref tips
+	// already captured.
+	Repositories map[string][]string `json:"repositories"`
+}
+
+func incrementalManifestKey() string {
+	return IncrementalBackupPrefix + "/manifest.json"
+}
+
+// Fetches the incremental manifest from the bucket. A missing manifest is
+// not an error; it just forces a full backup.
+func loadIncrementalManifest(s3Bucket string) *IncrementalManifest {
+	localFilename := "incremental-manifest.json"
+	err := DownloadFromS3(s3Bucket, incrementalManifestKey(), localFilename)
+	if err != nil {
+		fmt.Printf("No incremental manifest found, taking a full backup: %v\n", err)
+		return nil
+	}
+	defer os.Remove(localFilename)
+
+	data, err := ioutil.ReadFile(localFilename)
+	if err != nil {
+		return nil
+	}
+
+	manifest := &IncrementalManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		fmt.Printf("Unable to parse incremental manifest, taking a full backup: %v\n", err)
+		return nil
+	}
+
+	return manifest
+}
+
+func saveIncrementalManifest(s3Bucket string, manifest *IncrementalManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	localFilename := "incremental-manifest.json"
+	err = ioutil.WriteFile(localFilename, data, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFilename)
+
+	return UploadFileToS3(s3Bucket, incrementalManifestKey(), localFilename)
+}
+
+// Enumerates the bare repositories in the GitLab pod, as paths relative to
+// GitLabRepositoryDir.
+func listRepositories(namespace, podName string) ([]string, error) {
+	options := ExecOptions{
+		Command:       []string{"find", GitLabRepositoryDir, "-type", "d", "-name", "*.git"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to enumerate repositories: %v", err)
+	}
+
+	var repos []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasSuffix(line, ".wiki.git") {
+			continue
+		}
+		repos = append(repos, strings.TrimPrefix(line, GitLabRepositoryDir+"/"))
+	}
+
+	return repos, nil
+}
+
+// Returns the SHAs of all ref tips in a repository.
+func repositoryTips(namespace, podName, repo string) ([]string, error) {
+	options := ExecOptions{
+		Command: []string{"git", "--git-dir", GitLabRepositoryDir + "/" + repo,
+			"rev-parse", "--branches", "--tags"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(stdout), nil
+}
+
+// Creates a bundle of the repository in the pod, containing everything
+// except the excluded tips, and uploads it. Returns false when there is
+// nothing new to bundle.
+func bundleRepository(namespace, podName, s3Bucket, timestamp, repo string, exclude []string) (bool, error) {
+	bundleFile := "/tmp/gitlab-operator.bundle"
+	command := []string{"git", "--git-dir", GitLabRepositoryDir + "/" + repo,
+		"bundle", "create", bundleFile, "--branches", "--tags"}
+	for _, tip := range exclude {
+		command = append(command, "^"+tip)
+	}
+
+	options := ExecOptions{
+		Command:       command,
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	_, stderr, err := ExecWithOutput(options)
+	if err != nil {
+		// An empty bundle means the repository has no new commits.
+		if strings.Contains(stderr, "empty bundle") {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to bundle %v: %v", repo, err)
+	}
+
+	localFilename := strings.Replace(repo, "/", "_", -1) + ".bundle"
+	src := fileSpec{
+		PodNamespace: namespace,
+		PodName:      podName,
+		File:         bundleFile,
+	}
+	err = CopyFromPod(src, fileSpec{File: localFilename})
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(localFilename)
+
+	key := fmt.Sprintf("%v/%v/%v", IncrementalBackupPrefix, timestamp, localFilename)
+	err = UploadFileToS3(s3Bucket, key, localFilename)
+	if err != nil {
+		return false, err
+	}
+
+	options.Command = []string{"rm", "-f", bundleFile}
+	ExecWithOptions(options)
+
+	return true, nil
+}
+
+// BackupIncremental bundles only the commits added since the last run and
+// uploads the deltas, with a periodic full bundle for compaction. Far
+// cheaper than daily full tarballs for large installations.
+func BackupIncremental(s3Bucket string) error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	manifest := loadIncrementalManifest(s3Bucket)
+	full := manifest == nil
+	if !full {
+		lastFull, err := time.Parse(time.RFC3339, manifest.LastFull)
+		full = err != nil || time.Since(lastFull) > IncrementalFullInterval
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	if full {
+		fmt.Printf("Begining full bundle backup of repositories in %v, %v\n", namespace, podName)
+		manifest = &IncrementalManifest{LastFull: timestamp}
+	} else {
+		fmt.Printf("Begining incremental bundle backup of repositories in %v, %v\n", namespace, podName)
+	}
+	if manifest.Repositories == nil {
+		manifest.Repositories = map[string][]string{}
+	}
+
+	repos, err := listRepositories(namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	bundled := 0
+	for _, repo := range repos {
+		tips, err := repositoryTips(namespace, podName, repo)
+		if err != nil {
+			return err
+		}
+
+		var exclude []string
+		if !full {
+			exclude = manifest.Repositories[repo]
+		}
+
+		uploaded, err := bundleRepository(namespace, podName, s3Bucket, timestamp, repo, exclude)
+		if err != nil {
+			return err
+		}
+		if uploaded {
+			bundled++
+		}
+		manifest.Repositories[repo] = tips
+	}
+
+	err = saveIncrementalManifest(s3Bucket, manifest)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished bundle backup: %v of %v repositories had changes\n", bundled, len(repos))
+
+	return nil
+}
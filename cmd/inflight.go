@@ -0,0 +1,179 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// In-flight operation state, persisted to a ConfigMap so a restarted
+// operator knows what its predecessor was doing when it died. An operation
+// found here at startup did not finish: the new instance kills the
+// orphaned rake process in the target pod, deletes the partial object from
+// the bucket, and removes the staged local file, instead of leaving them
+// to leak silently.
+const (
+	InflightConfigMapName = "gitlab-operator-inflight"
+	inflightConfigMapKey  = "operation"
+)
+
+// Phases an in-flight backup moves through, recorded so recovery knows
+// what can exist to clean up.
+const (
+	InflightPhaseRunning   = "running"
+	InflightPhaseCopying   = "copying"
+	InflightPhaseUploading = "uploading"
+)
+
+// inflightOperation is the persisted state of one running operation.
+type inflightOperation struct {
+	Operation     string    `json:"operation"`
+	Phase         string    `json:"phase"`
+	Namespace     string    `json:"namespace"`
+	PodName       string    `json:"podName"`
+	ContainerName string    `json:"containerName"`
+	Bucket        string    `json:"bucket,omitempty"`
+	Key           string    `json:"key,omitempty"`
+	LocalPath     string    `json:"localPath,omitempty"`
+	StartedAt     time.Time `json:"startedAt"`
+}
+
+// Writes the in-flight record. Best effort: losing the record only costs
+// cleanup after a crash, and must not fail the operation itself.
+func recordInflight(operation inflightOperation) {
+	namespace, err := GetNamespace()
+	if err != nil {
+		fmt.Printf("unable to record in-flight operation: %v\n", err)
+		return
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		fmt.Printf("unable to record in-flight operation: %v\n", err)
+		return
+	}
+
+	data, err := json.Marshal(operation)
+	if err != nil {
+		fmt.Printf("unable to record in-flight operation: %v\n", err)
+		return
+	}
+
+	configMaps := clientset.Core().ConfigMaps(namespace)
+	existing, err := configMaps.Get(InflightConfigMapName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		configMap := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: InflightConfigMapName},
+			Data:       map[string]string{inflightConfigMapKey: string(data)},
+		}
+		_, err = configMaps.Create(configMap)
+	} else if err == nil {
+		existing.Data = map[string]string{inflightConfigMapKey: string(data)}
+		_, err = configMaps.Update(existing)
+	}
+	if err != nil {
+		fmt.Printf("unable to record in-flight operation: %v\n", err)
+	}
+}
+
+// clearInflight removes the in-flight record once the operation has run to
+// completion (successfully or not) in this process, since either way the
+// normal code paths have already cleaned up.
+func clearInflight() {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return
+	}
+
+	err = clientset.Core().ConfigMaps(namespace).Delete(InflightConfigMapName, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		fmt.Printf("unable to clear in-flight operation: %v\n", err)
+	}
+}
+
+// Reads the in-flight record left by a previous operator instance, if any.
+func readInflight() (inflightOperation, bool) {
+	var operation inflightOperation
+
+	namespace, err := GetNamespace()
+	if err != nil {
+		return operation, false
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return operation, false
+	}
+
+	configMap, err := clientset.Core().ConfigMaps(namespace).Get(InflightConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return operation, false
+	}
+	err = json.Unmarshal([]byte(configMap.Data[inflightConfigMapKey]), &operation)
+	if err != nil {
+		return operation, false
+	}
+
+	return operation, true
+}
+
+// RecoverInflightOperation cleans up after an operation a previous
+// operator instance left unfinished: the remote rake process is killed,
+// the partially uploaded object is deleted, and the staged local file is
+// removed. Called once at operator startup.
+func RecoverInflightOperation() {
+	operation, found := readInflight()
+	if !found {
+		return
+	}
+
+	fmt.Printf("Recovering %v started %v, left in phase %v by a previous operator instance\n",
+		operation.Operation, operation.StartedAt.Format(time.RFC3339), operation.Phase)
+
+	if operation.PodName != "" {
+		killRemoteBackup(operation.Namespace, operation.PodName, operation.ContainerName)
+	}
+
+	if operation.Phase == InflightPhaseUploading && operation.Bucket != "" && operation.Key != "" {
+		err := DeleteS3Object(operation.Bucket, operation.Key)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	}
+
+	if operation.LocalPath != "" {
+		os.Remove(operation.LocalPath)
+	}
+
+	if operation.PodName != "" {
+		EmitWarningEvent(operation.Namespace, operation.PodName, "OperationRecovered",
+			fmt.Sprintf("Cleaned up %v orphaned by an operator restart in phase %v",
+				operation.Operation, operation.Phase))
+	}
+	RecordStatus(map[string]string{
+		"lastRecoveredOperation": operation.Operation + " (" + operation.Phase + ")",
+	})
+
+	clearInflight()
+}
@@ -0,0 +1,150 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Cache of pods matching the GitLab selector in the operator's namespace,
+// kept current with a plain list+watch loop. When running as a long-lived
+// operator the cache answers pod lookups instead of hitting the API server
+// on every invocation, and reacts immediately when the GitLab pod is
+// rescheduled mid-backup.
+var (
+	podCacheMutex sync.RWMutex
+	podCache      map[string]*v1.Pod
+)
+
+// StartPodInformer primes the pod cache with a List and keeps it current
+// with a Watch in the background until the stop channel closes. One-shot
+// commands skip this and fall back to direct List calls.
+func StartPodInformer(namespace string, stop <-chan struct{}) error {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	resourceVersion, err := relistPods(clientset, namespace)
+	if err != nil {
+		return fmt.Errorf("unable to prime pod cache: %v", err)
+	}
+
+	go watchPods(clientset, namespace, resourceVersion, stop)
+
+	fmt.Printf("Pod cache primed for selector %v\n", gitLabSelector())
+	return nil
+}
+
+// Replaces the cache contents with a fresh List and returns the resource
+// version to resume watching from.
+func relistPods(clientset kubernetes.Interface, namespace string) (string, error) {
+	pods, err := clientset.Core().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: gitLabSelector(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	cache := map[string]*v1.Pod{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		cache[pod.Name] = pod
+	}
+
+	podCacheMutex.Lock()
+	podCache = cache
+	podCacheMutex.Unlock()
+
+	return pods.ResourceVersion, nil
+}
+
+// Applies watch events to the cache, re-listing whenever the watch expires
+// or fails, until the stop channel closes.
+func watchPods(clientset kubernetes.Interface, namespace, resourceVersion string, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		watcher, err := clientset.Core().Pods(namespace).Watch(metav1.ListOptions{
+			LabelSelector:   gitLabSelector(),
+			ResourceVersion: resourceVersion,
+		})
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Second):
+			}
+			if version, err := relistPods(clientset, namespace); err == nil {
+				resourceVersion = version
+			}
+			continue
+		}
+
+		for event := range watcher.ResultChan() {
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok {
+				// Includes watch errors such as an expired resource
+				// version; break out and re-list.
+				break
+			}
+			resourceVersion = pod.ResourceVersion
+
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				podCacheMutex.Lock()
+				podCache[pod.Name] = pod
+				podCacheMutex.Unlock()
+			case watch.Deleted:
+				podCacheMutex.Lock()
+				delete(podCache, pod.Name)
+				podCacheMutex.Unlock()
+				fmt.Printf("GitLab pod %v was deleted; in-flight operations against it will fail\n", pod.Name)
+			}
+		}
+		watcher.Stop()
+	}
+}
+
+// Returns the names of Ready, non-Terminating GitLab pods from the cache,
+// or nil when the cache is not running.
+func cachedGitLabPods() []string {
+	podCacheMutex.RLock()
+	defer podCacheMutex.RUnlock()
+	if podCache == nil {
+		return nil
+	}
+
+	var podNames []string
+	for _, pod := range podCache {
+		if pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil || !isPodReady(pod) {
+			continue
+		}
+		podNames = append(podNames, pod.Name)
+	}
+
+	return podNames
+}
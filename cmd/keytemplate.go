@@ -0,0 +1,117 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Key templating and object tagging for buckets shared by several
+// instances. s3_key_template renders the object key of each backup from
+// placeholders, e.g.
+//
+//	{instance}/{year}/{month}/gitlab-backup-{timestamp}{ext}
+//
+// ({instance} is the instance's namespace). The template must keep
+// {timestamp} so keys stay resolvable; text before the first time-based
+// placeholder is used as the listing prefix. s3_object_tags attaches
+// tags ("team=infra,environment=prod,retention=standard") to every
+// uploaded backup so bucket lifecycle rules can key off them.
+const (
+	S3KeyTemplateSetting = "s3_key_template"
+	S3ObjectTagsSetting  = "s3_object_tags"
+)
+
+// Renders the key template for a backup taken at the given time.
+func renderKeyTemplate(template, instance, timestamp string, now time.Time) string {
+	replacer := strings.NewReplacer(
+		"{instance}", instance,
+		"{namespace}", instance,
+		"{year}", now.UTC().Format("2006"),
+		"{month}", now.UTC().Format("01"),
+		"{day}", now.UTC().Format("02"),
+		"{timestamp}", timestamp,
+		"{ext}", CurrentCompression().Extension,
+	)
+	return replacer.Replace(template)
+}
+
+// backupObjectKey returns the bucket key for a backup taken at the given
+// time: the templated key when s3_key_template is set, and the flat
+// default otherwise.
+func backupObjectKey(timestamp string, now time.Time) string {
+	template := operatorConfig.GetString(S3KeyTemplateSetting)
+	if template == "" {
+		return GitLabLocalBackupPrefix + timestamp + CurrentCompression().Extension
+	}
+
+	instance, _ := GetNamespace()
+	return renderKeyTemplate(template, instance, timestamp, now)
+}
+
+// backupKeyForTimestamp reconstructs the key of a backup from its
+// RFC3339 timestamp, honoring the template.
+func backupKeyForTimestamp(timestamp string) string {
+	now, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		now = time.Now()
+	}
+	return backupObjectKey(timestamp, now)
+}
+
+// backupSearchPrefix returns the listing prefix backups live under: the
+// template rendered up to its first time-based placeholder, or the flat
+// default prefix.
+func backupSearchPrefix() string {
+	template := operatorConfig.GetString(S3KeyTemplateSetting)
+	if template == "" {
+		return GitLabLocalBackupPrefix
+	}
+
+	instance, _ := GetNamespace()
+	template = strings.Replace(template, "{instance}", instance, -1)
+	template = strings.Replace(template, "{namespace}", instance, -1)
+	if index := strings.Index(template, "{"); index >= 0 {
+		template = template[:index]
+	}
+	return template
+}
+
+// objectTagging renders the s3_object_tags setting as the URL-encoded
+// tag set S3 expects, or "" when no tags are configured.
+func objectTagging() string {
+	setting := operatorConfig.GetString(S3ObjectTagsSetting)
+	if setting == "" {
+		return ""
+	}
+
+	values := url.Values{}
+	for _, pair := range strings.Split(setting, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			fmt.Printf("ignoring malformed s3_object_tags entry %v\n", pair)
+			continue
+		}
+		values.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return values.Encode()
+}
@@ -0,0 +1,215 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+// Per-backup metadata lives under its own prefix, outside the
+// gitlab-backup- key space the tarballs are listed under, so it never
+// collides with the backups when "latest" is resolved by lexical key
+// order.
+const BackupMetadataPrefix = "gitlab-meta/"
+
+// BackupInfo describes one backup available in the bucket, combining the
+// object listing with the metadata uploaded alongside the backup.
+type BackupInfo struct {
+	Key           string
+	Timestamp     string
+	Size          int64
+	GitLabVersion string
+	Checksum      string
+}
+
+// Key of the metadata object for a backup tarball key.
+func backupMetadataKey(key string) string {
+	return BackupMetadataPrefix + key + ".json"
+}
+
+// UploadBackupMetadata uploads a backup's BackupResult as JSON next to the
+// backup itself. Best effort: list-backups degrades gracefully without it.
+func UploadBackupMetadata(s3Bucket, key string, result BackupResult) {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		fmt.Printf("unable to upload backup metadata: %v\n", err)
+		return
+	}
+
+	localFilename := "backup-meta.json"
+	err = ioutil.WriteFile(localFilename, data, 0600)
+	if err != nil {
+		fmt.Printf("unable to upload backup metadata: %v\n", err)
+		return
+	}
+	defer os.Remove(localFilename)
+
+	err = UploadFileToS3(s3Bucket, backupMetadataKey(key), localFilename)
+	if err != nil {
+		fmt.Printf("unable to upload backup metadata: %v\n", err)
+		return
+	}
+
+	err = uploadBackupSignature(s3Bucket, key, data)
+	if err != nil {
+		fmt.Printf("unable to upload backup metadata signature: %v\n", err)
+	}
+}
+
+// Fetches the metadata object for a backup key. Returns false when no
+// metadata was uploaded for the backup.
+func fetchBackupMetadata(s3Bucket, key string) (BackupResult, bool) {
+	var result BackupResult
+
+	sess, err := newAWSSession()
+	if err != nil {
+		return result, false
+	}
+
+	object, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(backupMetadataKey(key)),
+	})
+	if err != nil {
+		return result, false
+	}
+	defer object.Body.Close()
+
+	data, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return result, false
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return result, false
+	}
+
+	return result, true
+}
+
+// ListBackups enumerates the backups in the bucket, in chronological order,
+// merging in metadata where a backup has any.
+func ListBackups(s3Bucket string) ([]BackupInfo, error) {
+	sess, err := newAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []BackupInfo
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3Bucket),
+		Prefix: aws.String(backupSearchPrefix()),
+	}
+	err = s3.New(sess).ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			timestamp := strings.TrimPrefix(path.Base(key), GitLabLocalBackupPrefix)
+			if index := strings.Index(timestamp, ".tar"); index >= 0 {
+				timestamp = timestamp[:index]
+			}
+			backups = append(backups, BackupInfo{
+				Key:       key,
+				Timestamp: timestamp,
+				Size:      aws.Int64Value(object.Size),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list backups in %v: %v", s3Bucket, err)
+	}
+
+	// Chunked backups have no tarball object; list them from their chunk
+	// indexes, with sizes taken from the index.
+	for _, key := range chunkedBackupKeys(s3Bucket) {
+		timestamp := strings.TrimPrefix(key, GitLabLocalBackupPrefix)
+		if index := strings.Index(timestamp, ".tar"); index >= 0 {
+			timestamp = timestamp[:index]
+		}
+		info := BackupInfo{Key: key, Timestamp: timestamp}
+		if index, err := fetchChunkIndex(s3Bucket, key); err == nil {
+			info.Size = index.Size
+		}
+		backups = append(backups, info)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Key < backups[j].Key })
+
+	for index := range backups {
+		metadata, found := fetchBackupMetadata(s3Bucket, backups[index].Key)
+		if !found {
+			continue
+		}
+		backups[index].GitLabVersion = metadata.GitLabVersion
+		backups[index].Checksum = metadata.Checksum
+	}
+
+	return backups, nil
+}
+
+// listBackupsCmd represents the list-backups command
+var listBackupsCmd = &cobra.Command{
+	Use:          "list-backups [-s bucket]",
+	Short:        "Lists the backups available in the bucket",
+	SilenceUsage: true,
+	Long: `Lists the GitLab backups available in the s3 bucket with their
+timestamps, sizes, GitLab versions, and checksums, so a restore target can
+be picked.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		s3Bucket := operatorConfig.GetString("s3")
+		backups, err := ListBackups(s3Bucket)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(writer, "TIMESTAMP\tSIZE\tVERSION\tCHECKSUM\tKEY\n")
+		for _, backup := range backups {
+			version := backup.GitLabVersion
+			if version == "" {
+				version = "-"
+			}
+			checksum := backup.Checksum
+			if checksum == "" {
+				checksum = "-"
+			} else if len(checksum) > 12 {
+				checksum = checksum[:12]
+			}
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\n",
+				backup.Timestamp, backup.Size, version, checksum, backup.Key)
+		}
+		writer.Flush()
+
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(listBackupsCmd)
+}
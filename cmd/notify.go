@@ -0,0 +1,155 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"time"
+)
+
+// Notification describes the outcome of an operator action. Notifications
+// are fanned out to every configured Notifier.
+type Notification struct {
+	Operation   string        `json:"operation"`
+	Succeeded   bool          `json:"succeeded"`
+	Size        int64         `json:"size,omitempty"`
+	Duration    time.Duration `json:"duration,omitempty"`
+	Destination string        `json:"destination,omitempty"`
+	Message     string        `json:"message,omitempty"`
+}
+
+func (n Notification) String() string {
+	outcome := "succeeded"
+	if !n.Succeeded {
+		outcome = "failed"
+	}
+	text := fmt.Sprintf("gitlab-operator: %v %v", n.Operation, outcome)
+	if n.Destination != "" {
+		text += fmt.Sprintf(", destination %v", n.Destination)
+	}
+	if n.Size > 0 {
+		text += fmt.Sprintf(", %v bytes", n.Size)
+	}
+	if n.Duration > 0 {
+		text += fmt.Sprintf(", took %v", n.Duration.Round(time.Second))
+	}
+	if n.Message != "" {
+		text += ": " + n.Message
+	}
+	return text
+}
+
+// Notifier delivers a Notification to one target.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// Posts notifications to a Slack incoming webhook.
+type slackNotifier struct {
+	webhookURL string
+}
+
+func (s slackNotifier) Notify(n Notification) error {
+	payload, err := json.Marshal(map[string]string{"text": n.String()})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(s.webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+// Posts the notification as JSON to a generic HTTP webhook.
+type webhookNotifier struct {
+	url string
+}
+
+func (w webhookNotifier) Notify(n Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+// Sends the notification as a plain text email.
+type smtpNotifier struct {
+	addr string
+	from string
+	to   string
+}
+
+func (s smtpNotifier) Notify(n Notification) error {
+	msg := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: %v\r\n\r\n%v\r\n",
+		s.from, s.to, n.String(), n.String())
+	return smtp.SendMail(s.addr, nil, s.from, []string{s.to}, []byte(msg))
+}
+
+// Builds the notifier list from the operator config. Recognized settings
+// (flags or GITLAB_OPERATOR_* env vars): slack_webhook, notify_webhook,
+// smtp_addr, smtp_from, smtp_to.
+func configuredNotifiers() []Notifier {
+	var notifiers []Notifier
+
+	if url := operatorConfig.GetString("slack_webhook"); url != "" {
+		notifiers = append(notifiers, slackNotifier{webhookURL: url})
+	}
+	if url := operatorConfig.GetString("notify_webhook"); url != "" {
+		notifiers = append(notifiers, webhookNotifier{url: url})
+	}
+	addr := operatorConfig.GetString("smtp_addr")
+	from := operatorConfig.GetString("smtp_from")
+	to := operatorConfig.GetString("smtp_to")
+	if addr != "" && from != "" && to != "" {
+		notifiers = append(notifiers, smtpNotifier{addr: addr, from: from, to: to})
+	}
+	if notifier := providerNotifier(); notifier != nil {
+		notifiers = append(notifiers, notifier)
+	}
+
+	return notifiers
+}
+
+// SendNotification fans the notification out to all configured targets.
+// Delivery is best effort: failures are logged and do not affect the
+// operation's own outcome.
+func SendNotification(n Notification) {
+	for _, notifier := range configuredNotifiers() {
+		err := notifier.Notify(n)
+		if err != nil {
+			fmt.Printf("unable to send notification: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// Path of the rendered omnibus configuration in the GitLab container.
+const GitLabConfigFile = "/etc/gitlab/gitlab.rb"
+
+// renderOmnibusConfig renders the omnibus settings declared in a GitLab
+// resource's spec.omnibusConfig into gitlab.rb syntax. Keys are emitted in
+// sorted order so repeated renders of the same spec are byte-identical and
+// drift detection can compare strings. external_url always comes from the
+// spec's own field so the two cannot disagree.
+func renderOmnibusConfig(spec GitLabSpec, settings map[string]interface{}) string {
+	var builder bytes.Buffer
+	builder.WriteString("# Managed by gitlab-operator; edits here will be overwritten.\n")
+	if spec.ExternalURL != "" {
+		builder.WriteString(fmt.Sprintf("external_url '%v'\n", spec.ExternalURL))
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		switch value := settings[key].(type) {
+		case string:
+			builder.WriteString(fmt.Sprintf("%v '%v'\n", key, value))
+		default:
+			// Booleans and numbers are valid ruby literals as-is.
+			builder.WriteString(fmt.Sprintf("%v %v\n", key, value))
+		}
+	}
+
+	return builder.String()
+}
+
+// Reads the live gitlab.rb out of the pod.
+func liveOmnibusConfig(namespace, podName string) (string, error) {
+	options := ExecOptions{
+		Command:       []string{"cat", GitLabConfigFile},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	return stdout, err
+}
+
+// Writes the rendered gitlab.rb into the pod and reconfigures.
+func applyOmnibusConfig(namespace, podName, desired string) error {
+	options := ExecOptions{
+		Command:       []string{"sh", "-c", "cat > " + GitLabConfigFile},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		Stdin:         strings.NewReader(desired),
+		CaptureStderr: true,
+	}
+	err := ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("unable to write %v: %v", GitLabConfigFile, err)
+	}
+
+	options.Stdin = nil
+	options.Command = []string{"gitlab-ctl", "reconfigure"}
+	options.CaptureStdout = true
+	return ExecWithOptions(options)
+}
+
+// ReconcileOmnibusConfig renders the omnibus settings a GitLab resource
+// declares, compares them with the live gitlab.rb in the pod, and runs
+// gitlab-ctl reconfigure when they have drifted apart. The sync state is
+// reported in the resource's status.
+func ReconcileOmnibusConfig(client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	settings, _, err := unstructured.NestedMap(obj.Object, "spec", "omnibusConfig")
+	if err != nil {
+		return nil
+	}
+	if settings == nil {
+		settings = map[string]interface{}{}
+	}
+
+	// Email configuration is declared in first-class fields but lands in
+	// gitlab.rb like any other omnibus setting.
+	emailSettings, err := emailOmnibusSettings(obj)
+	if err != nil {
+		return err
+	}
+	for key, value := range emailSettings {
+		settings[key] = value
+	}
+
+	if len(settings) == 0 {
+		return nil
+	}
+
+	namespace := obj.GetNamespace()
+	desired := renderOmnibusConfig(gitLabSpecFrom(obj), settings)
+
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	live, err := liveOmnibusConfig(namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	if live == desired {
+		return SetStatusField(client, obj, "configInSync", true)
+	}
+
+	if DryRun {
+		fmt.Printf("Dry run: would reconfigure GitLab instance %v/%v with updated gitlab.rb\n",
+			namespace, obj.GetName())
+		return nil
+	}
+
+	fmt.Printf("gitlab.rb of %v/%v has drifted from spec, reconfiguring\n", namespace, obj.GetName())
+	SetStatusField(client, obj, "configInSync", false)
+
+	err = applyOmnibusConfig(namespace, podName, desired)
+	if err != nil {
+		return err
+	}
+
+	return SetStatusField(client, obj, "configInSync", true)
+}
@@ -0,0 +1,138 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// OpenShift support. Detection looks for the route.openshift.io API group,
+// and can be forced either way with the openshift setting. On OpenShift
+// the operator exposes instances with Routes instead of Ingresses, and
+// extracts tarballs with --no-same-owner since restricted SCCs run
+// containers as an arbitrary non-root UID that cannot chown. Projected
+// serviceaccount tokens at non-default paths are already covered by the
+// token_file setting.
+const (
+	OpenShiftSetting = "openshift"
+
+	RouteGroup   = "route.openshift.io"
+	RouteVersion = "v1"
+)
+
+var (
+	openShiftOnce     sync.Once
+	openShiftDetected bool
+)
+
+// Reports whether the cluster is OpenShift. The API discovery result is
+// cached for the life of the process.
+func isOpenShift() bool {
+	if operatorConfig.IsSet(OpenShiftSetting) {
+		return operatorConfig.GetBool(OpenShiftSetting)
+	}
+
+	openShiftOnce.Do(func() {
+		_, clientset, err := GetInCluster()
+		if err != nil {
+			return
+		}
+		groups, err := clientset.Discovery().ServerGroups()
+		if err != nil {
+			return
+		}
+		for _, group := range groups.Groups {
+			if group.Name == RouteGroup {
+				openShiftDetected = true
+				return
+			}
+		}
+	})
+
+	return openShiftDetected
+}
+
+// Extra tar flags for extracting inside a target pod. Restricted SCCs run
+// containers as a random non-root UID, so restoring the archived ownership
+// would fail; extract everything as the current user instead.
+func tarOwnershipArgs() []string {
+	if isOpenShift() {
+		return []string{"--no-same-owner"}
+	}
+	return nil
+}
+
+// Reconciles the Route exposing an instance, the OpenShift counterpart of
+// the Ingress reconciled elsewhere.
+func reconcileRoute(namespace, name, host string) error {
+	routes, err := NewDynamicResourceClient(RouteGroup, RouteVersion, "routes", namespace)
+	if err != nil {
+		return err
+	}
+
+	spec := map[string]interface{}{
+		"host": host,
+		"to": map[string]interface{}{
+			"kind": "Service",
+			"name": name,
+		},
+		"port": map[string]interface{}{
+			"targetPort": "http",
+		},
+	}
+	// Terminate TLS at the router when a cert-manager issuer is
+	// configured; the certificate Secret is maintained by certs.go.
+	if operatorConfig.GetString(CertIssuerSetting) != "" {
+		spec["tls"] = map[string]interface{}{
+			"termination":                   "edge",
+			"insecureEdgeTerminationPolicy": "Redirect",
+		}
+	}
+
+	route := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": RouteGroup + "/" + RouteVersion,
+			"kind":       "Route",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": spec,
+		},
+	}
+
+	existing, err := routes.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = routes.Create(route)
+		if err != nil {
+			return fmt.Errorf("unable to create route %v: %v", name, err)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	existing.Object["spec"] = route.Object["spec"]
+	_, err = routes.Update(existing)
+	if err != nil {
+		return fmt.Errorf("unable to update route %v: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WatchNamespaces returns the namespaces the operator manages. By default
+// that is only its own namespace; set namespaces to a comma separated
+// list, or all_namespaces to true for a cluster-wide watch (which needs
+// matching RBAC).
+func WatchNamespaces() ([]string, error) {
+	if operatorConfig.GetBool("all_namespaces") {
+		return []string{metav1.NamespaceAll}, nil
+	}
+
+	if list := operatorConfig.GetString("namespaces"); list != "" {
+		var namespaces []string
+		for _, namespace := range strings.Split(list, ",") {
+			namespace = strings.TrimSpace(namespace)
+			if namespace != "" {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+		return namespaces, nil
+	}
+
+	namespace, err := GetNamespace()
+	if err != nil {
+		return nil, err
+	}
+	return []string{namespace}, nil
+}
+
+// Controllers registered by the files that implement them. Each controller
+// runs in its own goroutine until the stop channel closes.
+var controllers []func(stop <-chan struct{})
+
+// RegisterController adds a controller to be run by the operator command.
+func RegisterController(run func(stop <-chan struct{})) {
+	controllers = append(controllers, run)
+}
+
+// RunOperator starts all registered controllers and blocks forever. It is
+// the entry point for running gitlab-operator as a long-lived deployment
+// rather than a one-shot job.
+func RunOperator() error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Starting gitlab-operator with %v controllers in namespace %v\n", len(controllers), namespace)
+
+	// Fail fast on unusable object storage credentials when a bucket is
+	// configured, instead of surfacing the problem mid-backup.
+	if operatorConfig.GetString("s3") != "" {
+		err = CheckAWSCredentials()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = EnsureStagingPVC(namespace)
+	if err != nil {
+		fmt.Printf("unable to ensure staging PVC: %v\n", err)
+	}
+	CleanupStaging()
+
+	// Clean up anything a crashed predecessor left behind before taking on
+	// new work.
+	RecoverInflightOperation()
+
+	StartHealthServer()
+	StartWebhookServer()
+	StartAdminAPIServer()
+
+	stop := make(chan struct{})
+
+	StartOperationQueue(stop)
+
+	err = StartPodInformer(namespace, stop)
+	if err != nil {
+		return err
+	}
+
+	for _, run := range controllers {
+		go run(stop)
+	}
+
+	// Block until the pod is asked to stop, then shut the controllers down
+	// so an in-flight operation gets its deferred cleanup instead of being
+	// killed mid-upload.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	received := <-signals
+
+	fmt.Printf("Received %v, shutting down\n", received)
+	close(stop)
+	return nil
+}
+
+// operatorCmd represents the operator command
+var operatorCmd = &cobra.Command{
+	Use:          "operator",
+	Short:        "Runs the long-lived operator controllers",
+	SilenceUsage: true,
+	Long: `Runs gitlab-operator as a long-lived process that watches the operator's
+custom resources and acts on them, instead of performing a single one-shot
+backup or restore.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := RunOperator()
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(operatorCmd)
+}
@@ -0,0 +1,203 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Directories backed up as separate parallel streams in parallel backup
+// mode. The database is handled separately through gitlab-rake.
+var backupComponentDirs = map[string]string{
+	"repositories": "/var/opt/gitlab/git-data/repositories",
+	"artifacts":    "/var/opt/gitlab/gitlab-rails/shared/artifacts",
+	"lfs":          "/var/opt/gitlab/gitlab-rails/shared/lfs",
+	"uploads":      "/var/opt/gitlab/gitlab-rails/uploads",
+	"registry":     "/var/opt/gitlab/gitlab-registry",
+}
+
+// BackupComponent records one uploaded stream of a parallel backup.
+type BackupComponent struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// BackupManifest ties the components of one parallel backup together so
+// restore knows what to fetch.
+type BackupManifest struct {
+	Timestamp  string            `json:"timestamp"`
+	Components []BackupComponent `json:"components"`
+}
+
+// Key prefix for one parallel backup's objects in the bucket. Outside the
+// gitlab-backup- key space so component tarballs and manifests never
+// resolve as the "latest" full backup.
+const ParallelBackupPrefixBase = "gitlab-parallel-"
+
+func parallelBackupPrefix(timestamp string) string {
+	return ParallelBackupPrefixBase + timestamp
+}
+
+// Copies one directory out of the pod, uploads it under its own key, and
+// returns the component record.
+func backupComponentDir(namespace, podName, name, dir, s3Bucket, prefix string) (BackupComponent, error) {
+	component := BackupComponent{
+		Name: name,
+		Key:  prefix + "/" + name + ".tar.gz",
+	}
+
+	localFilename := name + ".tar.gz"
+	src := fileSpec{
+		PodNamespace: namespace,
+		PodName:      podName,
+		File:         dir,
+	}
+	dest := fileSpec{File: localFilename}
+	err := CopyFromPod(src, dest)
+	if err != nil {
+		return component, fmt.Errorf("unable to copy %v: %v", dir, err)
+	}
+	defer os.Remove(localFilename)
+
+	if info, err := os.Stat(localFilename); err == nil {
+		component.Size = info.Size()
+	}
+
+	err = UploadFileToS3(s3Bucket, component.Key, localFilename)
+	if err != nil {
+		return component, err
+	}
+
+	return component, nil
+}
+
+// Runs the rake backup with everything but the database skipped, then
+// copies and uploads the resulting tarball.
+func backupDatabase(namespace, podName, s3Bucket, prefix string) (BackupComponent, error) {
+	component := BackupComponent{
+		Name: "db",
+		Key:  prefix + "/db.tar.gz",
+	}
+
+	options := ExecOptions{
+		Command: []string{"gitlab-rake", "gitlab:backup:create",
+			"SKIP=repositories,uploads,builds,artifacts,lfs,registry,pages"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	err := ExecWithOptions(options)
+	if err != nil {
+		return component, err
+	}
+
+	return backupComponentDir(namespace, podName, "db", GitLabRemoteRakeDir, s3Bucket, prefix)
+}
+
+// BackupParallel backs up the database, repositories, and object-storage
+// style directories as separate parallel streams with separate s3 keys,
+// then uploads a manifest tying them together. There is no manifest-driven
+// restore yet: restoring a parallel backup means downloading the
+// components listed in its manifest.json and extracting them into place by
+// hand. The plain restore path only consumes single-tarball backups.
+func BackupParallel(s3Bucket string) error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	prefix := parallelBackupPrefix(timestamp)
+	fmt.Printf("Begining parallel backup of GitLab instance %v, %v\n", namespace, podName)
+	EmitNormalEvent(namespace, podName, EventBackupStarted, "Parallel GitLab backup started")
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	manifest := BackupManifest{Timestamp: timestamp}
+	var errors []error
+
+	record := func(component BackupComponent, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%v: %v", component.Name, err))
+			return
+		}
+		manifest.Components = append(manifest.Components, component)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		component, err := backupDatabase(namespace, podName, s3Bucket, prefix)
+		record(component, err)
+	}()
+
+	for name, dir := range backupComponentDirs {
+		wg.Add(1)
+		go func(name, dir string) {
+			defer wg.Done()
+			component, err := backupComponentDir(namespace, podName, name, dir, s3Bucket, prefix)
+			record(component, err)
+		}(name, dir)
+	}
+
+	wg.Wait()
+
+	if len(errors) > 0 {
+		return fmt.Errorf("parallel backup failed: %v", errors)
+	}
+
+	err = uploadManifest(s3Bucket, prefix, manifest)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished parallel backup of GitLab instance\n")
+	EmitNormalEvent(namespace, podName, EventBackupSucceeded,
+		fmt.Sprintf("Parallel GitLab backup uploaded to %v/%v", s3Bucket, prefix))
+
+	return nil
+}
+
+// Uploads the backup manifest as JSON under the backup's key prefix.
+func uploadManifest(s3Bucket, prefix string, manifest BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	localFilename := "manifest.json"
+	err = ioutil.WriteFile(localFilename, data, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFilename)
+
+	return UploadFileToS3(s3Bucket, prefix+"/manifest.json", localFilename)
+}
@@ -0,0 +1,302 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Name of the Secret holding external PostgreSQL connection details under
+// the keys host, port, database, username, and password. Override with
+// the postgres_secret setting.
+const DefaultPostgresSecret = "gitlab-postgres"
+
+const (
+	pgClientImage = "postgres:9.6"
+	pgDumpFile    = "/tmp/gitlab-db.sql.gz"
+	// Outside the gitlab-backup- key space so dumps never resolve as the
+	// "latest" file-level backup.
+	pgDumpPrefix = "gitlab-db-"
+)
+
+// Connection details for an external/managed PostgreSQL.
+type pgCredentials struct {
+	Host     string
+	Port     string
+	Database string
+	Username string
+	Password string
+}
+
+func loadPostgresCredentials(clientset kubernetes.Interface, namespace string) (pgCredentials, error) {
+	secretName := operatorConfig.GetString("postgres_secret")
+	if secretName == "" {
+		secretName = DefaultPostgresSecret
+	}
+
+	secret, err := clientset.Core().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return pgCredentials{}, fmt.Errorf("unable to read postgres secret %v: %v", secretName, err)
+	}
+
+	creds := pgCredentials{
+		Host:     string(secret.Data["host"]),
+		Port:     string(secret.Data["port"]),
+		Database: string(secret.Data["database"]),
+		Username: string(secret.Data["username"]),
+		Password: string(secret.Data["password"]),
+	}
+	if creds.Port == "" {
+		creds.Port = "5432"
+	}
+	if creds.Host == "" || creds.Database == "" || creds.Username == "" {
+		return creds, fmt.Errorf("postgres secret %v must set host, database, and username", secretName)
+	}
+
+	return creds, nil
+}
+
+// Starts a short-lived postgres client pod with the credentials in its
+// environment, so passwords never appear on exec command lines.
+func startPostgresClientPod(clientset kubernetes.Interface, namespace string, creds pgCredentials) (string, error) {
+	podName := fmt.Sprintf("gitlab-pg-client-%v", time.Now().Unix())
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   podName,
+			Labels: map[string]string{"component": "gitlab-pg-client"},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers: []v1.Container{{
+				Name:    "pg-client",
+				Image:   pgClientImage,
+				Command: []string{"sleep", "86400"},
+				Env: []v1.EnvVar{
+					{Name: "PGHOST", Value: creds.Host},
+					{Name: "PGPORT", Value: creds.Port},
+					{Name: "PGDATABASE", Value: creds.Database},
+					{Name: "PGUSER", Value: creds.Username},
+					{Name: "PGPASSWORD", Value: creds.Password},
+				},
+			}},
+		},
+	}
+
+	_, err := clientset.Core().Pods(namespace).Create(pod)
+	if err != nil {
+		return "", fmt.Errorf("unable to create postgres client pod: %v", err)
+	}
+
+	err = waitForPodReady(clientset, namespace, podName, 5*time.Minute)
+	if err != nil {
+		clientset.Core().Pods(namespace).Delete(podName, &metav1.DeleteOptions{})
+		return "", err
+	}
+
+	return podName, nil
+}
+
+// BackupDatabaseDump takes a compressed pg_dump of the external PostgreSQL
+// and uploads it alongside the file-level backups.
+func BackupDatabaseDump(s3Bucket string) error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	creds, err := loadPostgresCredentials(clientset, namespace)
+	if err != nil {
+		return err
+	}
+
+	podName, err := startPostgresClientPod(clientset, namespace, creds)
+	if err != nil {
+		return err
+	}
+	defer clientset.Core().Pods(namespace).Delete(podName, &metav1.DeleteOptions{})
+
+	fmt.Printf("Begining pg_dump of %v/%v from pod %v\n", creds.Host, creds.Database, podName)
+
+	options := ExecOptions{
+		Command:       []string{"sh", "-c", "pg_dump --clean | gzip > " + pgDumpFile},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: "pg-client",
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("pg_dump failed: %v", err)
+	}
+
+	localFilename := pgDumpPrefix + time.Now().UTC().Format(time.RFC3339) + ".sql.gz"
+	src := fileSpec{
+		PodNamespace: namespace,
+		PodName:      podName,
+		File:         pgDumpFile,
+	}
+	err = CopyFromPod(src, fileSpec{File: localFilename})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFilename)
+
+	err = UploadToS3(s3Bucket, localFilename)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished database dump of %v\n", creds.Database)
+	return nil
+}
+
+// RestoreDatabaseDump restores a pg_dump previously uploaded by
+// BackupDatabaseDump into the external PostgreSQL.
+func RestoreDatabaseDump(s3Bucket, timestamp string) error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	creds, err := loadPostgresCredentials(clientset, namespace)
+	if err != nil {
+		return err
+	}
+
+	key := pgDumpPrefix + timestamp + ".sql.gz"
+	if timestamp == "" || timestamp == "latest" {
+		keys, err := ListS3Objects(s3Bucket, pgDumpPrefix)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("no database dumps with prefix %v found in %v", pgDumpPrefix, s3Bucket)
+		}
+		key = keys[len(keys)-1]
+	}
+
+	localFilename := key
+	err = DownloadFromS3(s3Bucket, key, localFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFilename)
+
+	podName, err := startPostgresClientPod(clientset, namespace, creds)
+	if err != nil {
+		return err
+	}
+	defer clientset.Core().Pods(namespace).Delete(podName, &metav1.DeleteOptions{})
+
+	fmt.Printf("Begining database restore of %v into %v/%v\n", key, creds.Host, creds.Database)
+
+	// The downloaded object is the tar stream CopyFromPod produced, whose
+	// entry carries the original pod path; extracting at / puts the dump
+	// back at pgDumpFile.
+	dest := fileSpec{
+		PodNamespace: namespace,
+		PodName:      podName,
+		File:         "/",
+	}
+	err = CopyToPod(localFilename, dest)
+	if err != nil {
+		return err
+	}
+
+	options := ExecOptions{
+		Command:       []string{"sh", "-c", "gunzip -c " + pgDumpFile + " | psql"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: "pg-client",
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("database restore failed: %v", err)
+	}
+
+	fmt.Printf("Finished database restore of %v\n", creds.Database)
+	return nil
+}
+
+// pgDumpCmd represents the pg-dump command
+var pgDumpCmd = &cobra.Command{
+	Use:          "pg-dump [-s bucket]",
+	Short:        "Takes a logical backup of an external PostgreSQL",
+	SilenceUsage: true,
+	Long: `Runs pg_dump against an external or managed PostgreSQL using credentials
+from a Secret, compresses the result, and uploads it to the s3 bucket
+alongside the file-level backups.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := BackupDatabaseDump(operatorConfig.GetString("s3"))
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+		return
+	},
+}
+
+// pgRestoreCmd represents the pg-restore command
+var pgRestoreCmd = &cobra.Command{
+	Use:          "pg-restore [-s bucket] [-t timestamp]",
+	Short:        "Restores a logical backup into an external PostgreSQL",
+	SilenceUsage: true,
+	Long: `Downloads a pg_dump previously uploaded by pg-dump and restores it into
+the external PostgreSQL using credentials from a Secret.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := RestoreDatabaseDump(operatorConfig.GetString("s3"), RestoreTimestamp)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(pgDumpCmd)
+	RootCmd.AddCommand(pgRestoreCmd)
+
+	pgRestoreCmd.Flags().StringVarP(
+		&RestoreTimestamp,
+		"timestamp",
+		"t",
+		"latest",
+		"timestamp of the database dump to restore, or \"latest\"")
+}
@@ -0,0 +1,232 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Client-side commands for driving a running operator, kubectl-plugin
+// style (install the binary as kubectl-gitlab and these become `kubectl
+// gitlab backup now` and friends). They talk to the operator's admin API,
+// configured with admin_api_url and admin_api_token
+// (GITLAB_OPERATOR_ADMIN_API_URL / _TOKEN), so nobody has to craft CR YAML
+// or exec into pods by hand.
+const (
+	AdminAPIURLSetting   = "admin_api_url"
+	AdminAPITokenSetting = "admin_api_token"
+)
+
+// Performs one authenticated request against the operator's admin API.
+func adminAPIRequest(method, path string) ([]byte, error) {
+	baseURL := operatorConfig.GetString(AdminAPIURLSetting)
+	if baseURL == "" {
+		return nil, fmt.Errorf("admin_api_url is not configured")
+	}
+
+	request, err := http.NewRequest(method, baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+operatorConfig.GetString(AdminAPITokenSetting))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		return nil, fmt.Errorf("%v %v returned %v: %v", method, path, response.Status, string(body))
+	}
+
+	return body, nil
+}
+
+// backup now: asks the operator to queue a backup.
+var backupNowCmd = &cobra.Command{
+	Use:          "now",
+	Short:        "Asks the running operator to start a backup",
+	SilenceUsage: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, err := adminAPIRequest("POST", "/v1/backup")
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		fmt.Printf("Backup queued\n")
+		ExitCode = 0
+		return
+	},
+}
+
+// backups list: renders the operator's view of the bucket as a table.
+var backupsCmd = &cobra.Command{
+	Use:          "backups",
+	Short:        "Inspects backups through the running operator",
+	SilenceUsage: true,
+}
+
+var backupsListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "Lists backups known to the running operator",
+	SilenceUsage: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		body, err := adminAPIRequest("GET", "/v1/backups")
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		var backups []BackupInfo
+		err = json.Unmarshal(body, &backups)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(writer, "TIMESTAMP\tSIZE\tVERSION\tKEY\n")
+		for _, backup := range backups {
+			version := backup.GitLabVersion
+			if version == "" {
+				version = "-"
+			}
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", backup.Timestamp, backup.Size, version, backup.Key)
+		}
+		writer.Flush()
+		ExitCode = 0
+		return
+	},
+}
+
+// status: renders the operator status endpoint as a table.
+var statusCmd = &cobra.Command{
+	Use:          "status",
+	Short:        "Shows the running operator's status",
+	SilenceUsage: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		body, err := adminAPIRequest("GET", "/v1/status")
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		var status struct {
+			Operator map[string]string `json:"operator"`
+			Restores map[string]string `json:"restores"`
+		}
+		err = json.Unmarshal(body, &status)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for key, value := range status.Operator {
+			fmt.Fprintf(writer, "%v\t%v\n", key, value)
+		}
+		for name, phase := range status.Restores {
+			fmt.Fprintf(writer, "restore/%v\t%v\n", name, phase)
+		}
+		writer.Flush()
+		ExitCode = 0
+		return
+	},
+}
+
+// restore request: creates a GitLabRestore CR so the operator performs the
+// restore, instead of hand-writing the YAML.
+var restoreRequestCmd = &cobra.Command{
+	Use:          "request [timestamp]",
+	Short:        "Creates a GitLabRestore resource for the operator to act on",
+	SilenceUsage: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		timestamp := "latest"
+		if len(args) > 0 {
+			timestamp = args[0]
+		}
+
+		namespace, err := GetNamespace()
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		client, err := NewCRDClient("gitlabrestores", namespace)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		name := fmt.Sprintf("restore-%v", time.Now().Unix())
+		restore := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": CRDGroup + "/" + CRDVersion,
+				"kind":       "GitLabRestore",
+				"metadata": map[string]interface{}{
+					"name":      name,
+					"namespace": namespace,
+				},
+				"spec": map[string]interface{}{
+					"timestamp": timestamp,
+				},
+			},
+		}
+		if s3Bucket := operatorConfig.GetString("s3"); s3Bucket != "" {
+			unstructured.SetNestedField(restore.Object, s3Bucket, "spec", "s3")
+		}
+
+		_, err = client.Create(restore)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		fmt.Printf("Created GitLabRestore %v for backup %v; watch its status for progress\n", name, timestamp)
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(backupNowCmd)
+	backupsCmd.AddCommand(backupsListCmd)
+	RootCmd.AddCommand(backupsCmd)
+	RootCmd.AddCommand(statusCmd)
+	restoreCmd.AddCommand(restoreRequestCmd)
+}
@@ -0,0 +1,167 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Capacity preflight. A backup that dies at 90% after three hours because
+// a volume filled up is the worst failure mode we have, so before starting
+// we estimate the backup's size from the source directories and the
+// database, and require that much headroom (times a safety margin) on both
+// the pod's backup volume and the operator's local buffer path.
+
+// Extra fraction of the estimated size that must be free. The rake backup
+// stages component tarballs before combining them, so exactly-enough is
+// not enough.
+const PreflightHeadroomFactor = 1.2
+
+// Runs du -sb on a directory in the pod. Best effort; returns 0 when the
+// directory is missing or du fails.
+func remoteDirSize(namespace, podName, containerName, dir string) int64 {
+	options := ExecOptions{
+		Command:       []string{"du", "-s", "-b", dir},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: containerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(stdout)
+	if len(fields) == 0 {
+		return 0
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// Queries the production database's on-disk size through gitlab-psql.
+// Best effort; returns 0 when the query fails.
+func remoteDatabaseSize(namespace, podName, containerName string) int64 {
+	options := ExecOptions{
+		Command: []string{"gitlab-psql", "-t", "-A", "-c",
+			"SELECT pg_database_size('gitlabhq_production')"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: containerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return 0
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(stdout), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// Reads the free bytes on the filesystem holding a directory in the pod,
+// via df. Returns 0 when df's output cannot be parsed.
+func remoteFreeSpace(namespace, podName, containerName, dir string) int64 {
+	options := ExecOptions{
+		Command:       []string{"df", "-P", "-B1", dir},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: containerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return 0
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) < 2 {
+		return 0
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0
+	}
+	free, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return free
+}
+
+// EstimateBackupSize sums the sizes of the directories that will go into
+// the backup, minus the skipped components, plus the database.
+func EstimateBackupSize(namespace, podName, containerName string, skips []string) int64 {
+	var total int64
+
+	skipped := func(name string) bool {
+		for _, skip := range skips {
+			if skip == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for name, dir := range backupComponentDirs {
+		if skipped(name) {
+			continue
+		}
+		total += remoteDirSize(namespace, podName, containerName, dir)
+	}
+	if !skipped("db") {
+		total += remoteDatabaseSize(namespace, podName, containerName)
+	}
+
+	return total
+}
+
+// PreflightBackupCheck estimates the backup's size and fails fast when the
+// pod's backup volume or the operator's buffer path lacks the headroom to
+// hold it.
+func PreflightBackupCheck(namespace, podName, containerName, backupDir string, skips []string) error {
+	estimate := EstimateBackupSize(namespace, podName, containerName, skips)
+	if estimate == 0 {
+		// Nothing measurable (or dry run); let the backup proceed rather
+		// than fail on a broken estimate.
+		return nil
+	}
+
+	needed := int64(float64(estimate) * PreflightHeadroomFactor)
+	fmt.Printf("Estimated backup size %v bytes, requiring %v bytes of headroom\n", estimate, needed)
+
+	if free := remoteFreeSpace(namespace, podName, containerName, backupDir); free > 0 && free < needed {
+		return fmt.Errorf("backup volume at %v has %v bytes free but the backup needs about %v; "+
+			"free up space or skip components", backupDir, free, needed)
+	}
+
+	if free := localFreeSpace(); free > 0 && free < needed {
+		return fmt.Errorf("operator buffer path has %v bytes free but the backup needs about %v", free, needed)
+	}
+
+	return nil
+}
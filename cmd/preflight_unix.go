@@ -0,0 +1,30 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package cmd
+
+import "syscall"
+
+// Reads the free bytes on the filesystem holding the operator's working
+// directory, where backup tarballs are buffered before upload.
+func localFreeSpace() int64 {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(stagingDir(), &stat)
+	if err != nil {
+		return 0
+	}
+	return int64(stat.Bavail) * stat.Bsize
+}
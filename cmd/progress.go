@@ -0,0 +1,145 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// How often in-flight transfers log their progress.
+const ProgressLogInterval = 30 * time.Second
+
+// ProgressTracker reports bytes transferred, rate, and ETA for a long
+// running copy or upload. Active trackers are registered so the metrics
+// endpoint can expose them.
+type ProgressTracker struct {
+	Name  string
+	Total int64 // 0 when the total size is unknown
+
+	mutex   sync.Mutex
+	start   time.Time
+	bytes   int64
+	lastLog time.Time
+}
+
+var (
+	transfersMutex  sync.Mutex
+	activeTransfers = map[string]*ProgressTracker{}
+)
+
+// NewProgressTracker starts tracking a transfer. Pass 0 for total when the
+// size is not known up front. Call Done when the transfer finishes.
+func NewProgressTracker(name string, total int64) *ProgressTracker {
+	tracker := &ProgressTracker{
+		Name:    name,
+		Total:   total,
+		start:   time.Now(),
+		lastLog: time.Now(),
+	}
+
+	transfersMutex.Lock()
+	activeTransfers[name] = tracker
+	transfersMutex.Unlock()
+
+	return tracker
+}
+
+// Add records n more bytes transferred, logging rate and ETA once per
+// ProgressLogInterval.
+func (t *ProgressTracker) Add(n int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.bytes += int64(n)
+	if time.Since(t.lastLog) < ProgressLogInterval {
+		return
+	}
+	t.lastLog = time.Now()
+
+	elapsed := time.Since(t.start).Seconds()
+	rate := float64(t.bytes) / elapsed
+	if t.Total > 0 && rate > 0 {
+		remaining := time.Duration(float64(t.Total-t.bytes)/rate) * time.Second
+		fmt.Printf("%v: %v of %v bytes (%.1f MB/s, ETA %v)\n",
+			t.Name, t.bytes, t.Total, rate/1024/1024, remaining.Round(time.Second))
+	} else {
+		fmt.Printf("%v: %v bytes (%.1f MB/s)\n", t.Name, t.bytes, rate/1024/1024)
+	}
+}
+
+// Bytes returns the number of bytes transferred so far.
+func (t *ProgressTracker) Bytes() int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.bytes
+}
+
+// Done unregisters the tracker and logs a final summary.
+func (t *ProgressTracker) Done() {
+	transfersMutex.Lock()
+	delete(activeTransfers, t.Name)
+	transfersMutex.Unlock()
+
+	elapsed := time.Since(t.start)
+	fmt.Printf("%v: finished, %v bytes in %v\n", t.Name, t.Bytes(), elapsed.Round(time.Second))
+}
+
+// TransferProgress snapshots the bytes transferred by every in-flight
+// transfer, keyed by transfer name.
+func TransferProgress() map[string]int64 {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+
+	progress := map[string]int64{}
+	for name, tracker := range activeTransfers {
+		progress[name] = tracker.Bytes()
+	}
+	return progress
+}
+
+type trackedReader struct {
+	reader  io.Reader
+	tracker *ProgressTracker
+}
+
+func (r trackedReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.tracker.Add(n)
+	return n, err
+}
+
+// WrapReader counts bytes read through the returned reader.
+func (t *ProgressTracker) WrapReader(reader io.Reader) io.Reader {
+	return trackedReader{reader: reader, tracker: t}
+}
+
+type trackedWriter struct {
+	writer  io.Writer
+	tracker *ProgressTracker
+}
+
+func (w trackedWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	w.tracker.Add(n)
+	return n, err
+}
+
+// WrapWriter counts bytes written through the returned writer.
+func (t *ProgressTracker) WrapWriter(writer io.Writer) io.Writer {
+	return trackedWriter{writer: writer, tracker: t}
+}
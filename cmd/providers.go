@@ -0,0 +1,185 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Provider extension points. A build that links in extra code can register
+// an ObjectStore or Notifier implementation by name from an init func, and
+// storage_provider / notify_provider select it at runtime. Alternatively
+// either setting can name an external helper as exec:/path/to/helper; the
+// helper receives one JSON request on stdin and answers with one JSON
+// response on stdout, so exotic backends (Swift, B2, pager systems) can be
+// scripted in any language without forking the operator.
+//
+// The exec protocol passes file content by local path, never through the
+// pipe: {"operation": "upload", "bucket": ..., "key": ..., "filename": ...}
+// expects the helper to store the named file, "download" the reverse,
+// "delete" and "list" (with "prefix", answered by {"keys": [...]}) round
+// out storage, and "notify" carries the notification object. A non-empty
+// "error" in the response, or a non-zero exit, fails the call.
+const (
+	StorageProviderSetting = "storage_provider"
+	NotifyProviderSetting  = "notify_provider"
+
+	execProviderPrefix = "exec:"
+)
+
+var (
+	objectStoreProviders = map[string]ObjectStore{}
+	notifierProviders    = map[string]Notifier{}
+)
+
+// RegisterObjectStoreProvider makes a storage backend selectable with
+// storage_provider. Called from init funcs of provider implementations.
+func RegisterObjectStoreProvider(name string, store ObjectStore) {
+	objectStoreProviders[name] = store
+}
+
+// RegisterNotifierProvider makes a notification target selectable with
+// notify_provider. Called from init funcs of provider implementations.
+func RegisterNotifierProvider(name string, notifier Notifier) {
+	notifierProviders[name] = notifier
+}
+
+// One request to an external provider helper.
+type providerRequest struct {
+	Operation    string        `json:"operation"`
+	Bucket       string        `json:"bucket,omitempty"`
+	Key          string        `json:"key,omitempty"`
+	Filename     string        `json:"filename,omitempty"`
+	Prefix       string        `json:"prefix,omitempty"`
+	Notification *Notification `json:"notification,omitempty"`
+}
+
+// The helper's answer.
+type providerResponse struct {
+	Error string   `json:"error,omitempty"`
+	Keys  []string `json:"keys,omitempty"`
+}
+
+// Runs one request through an external provider helper.
+func callExecProvider(command string, request providerRequest) (providerResponse, error) {
+	var response providerResponse
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+
+	cmd := exec.Command(command)
+	cmd.Stdin = bytes.NewReader(payload)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return response, fmt.Errorf("provider %v %v failed: %v: %v",
+			command, request.Operation, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if len(bytes.TrimSpace(output)) > 0 {
+		err = json.Unmarshal(output, &response)
+		if err != nil {
+			return response, fmt.Errorf("provider %v returned unparseable output: %v", command, err)
+		}
+	}
+	if response.Error != "" {
+		return response, fmt.Errorf("provider %v %v failed: %v", command, request.Operation, response.Error)
+	}
+
+	return response, nil
+}
+
+// execObjectStore adapts an external helper to the ObjectStore interface.
+type execObjectStore struct {
+	command string
+}
+
+func (e execObjectStore) Upload(bucket, key, filename string) error {
+	_, err := callExecProvider(e.command, providerRequest{
+		Operation: "upload", Bucket: bucket, Key: key, Filename: filename})
+	return err
+}
+
+func (e execObjectStore) Download(bucket, key, filename string) error {
+	_, err := callExecProvider(e.command, providerRequest{
+		Operation: "download", Bucket: bucket, Key: key, Filename: filename})
+	return err
+}
+
+func (e execObjectStore) Delete(bucket, key string) error {
+	_, err := callExecProvider(e.command, providerRequest{
+		Operation: "delete", Bucket: bucket, Key: key})
+	return err
+}
+
+func (e execObjectStore) List(bucket, prefix string) ([]string, error) {
+	response, err := callExecProvider(e.command, providerRequest{
+		Operation: "list", Bucket: bucket, Prefix: prefix})
+	return response.Keys, err
+}
+
+// execNotifier adapts an external helper to the Notifier interface.
+type execNotifier struct {
+	command string
+}
+
+func (e execNotifier) Notify(n Notification) error {
+	_, err := callExecProvider(e.command, providerRequest{
+		Operation: "notify", Notification: &n})
+	return err
+}
+
+// The ObjectStore in effect: a configured provider when storage_provider
+// is set, the default S3 implementation otherwise.
+func activeObjectStore() ObjectStore {
+	name := operatorConfig.GetString(StorageProviderSetting)
+	if name == "" {
+		return objectStore
+	}
+	if strings.HasPrefix(name, execProviderPrefix) {
+		return execObjectStore{command: strings.TrimPrefix(name, execProviderPrefix)}
+	}
+	if store, found := objectStoreProviders[name]; found {
+		return store
+	}
+
+	fmt.Printf("unknown storage_provider %v; using the built-in s3 store\n", name)
+	return objectStore
+}
+
+// The Notifier selected with notify_provider, or nil when none is
+// configured.
+func providerNotifier() Notifier {
+	name := operatorConfig.GetString(NotifyProviderSetting)
+	if name == "" {
+		return nil
+	}
+	if strings.HasPrefix(name, execProviderPrefix) {
+		return execNotifier{command: strings.TrimPrefix(name, execProviderPrefix)}
+	}
+	if notifier, found := notifierProviders[name]; found {
+		return notifier
+	}
+
+	fmt.Printf("unknown notify_provider %v\n", name)
+	return nil
+}
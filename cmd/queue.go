@@ -0,0 +1,125 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The operator can manage many GitLab instances; running all their
+// backups and restores at once would overload object storage and the
+// node. Operations are queued and drained by a bounded worker pool sized
+// by the max_parallel_backups setting (default 1).
+
+type queuedOperation struct {
+	name string
+	run  func() error
+}
+
+var (
+	queueOnce      sync.Once
+	operationQueue chan queuedOperation
+
+	pauseMutex  sync.Mutex
+	queuePaused bool
+)
+
+// PauseOperations stops the workers from picking up further queued
+// operations; the operation currently running is unaffected. Queued
+// operations stay queued until ResumeOperations.
+func PauseOperations() {
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+	if !queuePaused {
+		fmt.Printf("Operation queue paused\n")
+	}
+	queuePaused = true
+}
+
+// ResumeOperations lets the workers drain the queue again.
+func ResumeOperations() {
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+	if queuePaused {
+		fmt.Printf("Operation queue resumed\n")
+	}
+	queuePaused = false
+}
+
+func operationsPaused() bool {
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+	return queuePaused
+}
+
+// StartOperationQueue starts the worker pool that drains queued
+// operations. Called once by the operator command.
+func StartOperationQueue(stop <-chan struct{}) {
+	queueOnce.Do(func() {
+		operationQueue = make(chan queuedOperation, 100)
+
+		workers := operatorConfig.GetInt("max_parallel_backups")
+		if workers < 1 {
+			workers = 1
+		}
+		fmt.Printf("Starting operation queue with %v workers\n", workers)
+
+		for i := 0; i < workers; i++ {
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					case operation := <-operationQueue:
+						for operationsPaused() {
+							select {
+							case <-stop:
+								return
+							case <-time.After(5 * time.Second):
+							}
+						}
+						fmt.Printf("Starting queued operation %v\n", operation.name)
+						SetAuditContext(operation.name)
+						err := operation.run()
+						SetAuditContext("")
+						if err != nil {
+							fmt.Printf("Queued operation %v failed: %v\n", operation.name, err)
+						} else {
+							fmt.Printf("Finished queued operation %v\n", operation.name)
+						}
+					}
+				}
+			}()
+		}
+	})
+}
+
+// EnqueueOperation queues an operation for the worker pool. When the
+// operator is not running (one-shot CLI use) the operation runs
+// immediately instead.
+func EnqueueOperation(name string, run func() error) {
+	if operationQueue == nil {
+		err := run()
+		if err != nil {
+			fmt.Printf("Operation %v failed: %v\n", name, err)
+		}
+		return
+	}
+
+	fmt.Printf("Queueing operation %v (%v waiting)\n", name, len(operationQueue))
+	operationQueue <- queuedOperation{name: name, run: run}
+}
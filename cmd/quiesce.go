@@ -0,0 +1,129 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+)
+
+// Quiescing an instance before disruptive work. Quiesce puts up a
+// maintenance banner, stops Sidekiq, lets in-flight web requests drain for
+// quiesce_drain before stopping the web service, asks Redis to persist its
+// state, and syncs the filesystem so what is on disk is what restore or
+// snapshot sees. Unquiesce reverses all of it and is safe to call no
+// matter how far Quiesce got, so callers defer it unconditionally.
+const (
+	QuiesceDrainSetting = "quiesce_drain"
+	DefaultQuiesceDrain = 10 * time.Second
+)
+
+// The omnibus services stopped by a quiesce, in order. Web services are
+// listed both by their old and new names; stopping an absent service is
+// harmless.
+var quiesceServices = []string{"sidekiq", "unicorn", "puma"}
+
+// Sets or clears the maintenance banner. Best effort: an unreachable API
+// never blocks the operation the quiesce is protecting.
+func setMaintenanceBanner(message string) {
+	apiURL := operatorConfig.GetString("api_url")
+	if apiURL == "" {
+		return
+	}
+	client, err := NewGitLabAPIClient(apiURL)
+	if err != nil {
+		fmt.Printf("unable to update maintenance banner: %v\n", err)
+		return
+	}
+	err = client.SetMaintenanceMessage(message)
+	if err != nil {
+		fmt.Printf("unable to update maintenance banner: %v\n", err)
+	}
+}
+
+// Quiesce stops the parts of GitLab that write to the database and disk,
+// so a restore, snapshot, or upgrade works against a consistent, idle
+// instance. Callers must defer Unquiesce before checking the error.
+func Quiesce(namespace, podName, reason string) error {
+	fmt.Printf("Quiescing GitLab instance %v/%v for %v\n", namespace, podName, reason)
+
+	setMaintenanceBanner(fmt.Sprintf("GitLab is undergoing maintenance (%v); expect a brief interruption.", reason))
+
+	options := ExecOptions{
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+
+	options.Command = []string{"gitlab-ctl", "stop", "sidekiq"}
+	err := ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("unable to quiesce: %v", err)
+	}
+
+	// Give in-flight web requests a moment to finish before taking the
+	// web service down.
+	drain := operatorConfig.GetDuration(QuiesceDrainSetting)
+	if drain <= 0 {
+		drain = DefaultQuiesceDrain
+	}
+	time.Sleep(drain)
+
+	for _, service := range quiesceServices[1:] {
+		options.Command = []string{"gitlab-ctl", "stop", service}
+		err = ExecWithOptions(options)
+		if err != nil {
+			return fmt.Errorf("unable to quiesce: %v", err)
+		}
+	}
+
+	// Persist Redis and flush the page cache so the on-disk state is
+	// complete. Both are best effort.
+	options.Command = []string{"sh", "-c",
+		"/opt/gitlab/embedded/bin/redis-cli -s /var/opt/gitlab/redis/redis.socket BGSAVE; sync"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		fmt.Printf("unable to persist redis during quiesce: %v\n", err)
+	}
+
+	return nil
+}
+
+// Unquiesce restarts everything Quiesce stopped and clears the banner.
+// Best effort and idempotent: it runs via defer even when the guarded
+// operation (or the quiesce itself) failed partway.
+func Unquiesce(namespace, podName string) {
+	fmt.Printf("Unquiescing GitLab instance %v/%v\n", namespace, podName)
+
+	options := ExecOptions{
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+
+	for _, service := range quiesceServices {
+		options.Command = []string{"gitlab-ctl", "start", service}
+		err := ExecWithOptions(options)
+		if err != nil {
+			fmt.Printf("unable to restart %v after quiesce: %v\n", service, err)
+		}
+	}
+
+	setMaintenanceBanner("")
+}
@@ -0,0 +1,173 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Skip-and-reference mode for data already living in object storage. When
+// GitLab keeps artifacts, LFS objects, or uploads in buckets of their own,
+// tarring them into the backup duplicates data the provider already
+// stores durably. Setting object_storage_refs to a comma separated list of
+// component=bucket[/prefix] entries makes the backup skip those components
+// and record the references in the backup metadata instead; restore then
+// points the restored instance's gitlab.rb at the referenced buckets.
+// Setting object_storage_replicate additionally configures provider-side
+// replication from each referenced bucket into replica_s3, using the IAM
+// role named by object_storage_replication_role.
+const (
+	ObjectStorageRefsSetting      = "object_storage_refs"
+	ObjectStorageReplicateSetting = "object_storage_replicate"
+	ObjectStorageReplicationRole  = "object_storage_replication_role"
+)
+
+// The gitlab.rb key that names each component's remote bucket.
+var objectStorageDirectoryKeys = map[string]string{
+	"artifacts": "artifacts_object_store_remote_directory",
+	"lfs":       "lfs_object_store_remote_directory",
+	"uploads":   "uploads_object_store_remote_directory",
+}
+
+// Parses object_storage_refs into component -> bucket[/prefix]. Entries
+// naming components the backup cannot skip are dropped with a warning.
+func parseObjectStorageRefs() map[string]string {
+	refs := map[string]string{}
+	for _, entry := range strings.Split(operatorConfig.GetString(ObjectStorageRefsSetting), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			fmt.Printf("Ignoring malformed object_storage_refs entry %q\n", entry)
+			continue
+		}
+		if validateBackupSkips([]string{parts[0]}) != nil {
+			fmt.Printf("Ignoring object_storage_refs entry %q: not a skippable component\n", entry)
+			continue
+		}
+		refs[parts[0]] = parts[1]
+	}
+	return refs
+}
+
+// Merges the referenced components into a backup's skip list.
+func appendObjectStorageSkips(skips []string, refs map[string]string) []string {
+	for component := range refs {
+		present := false
+		for _, skip := range skips {
+			if skip == component {
+				present = true
+				break
+			}
+		}
+		if !present {
+			skips = append(skips, component)
+		}
+	}
+	return skips
+}
+
+// Points the restored instance's gitlab.rb at the referenced buckets, so
+// the data the backup skipped is reachable again after the restore. The
+// caller runs gitlab-ctl reconfigure afterwards.
+func applyObjectStorageRefs(namespace, podName string, refs map[string]string) error {
+	for component, ref := range refs {
+		key, known := objectStorageDirectoryKeys[component]
+		if !known {
+			fmt.Printf("Backup references %v in %v; wire it up manually\n", component, ref)
+			continue
+		}
+
+		bucket := strings.SplitN(ref, "/", 2)[0]
+		fmt.Printf("Pointing %v at object storage bucket %v\n", component, bucket)
+		options := ExecOptions{
+			Command: []string{"sh", "-c", fmt.Sprintf(
+				"grep -q \"^gitlab_rails\\['%v'\\]\" /etc/gitlab/gitlab.rb"+
+					" && sed -i \"s|^gitlab_rails\\['%v'\\] .*|gitlab_rails['%v'] = '%v'|\" /etc/gitlab/gitlab.rb"+
+					" || echo \"gitlab_rails['%v'] = '%v'\" >> /etc/gitlab/gitlab.rb",
+				key, key, key, bucket, key, bucket)},
+			Namespace:     namespace,
+			PodName:       podName,
+			ContainerName: GitLabContainerName,
+			CaptureStdout: true,
+			CaptureStderr: true,
+		}
+		err := ExecWithOptions(options)
+		if err != nil {
+			return fmt.Errorf("unable to wire %v to bucket %v: %v", component, bucket, err)
+		}
+	}
+	return nil
+}
+
+// Configures provider-side replication from each referenced bucket into
+// the replica bucket. Best effort, and a no-op unless both
+// object_storage_replicate and replica_s3 are set.
+func replicateObjectStorageBuckets(refs map[string]string) {
+	if !operatorConfig.GetBool(ObjectStorageReplicateSetting) {
+		return
+	}
+	replicaBucket := operatorConfig.GetString(ReplicaBucketSetting)
+	role := operatorConfig.GetString(ObjectStorageReplicationRole)
+	if replicaBucket == "" || role == "" {
+		fmt.Printf("object_storage_replicate needs replica_s3 and object_storage_replication_role\n")
+		return
+	}
+
+	sess, err := newAWSSession()
+	if err != nil {
+		fmt.Printf("unable to configure bucket replication: %v\n", err)
+		return
+	}
+	svc := s3.New(sess)
+
+	for component, ref := range refs {
+		bucket := strings.SplitN(ref, "/", 2)[0]
+		prefix := ""
+		if parts := strings.SplitN(ref, "/", 2); len(parts) == 2 {
+			prefix = parts[1]
+		}
+
+		if DryRun {
+			fmt.Printf("Dry run: would replicate bucket %v (%v) to %v\n", bucket, component, replicaBucket)
+			continue
+		}
+
+		_, err = svc.PutBucketReplication(&s3.PutBucketReplicationInput{
+			Bucket: aws.String(bucket),
+			ReplicationConfiguration: &s3.ReplicationConfiguration{
+				Role: aws.String(role),
+				Rules: []*s3.ReplicationRule{{
+					Prefix: aws.String(prefix),
+					Status: aws.String(s3.ReplicationRuleStatusEnabled),
+					Destination: &s3.Destination{
+						Bucket: aws.String("arn:aws:s3:::" + replicaBucket),
+					},
+				}},
+			},
+		})
+		if err != nil {
+			fmt.Printf("unable to configure replication of %v (%v): %v\n", bucket, component, err)
+			continue
+		}
+		fmt.Printf("Configured replication of bucket %v (%v) to %v\n", bucket, component, replicaBucket)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Registry garbage collection. The registry only frees layer blobs when
+// garbage collection runs, and running it safely means flipping the
+// registry into read-only mode first. The registry-gc command does the
+// whole dance on demand; setting registry_gc_interval to a duration runs
+// it periodically.
+const (
+	RegistryGCIntervalSetting = "registry_gc_interval"
+	RegistryDataDir           = "/var/opt/gitlab/gitlab-registry"
+
+	// Marker appended to gitlab.rb while the registry is read-only, and
+	// matched to remove it again.
+	registryReadOnlyLine = "registry['storage'] = {'maintenance'=>{'readonly'=>{'enabled'=>true}}} # gitlab-operator registry-gc"
+)
+
+// Reads the registry data directory's size in bytes. Best effort; returns
+// 0 when du fails.
+func registryDiskUsage(namespace, podName string) int64 {
+	options := ExecOptions{
+		Command:       []string{"du", "-s", "-b", RegistryDataDir},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(stdout)
+	if len(fields) == 0 {
+		return 0
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// RegistryGarbageCollect puts the container registry into read-only mode,
+// runs gitlab-ctl registry-garbage-collect -m, and restores read-write
+// mode, recording the space reclaimed in the status ConfigMap.
+func RegistryGarbageCollect(namespace string) error {
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Begining registry garbage collection on %v, %v\n", namespace, podName)
+
+	options := ExecOptions{
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+
+	sizeBefore := registryDiskUsage(namespace, podName)
+
+	options.Command = []string{"sh", "-c",
+		fmt.Sprintf("echo %q >> %v && gitlab-ctl reconfigure", registryReadOnlyLine, GitLabConfigFile)}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("unable to put registry into read-only mode: %v", err)
+	}
+
+	// Restore read-write mode whatever the garbage collection did; a
+	// registry stuck read-only is worse than a failed GC.
+	defer func() {
+		options.Command = []string{"sh", "-c",
+			"sed -i '/gitlab-operator registry-gc/d' " + GitLabConfigFile + " && gitlab-ctl reconfigure"}
+		restoreErr := ExecWithOptions(options)
+		if restoreErr != nil {
+			fmt.Printf("unable to restore registry read-write mode: %v\n", restoreErr)
+		}
+	}()
+
+	options.Command = []string{"gitlab-ctl", "registry-garbage-collect", "-m"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("registry garbage collection failed: %v", err)
+	}
+
+	sizeAfter := registryDiskUsage(namespace, podName)
+	reclaimed := sizeBefore - sizeAfter
+	if reclaimed < 0 {
+		reclaimed = 0
+	}
+
+	fmt.Printf("Finished registry garbage collection, reclaimed %v bytes\n", reclaimed)
+	RecordStatus(map[string]string{
+		"lastRegistryGCTimestamp": time.Now().UTC().Format(time.RFC3339),
+		"lastRegistryGCReclaimed": strconv.FormatInt(reclaimed, 10),
+	})
+
+	return nil
+}
+
+// Runs registry garbage collection at the configured interval in every
+// watched namespace. Disabled unless registry_gc_interval is set.
+func runRegistryGCController(stop <-chan struct{}) {
+	interval := operatorConfig.GetDuration(RegistryGCIntervalSetting)
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		namespaces, err := WatchNamespaces()
+		if err != nil {
+			fmt.Printf("registry gc controller: %v\n", err)
+			continue
+		}
+
+		for _, namespace := range namespaces {
+			err = RegistryGarbageCollect(namespace)
+			if err != nil {
+				fmt.Printf("registry gc of %v failed: %v\n", namespace, err)
+			}
+		}
+	}
+}
+
+// registryGCCmd represents the registry-gc command
+var registryGCCmd = &cobra.Command{
+	Use:          "registry-gc",
+	Short:        "Garbage collects the container registry",
+	SilenceUsage: true,
+	Long: `Puts the container registry into read-only mode, runs gitlab-ctl
+registry-garbage-collect -m, and restores read-write mode, reporting the
+space reclaimed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		namespace, err := GetNamespace()
+		if err == nil {
+			err = RegistryGarbageCollect(namespace)
+		}
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(registryGCCmd)
+	RegisterController(runRegistryGCController)
+}
@@ -0,0 +1,70 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Replication settings. When replica_s3 is set, every backup object is
+// copied to that bucket after a successful upload, so a regional outage
+// cannot take out both the instance and its backups. replica_region names
+// the region of the replica bucket when it differs from the primary's.
+const (
+	ReplicaBucketSetting = "replica_s3"
+	ReplicaRegionSetting = "replica_region"
+)
+
+// ReplicateToS3 copies an object from the primary backup bucket to the
+// configured replica bucket with a server-side S3 copy. Returns the
+// replica location, or "" when no replica bucket is configured.
+func ReplicateToS3(s3Bucket, key string) (string, error) {
+	replicaBucket := operatorConfig.GetString(ReplicaBucketSetting)
+	if replicaBucket == "" {
+		return "", nil
+	}
+
+	if DryRun {
+		fmt.Printf("Dry run: would replicate %v/%v to %v\n", s3Bucket, key, replicaBucket)
+		return replicaBucket + "/" + key, nil
+	}
+
+	fmt.Printf("Replicating %v/%v to %v\n", s3Bucket, key, replicaBucket)
+
+	sess, err := newAWSSession()
+	if err != nil {
+		return "", err
+	}
+
+	config := aws.NewConfig()
+	if region := operatorConfig.GetString(ReplicaRegionSetting); region != "" {
+		config = config.WithRegion(region)
+	}
+	svc := s3.New(sess, config)
+	_, err = svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(replicaBucket),
+		Key:        aws.String(key),
+		CopySource: aws.String(s3Bucket + "/" + key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to replicate %v to %v: %v", key, replicaBucket, err)
+	}
+
+	fmt.Printf("Finished replicating to %v/%v\n", replicaBucket, key)
+	return replicaBucket + "/" + key, nil
+}
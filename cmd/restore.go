@@ -0,0 +1,344 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// Phases reported in a GitLabRestore's status as the restore progresses.
+const (
+	RestorePhaseDownloading   = "Downloading"
+	RestorePhaseCopying       = "Copying"
+	RestorePhaseRestoring     = "Restoring"
+	RestorePhaseReconfiguring = "Reconfiguring"
+	RestorePhaseComplete      = "Complete"
+	RestorePhaseFailed        = "Failed"
+)
+
+var RestoreTimestamp string
+
+// Resolves a user supplied timestamp (or "latest") to the s3 key of a
+// backup tarball in the bucket.
+func resolveBackupKey(s3Bucket, timestamp string) (string, error) {
+	if timestamp != "" && timestamp != "latest" {
+		return backupKeyForTimestamp(timestamp), nil
+	}
+
+	keys, err := ListS3Objects(s3Bucket, backupSearchPrefix())
+	if err != nil {
+		return "", err
+	}
+	// Chunked backups have no tarball object; their keys come from the
+	// chunk indexes instead.
+	keys = append(keys, chunkedBackupKeys(s3Bucket)...)
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no backups with prefix %v found in %v", GitLabLocalBackupPrefix, s3Bucket)
+	}
+
+	return keys[len(keys)-1], nil
+}
+
+// Find the target pod in the given namespace and restore a GitLab backup
+// from the s3 bucket onto it. report is called as the restore moves
+// between phases; a nil report is ignored.
+func Restore(namespace, s3Bucket, timestamp string, skips []string, report func(phase string)) error {
+	if report == nil {
+		report = func(phase string) {}
+	}
+
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	backupKey, err := resolveBackupKey(s3Bucket, timestamp)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Begining restore of %v onto GitLab instance %v, %v\n", backupKey, namespace, podName)
+	EmitNormalEvent(namespace, podName, EventRestoreStarted,
+		fmt.Sprintf("GitLab restore of %v started", backupKey))
+
+	// Keep drains and autoscaler scale-downs away from the pod while the
+	// restore runs.
+	ProtectPodFromDisruption(namespace, podName, "restore")
+	defer UnprotectPodFromDisruption(namespace, podName)
+
+	err = RunHook(HookPreRestore, namespace, podName, GitLabContainerName)
+	if err != nil {
+		return err
+	}
+
+	if operatorConfig.GetBool(StreamRestoreSetting) {
+		// Pipe the backup straight into the pod, never touching the
+		// operator's disk.
+		report(RestorePhaseDownloading)
+		err = StreamRestoreToPod(namespace, podName, s3Bucket, backupKey)
+		if err != nil {
+			return err
+		}
+		report(RestorePhaseCopying)
+	} else {
+		report(RestorePhaseDownloading)
+		localFilename := stagingPath(backupKey)
+		err = downloadBackup(s3Bucket, backupKey, localFilename)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(localFilename)
+
+		err = VerifyBackupIntegrity(s3Bucket, backupKey, localFilename)
+		if err != nil {
+			return err
+		}
+
+		// The backup tarball was created from / with leading slashes
+		// stripped, so extracting at / recreates the backup directory.
+		report(RestorePhaseCopying)
+		dest := fileSpec{
+			PodNamespace: namespace,
+			PodName:      podName,
+			File:         "/",
+		}
+		err = CopyToPod(localFilename, dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	report(RestorePhaseRestoring)
+	options := ExecOptions{
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+
+	// Stop everything that talks to the database before restoring. The
+	// deferred unquiesce brings the instance back even when the restore
+	// fails partway.
+	err = Quiesce(namespace, podName, "restore")
+	defer Unquiesce(namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	restore := []string{"gitlab-rake", "gitlab:backup:restore", "force=yes"}
+	if len(skips) > 0 {
+		restore = append(restore, "SKIP="+strings.Join(skips, ","))
+	}
+	options.Command = restore
+	err = ExecWithOptions(options)
+	if err != nil {
+		return err
+	}
+
+	// Restore /etc/gitlab from the tarball taken during backup and
+	// reconfigure so the instance picks up the restored secrets.
+	report(RestorePhaseReconfiguring)
+	options.Command = []string{"tar", "xzf", GitLabRemoteEtcFile, "-C", "/"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return err
+	}
+
+	// Components the backup skipped because their data lives in object
+	// storage need the restored instance pointed back at those buckets.
+	if metadata, found := fetchBackupMetadata(s3Bucket, backupKey); found && len(metadata.ObjectStorageRefs) > 0 {
+		err = applyObjectStorageRefs(namespace, podName, metadata.ObjectStorageRefs)
+		if err != nil {
+			return err
+		}
+	}
+
+	options.Command = []string{"gitlab-ctl", "reconfigure"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return err
+	}
+
+	options.Command = []string{"gitlab-ctl", "restart"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return err
+	}
+
+	err = RunHook(HookPostRestore, namespace, podName, GitLabContainerName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished restore of GitLab instance\n")
+	EmitNormalEvent(namespace, podName, EventRestoreComplete,
+		fmt.Sprintf("GitLab restore of %v complete", backupKey))
+	SendNotification(Notification{
+		Operation:   "restore",
+		Succeeded:   true,
+		Destination: s3Bucket + "/" + backupKey,
+	})
+
+	return nil
+}
+
+// Runs the restore workflow for a GitLabRestore custom resource, recording
+// phase transitions in its status.
+func handleRestore(client dynamic.ResourceInterface, obj *unstructured.Unstructured) {
+	s3Bucket := GetSpecString(obj, "s3")
+	if s3Bucket == "" {
+		s3Bucket = operatorConfig.GetString("s3")
+	}
+	timestamp := GetSpecString(obj, "timestamp")
+
+	var skips []string
+	if GetSpecBool(obj, "skipRegistry") {
+		skips = append(skips, "registry")
+	}
+	if GetSpecBool(obj, "skipArtifacts") {
+		skips = append(skips, "artifacts")
+	}
+
+	report := func(phase string) {
+		err := SetStatusField(client, obj, "phase", phase)
+		if err != nil {
+			fmt.Printf("unable to update phase of GitLabRestore %v: %v\n", obj.GetName(), err)
+		}
+	}
+
+	err := Restore(obj.GetNamespace(), s3Bucket, timestamp, skips, report)
+	if err != nil {
+		fmt.Printf("restore %v failed: %v\n", obj.GetName(), err)
+		report(RestorePhaseFailed)
+		SetStatusField(client, obj, "reason", err.Error())
+		SendNotification(Notification{
+			Operation:   "restore",
+			Succeeded:   false,
+			Destination: s3Bucket,
+			Message:     err.Error(),
+		})
+		return
+	}
+
+	report(RestorePhaseComplete)
+}
+
+// Watches GitLabRestore resources in the configured namespaces and runs
+// the restore workflow for each new one.
+func runRestoreController(stop <-chan struct{}) {
+	namespaces, err := WatchNamespaces()
+	if err != nil {
+		fmt.Printf("restore controller: %v\n", err)
+		return
+	}
+
+	for _, namespace := range namespaces {
+		go watchRestores(namespace, stop)
+	}
+	<-stop
+}
+
+func watchRestores(namespace string, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		client, err := NewCRDClient("gitlabrestores", namespace)
+		if err != nil {
+			fmt.Printf("restore controller: %v\n", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		watcher, err := client.Watch(metav1.ListOptions{})
+		if err != nil {
+			fmt.Printf("unable to watch gitlabrestores: %v\n", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		for event := range watcher.ResultChan() {
+			if event.Type != watch.Added {
+				continue
+			}
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			if phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase"); phase != "" {
+				continue
+			}
+			restoreObj := obj
+			EnqueueOperation("restore "+restoreObj.GetName(), func() error {
+				handleRestore(client, restoreObj)
+				return nil
+			})
+		}
+	}
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:          "restore [-s bucket] [-t timestamp]",
+	Short:        "Restores GitLab from a backup",
+	SilenceUsage: true,
+	Long: `Restores a GitLab deployment from a backup previously saved to an s3
+bucket by the backup command. The backup is selected by timestamp, or the
+most recent backup is used when the timestamp is "latest" or omitted.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		s3 := operatorConfig.GetString("s3")
+		namespace, err := GetNamespace()
+		if err == nil {
+			err = Restore(namespace, s3, RestoreTimestamp, nil, nil)
+		}
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(restoreCmd)
+
+	restoreCmd.Flags().StringVarP(
+		&RestoreTimestamp,
+		"timestamp",
+		"t",
+		"latest",
+		"timestamp of the backup to restore, or \"latest\"")
+
+	RegisterController(runRestoreController)
+}
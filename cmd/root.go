@@ -16,10 +16,12 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"os"
 	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 const (
@@ -34,6 +36,18 @@ const (
 var S3Location string
 var ExitCode int
 
+// Path of an explicit config file; when empty the default locations are
+// searched.
+var ConfigFile string
+
+// When true, log every pod exec, upload, and object mutation that would
+// happen without performing any of them.
+var DryRun bool
+
+// Identity to impersonate for all Kubernetes API calls, kubectl style.
+var ImpersonateUser string
+var ImpersonateGroups []string
+
 // init the careen config viper instance
 var operatorConfig = viper.New()
 
@@ -64,15 +78,67 @@ func init() {
 		"s",
 		"",
 		"s3 bucket or object for backups and restores")
+
+	RootCmd.PersistentFlags().StringVar(
+		&ConfigFile,
+		"config",
+		"",
+		"config file (default searches /etc/gitlab-operator/config.yaml, then ./config.yaml)")
+
+	RootCmd.PersistentFlags().BoolVar(
+		&DryRun,
+		"dry-run",
+		false,
+		"log the commands and object writes that would happen without performing them")
+
+	RootCmd.PersistentFlags().StringVar(
+		&ImpersonateUser,
+		"as",
+		"",
+		"username to impersonate for Kubernetes API calls")
+	RootCmd.PersistentFlags().StringArrayVar(
+		&ImpersonateGroups,
+		"as-group",
+		nil,
+		"group to impersonate for Kubernetes API calls, repeatable")
 }
 
-// Initializes operatorConfig to use flags or ENV variables (in that order).
+// Initializes operatorConfig to use flags, ENV variables, or a config file
+// (in that order). The config file is a YAML file, typically mounted from a
+// ConfigMap, covering every setting flags and env vars do: storage buckets,
+// schedules, retention, notification targets, selectors, hooks, and so on.
+// Changes to the file are picked up without a restart, so the long-running
+// operator follows ConfigMap edits.
 func initOperatorConfig() {
 	operatorConfig.BindPFlag("s3", RootCmd.Flags().Lookup("s3"))
 
 	operatorConfig.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	operatorConfig.SetEnvPrefix("GITLAB_OPERATOR") // prefix for env vars to configure cluster
 	operatorConfig.AutomaticEnv()                  // read in environment variables that match
+
+	if ConfigFile != "" {
+		operatorConfig.SetConfigFile(ConfigFile)
+	} else {
+		operatorConfig.SetConfigName("config")
+		operatorConfig.AddConfigPath("/etc/gitlab-operator")
+		operatorConfig.AddConfigPath(".")
+	}
+
+	err := operatorConfig.ReadInConfig()
+	if err != nil {
+		// A config file is optional unless one was named explicitly.
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok || ConfigFile != "" {
+			fmt.Printf("unable to read config file: %v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	fmt.Printf("Using config file %v\n", operatorConfig.ConfigFileUsed())
+	operatorConfig.WatchConfig()
+	operatorConfig.OnConfigChange(func(event fsnotify.Event) {
+		fmt.Printf("Config file %v changed, settings reloaded\n", event.Name)
+	})
 }
 
 func validateArguments(cmd *cobra.Command, args []string) error {
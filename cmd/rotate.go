@@ -0,0 +1,213 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Secret rotation settings. When secret_rotation_interval is a non-zero
+// duration (e.g. "720h"), the rotation controller regenerates the GitLab
+// root password and the runner registration token at that interval,
+// applies them through the rails console, and updates the corresponding
+// Secrets. The rotation timestamp is recorded as an annotation on each
+// Secret and in the status ConfigMap.
+const (
+	RotationIntervalSetting = "secret_rotation_interval"
+	RootPasswordSecretName  = "gitlab-root-password"
+	RunnerTokenSecretName   = "gitlab-runner-token"
+	RotatedAtAnnotation     = "gitlab-operator/rotated-at"
+)
+
+// Returns a random hex password suitable for the GitLab root account.
+func randomPassword() (string, error) {
+	buffer := make([]byte, 24)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// Creates or updates a single-key Secret and stamps it with the rotation
+// timestamp.
+func storeRotatedSecret(clientset kubernetes.Interface, namespace, name, key, value string) error {
+	if DryRun {
+		fmt.Printf("Dry run: would update secret %v/%v\n", namespace, name)
+		return nil
+	}
+
+	secrets := clientset.Core().Secrets(namespace)
+	annotations := map[string]string{
+		RotatedAtAnnotation: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	existing, err := secrets.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Annotations: annotations,
+			},
+			Data: map[string][]byte{key: []byte(value)},
+		}
+		_, err = secrets.Create(secret)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if existing.Data == nil {
+		existing.Data = map[string][]byte{}
+	}
+	existing.Data[key] = []byte(value)
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	existing.Annotations[RotatedAtAnnotation] = annotations[RotatedAtAnnotation]
+	_, err = secrets.Update(existing)
+	return err
+}
+
+// Sets a new random root password through the rails console and stores it
+// in the root password Secret.
+func rotateRootPassword(clientset kubernetes.Interface, namespace, podName string) error {
+	password, err := randomPassword()
+	if err != nil {
+		return err
+	}
+
+	// The script reaches the console on stdin so the password never
+	// appears on an exec command line, in the log, or in the audit trail.
+	script := fmt.Sprintf("user = User.find_by_username('root'); user.password = '%v'; user.password_confirmation = '%v'; user.save!", password, password)
+	options := ExecOptions{
+		Command:       []string{"gitlab-rails", "runner", "-"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		Stdin:         strings.NewReader(script),
+		CaptureStderr: true,
+		Sensitive:     true,
+	}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("unable to rotate root password: %v", err)
+	}
+
+	return storeRotatedSecret(clientset, namespace, RootPasswordSecretName, "password", password)
+}
+
+// Resets the runner registration token through the rails console and
+// stores the new token in the runner token Secret.
+func rotateRunnerToken(clientset kubernetes.Interface, namespace, podName string) error {
+	// Sensitive: the new token comes back on stdout and must not be
+	// streamed into the log.
+	options := ExecOptions{
+		Command: []string{"gitlab-rails", "runner",
+			"ApplicationSetting.current.reset_runners_registration_token!; puts ApplicationSetting.current.runners_registration_token"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+		Sensitive:     true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return fmt.Errorf("unable to rotate runner registration token: %v", err)
+	}
+
+	token := strings.TrimSpace(stdout)
+	if token == "" {
+		return fmt.Errorf("rails console returned an empty runner registration token")
+	}
+
+	return storeRotatedSecret(clientset, namespace, RunnerTokenSecretName, "registration-token", token)
+}
+
+// Rotates the secrets of the GitLab instance in one namespace.
+func rotateSecrets(namespace string) error {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rotating secrets of GitLab instance %v, %v\n", namespace, podName)
+
+	err = rotateRootPassword(clientset, namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	err = rotateRunnerToken(clientset, namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished rotating secrets in namespace %v\n", namespace)
+	return nil
+}
+
+// Rotates secrets at the configured interval in every watched namespace.
+// Disabled unless secret_rotation_interval is set.
+func runRotationController(stop <-chan struct{}) {
+	interval := operatorConfig.GetDuration(RotationIntervalSetting)
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		namespaces, err := WatchNamespaces()
+		if err != nil {
+			fmt.Printf("rotation controller: %v\n", err)
+			continue
+		}
+
+		for _, namespace := range namespaces {
+			err = rotateSecrets(namespace)
+			if err != nil {
+				fmt.Printf("rotation of %v failed: %v\n", namespace, err)
+			}
+		}
+	}
+}
+
+func init() {
+	RegisterController(runRotationController)
+}
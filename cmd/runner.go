@@ -0,0 +1,296 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	RunnerLabelKey      = "component"
+	RunnerLabelValue    = "gitlab-runner"
+	RunnerContainerName = "gitlab-runner"
+)
+
+// Spec of a Runner custom resource.
+type RunnerSpec struct {
+	// URL of the GitLab instance to register against.
+	GitLabURL string
+	// Name of the Secret holding the registration token under the key
+	// "registration-token".
+	TokenSecret string
+	Tags        []string
+	Concurrency int64
+	Executor    string
+	Version     string
+}
+
+func runnerSpecFrom(obj *unstructured.Unstructured) RunnerSpec {
+	tags, _, _ := unstructured.NestedStringSlice(obj.Object, "spec", "tags")
+	concurrency, _, _ := unstructured.NestedInt64(obj.Object, "spec", "concurrency")
+	spec := RunnerSpec{
+		GitLabURL:   GetSpecString(obj, "gitlabURL"),
+		TokenSecret: GetSpecString(obj, "tokenSecret"),
+		Tags:        tags,
+		Concurrency: concurrency,
+		Executor:    GetSpecString(obj, "executor"),
+		Version:     GetSpecString(obj, "version"),
+	}
+	if spec.Executor == "" {
+		spec.Executor = "shell"
+	}
+	if spec.Concurrency == 0 {
+		spec.Concurrency = 1
+	}
+	if spec.Version == "" {
+		spec.Version = "latest"
+	}
+	return spec
+}
+
+func runnerLabels(name string) map[string]string {
+	return map[string]string{
+		RunnerLabelKey: RunnerLabelValue,
+		"runner":       name,
+	}
+}
+
+// Reads the registration token for a runner from its Secret.
+func runnerRegistrationToken(clientset kubernetes.Interface, namespace string, spec RunnerSpec) (string, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(spec.TokenSecret, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to read token secret %v: %v", spec.TokenSecret, err)
+	}
+
+	token, ok := secret.Data["registration-token"]
+	if !ok {
+		return "", fmt.Errorf("secret %v has no registration-token key", spec.TokenSecret)
+	}
+
+	return string(token), nil
+}
+
+// Reconciles the Deployment running a gitlab-runner pod for the resource.
+func reconcileRunnerDeployment(clientset kubernetes.Interface, namespace, name string, spec RunnerSpec) error {
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: runnerLabels(name)},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: runnerLabels(name)},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: runnerLabels(name)},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  RunnerContainerName,
+						Image: "gitlab/gitlab-runner:" + spec.Version,
+					}},
+				},
+			},
+		},
+	}
+
+	deployments := clientset.AppsV1().Deployments(namespace)
+	existing, err := deployments.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = deployments.Create(deployment)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	existing.Spec = deployment.Spec
+	_, err = deployments.Update(existing)
+	return err
+}
+
+// Registers a runner pod against the GitLab instance if it has not been
+// registered yet.
+func registerRunner(clientset kubernetes.Interface, namespace, name string, spec RunnerSpec) error {
+	podNames, err := GetPodsWithLabel(namespace, "runner", name)
+	if err != nil {
+		return err
+	} else if len(podNames) != 1 {
+		return fmt.Errorf("there were %v pods for runner %v when exactly one was expected", len(podNames), name)
+	}
+
+	options := ExecOptions{
+		Namespace:     namespace,
+		PodName:       podNames[0],
+		ContainerName: RunnerContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+
+	// An already registered runner has an entry in its config.
+	options.Command = []string{"gitlab-runner", "list"}
+	stdout, stderr, err := ExecWithOutput(options)
+	if err == nil && strings.Contains(stdout+stderr, name) {
+		return nil
+	}
+
+	token, err := runnerRegistrationToken(clientset, namespace, spec)
+	if err != nil {
+		return err
+	}
+
+	// The token reaches the command on stdin, not argv, so it never shows
+	// up in the exec log or the audit trail.
+	register := strings.Join([]string{
+		"gitlab-runner", "register",
+		"--non-interactive",
+		"--registration-token", `"$TOKEN"`,
+		"--name", name,
+		"--url", spec.GitLabURL,
+		"--executor", spec.Executor,
+		"--tag-list", strings.Join(spec.Tags, ","),
+		"--limit", strconv.FormatInt(spec.Concurrency, 10),
+	}, " ")
+	options.Command = []string{"sh", "-c", "read -r TOKEN; " + register}
+	options.Stdin = strings.NewReader(token + "\n")
+	options.Sensitive = true
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("unable to register runner %v: %v", name, err)
+	}
+
+	fmt.Printf("Registered runner %v against %v\n", name, spec.GitLabURL)
+	return nil
+}
+
+// Unregisters the runner's registrations and removes its Deployment. Used
+// when a Runner resource has been deleted.
+func teardownRunner(clientset kubernetes.Interface, namespace, name string) error {
+	if DryRun {
+		fmt.Printf("Dry run: would unregister and remove runner %v/%v\n", namespace, name)
+		return nil
+	}
+
+	podNames, err := GetPodsWithLabel(namespace, "runner", name)
+	if err == nil && len(podNames) == 1 {
+		options := ExecOptions{
+			Command:       []string{"gitlab-runner", "unregister", "--all-runners"},
+			Namespace:     namespace,
+			PodName:       podNames[0],
+			ContainerName: RunnerContainerName,
+			CaptureStdout: true,
+			CaptureStderr: true,
+		}
+		err = ExecWithOptions(options)
+		if err != nil {
+			fmt.Printf("unable to unregister runner %v: %v\n", name, err)
+		}
+	}
+
+	fmt.Printf("Removing runner %v\n", name)
+	return clientset.AppsV1().Deployments(namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
+// Periodically reconciles Runner resources in the configured namespaces:
+// deploys and registers runners for each resource, and tears down runners
+// whose resource has been deleted.
+func runRunnerController(stop <-chan struct{}) {
+	namespaces, err := WatchNamespaces()
+	if err != nil {
+		fmt.Printf("runner controller: %v\n", err)
+		return
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(30 * time.Second):
+		}
+
+		_, clientset, err := GetInCluster()
+		if err != nil {
+			fmt.Printf("runner controller: %v\n", err)
+			continue
+		}
+
+		for _, namespace := range namespaces {
+			client, err := NewCRDClient("runners", namespace)
+			if err != nil {
+				fmt.Printf("runner controller: %v\n", err)
+				continue
+			}
+
+			list, err := client.List(metav1.ListOptions{})
+			if err != nil {
+				fmt.Printf("unable to list runners: %v\n", err)
+				continue
+			}
+			items, ok := list.(*unstructured.UnstructuredList)
+			if !ok {
+				continue
+			}
+
+			wanted := sets.NewString()
+			for i := range items.Items {
+				obj := &items.Items[i]
+				name := obj.GetName()
+				runnerNamespace := obj.GetNamespace()
+				wanted.Insert(runnerNamespace + "/" + name)
+				spec := runnerSpecFrom(obj)
+
+				err = reconcileRunnerDeployment(clientset, runnerNamespace, name, spec)
+				if err != nil {
+					fmt.Printf("unable to reconcile runner %v: %v\n", name, err)
+					continue
+				}
+				err = registerRunner(clientset, runnerNamespace, name, spec)
+				if err != nil {
+					fmt.Printf("%v\n", err)
+					continue
+				}
+				SetStatusField(client, obj, "phase", "Running")
+			}
+
+			// Tear down runner deployments whose resource is gone.
+			selector := metav1.LabelSelector{}
+			metav1.AddLabelToSelector(&selector, RunnerLabelKey, RunnerLabelValue)
+			deployments, err := clientset.AppsV1().Deployments(namespace).List(
+				metav1.ListOptions{LabelSelector: metav1.FormatLabelSelector(&selector)})
+			if err != nil {
+				fmt.Printf("unable to list runner deployments: %v\n", err)
+				continue
+			}
+			for _, deployment := range deployments.Items {
+				if !wanted.Has(deployment.Namespace + "/" + deployment.Name) {
+					err = teardownRunner(clientset, deployment.Namespace, deployment.Name)
+					if err != nil {
+						fmt.Printf("unable to tear down runner %v: %v\n", deployment.Name, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func init() {
+	RegisterController(runRunnerController)
+}
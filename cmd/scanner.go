@@ -0,0 +1,217 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+// Backup integrity scanning. An upload can "succeed" and still be garbage
+// — a zero-byte object, or a truncated one when the connection died at the
+// wrong moment. The scanner re-lists the most recent backups, compares
+// each object's size against the size recorded in its metadata at upload
+// time, and spot-reads the first and last bytes to check the stream really
+// is a compressed tarball. Suspicious backups raise a notification and the
+// gitlab_operator_suspicious_backups gauge. Setting
+// integrity_scan_interval runs the scan periodically.
+const (
+	IntegrityScanIntervalSetting = "integrity_scan_interval"
+	IntegrityScanRecentSetting   = "integrity_scan_recent"
+	DefaultIntegrityScanRecent   = 5
+)
+
+// Reads length bytes at offset from an object, with -1 meaning "the last
+// length bytes".
+func readObjectRange(s3Bucket, key string, offset, length int64) ([]byte, error) {
+	sess, err := newAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	rangeHeader := fmt.Sprintf("bytes=%v-%v", offset, offset+length-1)
+	if offset < 0 {
+		rangeHeader = fmt.Sprintf("bytes=-%v", length)
+	}
+
+	object, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(rangeHeader),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	return ioutil.ReadAll(object.Body)
+}
+
+// Leading bytes of the compression formats backups are written in.
+var compressionMagics = map[string][]byte{
+	".tar.gz":  {0x1f, 0x8b},
+	".tar.zst": {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// Why this backup looks suspicious, or "" when it passes.
+func inspectBackup(s3Bucket string, backup BackupInfo) string {
+	if backup.Size == 0 {
+		return "object is zero bytes"
+	}
+
+	metadata, found := fetchBackupMetadata(s3Bucket, backup.Key)
+	if found && metadata.Size > 0 && metadata.Size != backup.Size {
+		return fmt.Sprintf("object is %v bytes but %v were recorded at upload time",
+			backup.Size, metadata.Size)
+	}
+
+	// Chunked backups have no single object to sample; the per-chunk
+	// checksums in ChunkedDownload cover them.
+	if backupIsChunked(s3Bucket, backup.Key) {
+		return ""
+	}
+
+	// The first bytes must look like the compression format the extension
+	// promises, and the tail must actually be readable at the recorded
+	// size. A truncated upload fails one or the other.
+	for extension, magic := range compressionMagics {
+		if !strings.HasSuffix(backup.Key, extension) {
+			continue
+		}
+		head, err := readObjectRange(s3Bucket, backup.Key, 0, int64(len(magic)))
+		if err != nil {
+			return fmt.Sprintf("unable to read leading bytes: %v", err)
+		}
+		if !bytes.HasPrefix(head, magic) {
+			return fmt.Sprintf("leading bytes %x are not a %v header", head, extension)
+		}
+	}
+
+	tail, err := readObjectRange(s3Bucket, backup.Key, -1, 1)
+	if err != nil || len(tail) == 0 {
+		return fmt.Sprintf("unable to read trailing bytes: %v", err)
+	}
+
+	return ""
+}
+
+// ScanBackupIntegrity inspects the most recent backups in the bucket and
+// reports the ones that look corrupt or truncated.
+func ScanBackupIntegrity(s3Bucket string) error {
+	backups, err := ListBackups(s3Bucket)
+	if err != nil {
+		return err
+	}
+
+	recent := operatorConfig.GetInt(IntegrityScanRecentSetting)
+	if recent <= 0 {
+		recent = DefaultIntegrityScanRecent
+	}
+	if len(backups) > recent {
+		backups = backups[len(backups)-recent:]
+	}
+
+	fmt.Printf("Begining integrity scan of %v backups in %v\n", len(backups), s3Bucket)
+
+	var suspicious []string
+	for _, backup := range backups {
+		reason := inspectBackup(s3Bucket, backup)
+		if reason == "" {
+			continue
+		}
+		fmt.Printf("Backup %v looks suspicious: %v\n", backup.Key, reason)
+		suspicious = append(suspicious, fmt.Sprintf("%v (%v)", backup.Key, reason))
+	}
+
+	setHealthMetric("gitlab_operator_suspicious_backups", float64(len(suspicious)))
+	RecordStatus(map[string]string{
+		"lastIntegrityScanTimestamp":  time.Now().UTC().Format(time.RFC3339),
+		"lastIntegrityScanSuspicious": strconv.Itoa(len(suspicious)),
+	})
+
+	if len(suspicious) > 0 {
+		message := strings.Join(suspicious, "; ")
+		SendNotification(Notification{
+			Operation:   "integrity-scan",
+			Succeeded:   false,
+			Destination: s3Bucket,
+			Message:     message,
+		})
+		return fmt.Errorf("%v of %v backups look suspicious: %v", len(suspicious), len(backups), message)
+	}
+
+	fmt.Printf("Finished integrity scan: all %v backups look intact\n", len(backups))
+	return nil
+}
+
+// Runs integrity scans at the configured interval. Disabled unless
+// integrity_scan_interval is set.
+func runIntegrityScanController(stop <-chan struct{}) {
+	interval := operatorConfig.GetDuration(IntegrityScanIntervalSetting)
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := ScanBackupIntegrity(operatorConfig.GetString("s3"))
+		if err != nil {
+			fmt.Printf("integrity scan: %v\n", err)
+		}
+	}
+}
+
+// scanBackupsCmd represents the scan-backups command
+var scanBackupsCmd = &cobra.Command{
+	Use:          "scan-backups [-s bucket]",
+	Short:        "Scans recent backups for truncated or corrupt uploads",
+	SilenceUsage: true,
+	Long: `Inspects the most recent backups in the bucket: compares object sizes
+against the sizes recorded at upload time and spot-reads the first and
+last bytes of each object, flagging zero-byte and truncated uploads that
+otherwise look successful.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := ScanBackupIntegrity(operatorConfig.GetString("s3"))
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(scanBackupsCmd)
+	RegisterController(runIntegrityScanController)
+}
@@ -0,0 +1,107 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Reports whether all of the pod's containers are ready.
+func isPodReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// GetPodsWithSelector returns the names of pods matching a full label
+// selector string and optional field selector. When readyOnly is set,
+// pods that are not Ready or are Terminating are filtered out so backups
+// never target a pod on its way down.
+func GetPodsWithSelector(namespace, labelSelector, fieldSelector string, readyOnly bool) ([]string, error) {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	options := metav1.ListOptions{
+		LabelSelector: labelSelector,
+		FieldSelector: fieldSelector,
+	}
+	pods, err := clientset.Core().Pods(namespace).List(options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods: err %v\n", err)
+	}
+
+	var podNames []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if readyOnly {
+			if pod.DeletionTimestamp != nil || !isPodReady(pod) {
+				continue
+			}
+		}
+		podNames = append(podNames, pod.Name)
+	}
+
+	// Sort so that selection among multiple matches is deterministic.
+	sort.Strings(podNames)
+
+	return podNames, nil
+}
+
+// The label selector used to find the GitLab pod; override the default
+// with the selector setting (flag or GITLAB_OPERATOR_SELECTOR).
+func gitLabSelector() string {
+	selector := operatorConfig.GetString("selector")
+	if selector == "" {
+		selector = GitLabLabelKey + "=" + GitLabLabelValue
+	}
+	return selector
+}
+
+// GetTargetPod returns the pod backups and restores should exec into: the
+// first, in name order, of the Ready pods matching the configured
+// selector. Name order keeps the choice stable across invocations when a
+// deployment briefly has more than one pod.
+func GetTargetPod(namespace string) (string, error) {
+	selector := gitLabSelector()
+
+	// Prefer the informer cache when the operator is running long-lived;
+	// one-shot commands fall through to a direct List.
+	podNames := cachedGitLabPods()
+	sort.Strings(podNames)
+	if podNames == nil {
+		var err error
+		podNames, err = GetPodsWithSelector(namespace, selector, "status.phase=Running", true)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(podNames) == 0 {
+		return "", fmt.Errorf("no ready pods matched selector %v in namespace %v", selector, namespace)
+	}
+	if len(podNames) > 1 {
+		fmt.Printf("%v ready pods matched selector %v; using %v\n", len(podNames), selector, podNames[0])
+	}
+
+	return podNames[0], nil
+}
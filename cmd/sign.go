@@ -0,0 +1,196 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Backup metadata signing. When signing_key_secret names a Secret, the
+// metadata object uploaded with each backup is signed with the key in the
+// Secret's "signing-key" entry, and restores verify both the signature and
+// the tarball checksum the metadata records. An attacker with write access
+// to the bucket but not the cluster cannot forge either, so a modified
+// backup is detected before it is restored.
+const (
+	SigningSecretSetting = "signing_key_secret"
+	SigningSecretKey     = "signing-key"
+)
+
+// Reads the signing key from the configured Secret. Returns nil without an
+// error when signing is not configured.
+func loadSigningKey() ([]byte, error) {
+	secretName := operatorConfig.GetString(SigningSecretSetting)
+	if secretName == "" {
+		return nil, nil
+	}
+
+	namespace, err := GetNamespace()
+	if err != nil {
+		return nil, err
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := clientset.Core().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signing key secret %v: %v", secretName, err)
+	}
+
+	key, ok := secret.Data[SigningSecretKey]
+	if !ok || len(key) == 0 {
+		return nil, fmt.Errorf("signing key secret %v has no %v entry", secretName, SigningSecretKey)
+	}
+
+	return key, nil
+}
+
+// SignData returns the hex HMAC-SHA256 of data under the configured signing
+// key, or "" when signing is not configured.
+func SignData(data []byte) (string, error) {
+	key, err := loadSigningKey()
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		return "", nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifySignature checks a signature produced by SignData. Returns nil when
+// signing is not configured.
+func VerifySignature(data []byte, signature string) error {
+	key, err := loadSigningKey()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.TrimSpace(signature))) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return nil
+}
+
+// Key of the detached signature object for a backup tarball key.
+func backupSignatureKey(key string) string {
+	return backupMetadataKey(key) + ".sig"
+}
+
+// Signs the backup metadata JSON and uploads the detached signature next to
+// it. A no-op when signing is not configured.
+func uploadBackupSignature(s3Bucket, key string, metadata []byte) error {
+	signature, err := SignData(metadata)
+	if err != nil {
+		return err
+	}
+	if signature == "" {
+		return nil
+	}
+
+	localFilename := "backup-meta.sig"
+	err = ioutil.WriteFile(localFilename, []byte(signature), 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFilename)
+
+	return UploadFileToS3(s3Bucket, backupSignatureKey(key), localFilename)
+}
+
+// VerifyBackupIntegrity verifies a downloaded backup tarball against its
+// signed metadata: the metadata's signature must check out and the
+// tarball's sha256 must match the checksum the metadata records. A no-op
+// when signing is not configured.
+func VerifyBackupIntegrity(s3Bucket, key, localFilename string) error {
+	if operatorConfig.GetString(SigningSecretSetting) == "" {
+		return nil
+	}
+
+	metadata, signature, err := fetchSignedMetadata(s3Bucket, key)
+	if err != nil {
+		return err
+	}
+
+	err = VerifySignature(metadata, signature)
+	if err != nil {
+		return fmt.Errorf("backup %v failed signature verification: %v", key, err)
+	}
+
+	result, found := fetchBackupMetadata(s3Bucket, key)
+	if !found {
+		return fmt.Errorf("backup %v has a signature but unreadable metadata", key)
+	}
+
+	checksum, err := FileChecksum(localFilename)
+	if err != nil {
+		return err
+	}
+	if checksum != result.Checksum {
+		return fmt.Errorf("backup %v checksum mismatch: expected %v, got %v", key, result.Checksum, checksum)
+	}
+
+	fmt.Printf("Verified signature and checksum of %v\n", key)
+	return nil
+}
+
+// Fetches a backup's raw metadata JSON and detached signature.
+func fetchSignedMetadata(s3Bucket, key string) ([]byte, string, error) {
+	metadataFile := "verify-meta.json"
+	err := DownloadFromS3(s3Bucket, backupMetadataKey(key), metadataFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("backup %v has no metadata to verify: %v", key, err)
+	}
+	defer os.Remove(metadataFile)
+
+	metadata, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		return nil, "", err
+	}
+
+	signatureFile := "verify-meta.sig"
+	err = DownloadFromS3(s3Bucket, backupSignatureKey(key), signatureFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("backup %v is unsigned: %v", key, err)
+	}
+	defer os.Remove(signatureFile)
+
+	signature, err := ioutil.ReadFile(signatureFile)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return metadata, string(signature), nil
+}
@@ -0,0 +1,260 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// SLO-style indicators on top of the raw metrics: how long since the last
+// successful backup, and the success ratio over a rolling 30 days,
+// exposed as gauges on /metrics. With prometheus_rules set, a
+// PrometheusRule object carrying matching alerts is created alongside the
+// operator so alerting ships with it. backup_slo_max_age (default 26h)
+// sets the alert threshold for backup staleness.
+const (
+	PrometheusRulesSetting = "prometheus_rules"
+	BackupSLOMaxAgeSetting = "backup_slo_max_age"
+	DefaultBackupSLOMaxAge = 26 * time.Hour
+
+	// ConfigMap holding the rolling backup attempt history the ratio is
+	// computed from.
+	BackupHistoryConfigMapName = "gitlab-operator-backup-history"
+
+	backupHistoryWindow = 30 * 24 * time.Hour
+
+	PrometheusRuleName = "gitlab-operator-slo"
+)
+
+// backupAttempt is one entry of the rolling history.
+type backupAttempt struct {
+	Timestamp time.Time `json:"timestamp"`
+	Succeeded bool      `json:"succeeded"`
+}
+
+// appendBackupHistory adds an attempt to the rolling history, dropping
+// entries older than the window. Best effort.
+func appendBackupHistory(attempt backupAttempt) {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return
+	}
+
+	configMaps := clientset.Core().ConfigMaps(namespace)
+	existing, err := configMaps.Get(BackupHistoryConfigMapName, metav1.GetOptions{})
+
+	var history []backupAttempt
+	if err == nil && existing.Data != nil {
+		json.Unmarshal([]byte(existing.Data["history"]), &history)
+	}
+
+	history = append(history, attempt)
+	cutoff := time.Now().Add(-backupHistoryWindow)
+	trimmed := history[:0]
+	for _, entry := range history {
+		if entry.Timestamp.After(cutoff) {
+			trimmed = append(trimmed, entry)
+		}
+	}
+
+	data, marshalErr := json.Marshal(trimmed)
+	if marshalErr != nil {
+		return
+	}
+
+	if errors.IsNotFound(err) {
+		configMap := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: BackupHistoryConfigMapName},
+			Data:       map[string]string{"history": string(data)},
+		}
+		_, err = configMaps.Create(configMap)
+	} else if err == nil {
+		if existing.Data == nil {
+			existing.Data = map[string]string{}
+		}
+		existing.Data["history"] = string(data)
+		_, err = configMaps.Update(existing)
+	}
+	if err != nil {
+		fmt.Printf("unable to record backup history: %v\n", err)
+	}
+}
+
+// readBackupHistory returns the rolling history, oldest first.
+func readBackupHistory() []backupAttempt {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return nil
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return nil
+	}
+
+	existing, err := clientset.Core().ConfigMaps(namespace).Get(BackupHistoryConfigMapName, metav1.GetOptions{})
+	if err != nil || existing.Data == nil {
+		return nil
+	}
+
+	var history []backupAttempt
+	json.Unmarshal([]byte(existing.Data["history"]), &history)
+	return history
+}
+
+// updateSLOMetrics recomputes the SLO gauges from the rolling history.
+func updateSLOMetrics() {
+	history := readBackupHistory()
+
+	var lastSuccess time.Time
+	var attempts, successes int
+	for _, entry := range history {
+		attempts++
+		if entry.Succeeded {
+			successes++
+			if entry.Timestamp.After(lastSuccess) {
+				lastSuccess = entry.Timestamp
+			}
+		}
+	}
+
+	if !lastSuccess.IsZero() {
+		setHealthMetric("gitlab_operator_time_since_last_successful_backup_seconds",
+			time.Since(lastSuccess).Seconds())
+	}
+	if attempts > 0 {
+		setHealthMetric("gitlab_operator_backup_success_ratio_30d",
+			float64(successes)/float64(attempts))
+	}
+}
+
+// The alert threshold for backup staleness.
+func backupSLOMaxAge() time.Duration {
+	age := operatorConfig.GetDuration(BackupSLOMaxAgeSetting)
+	if age <= 0 {
+		age = DefaultBackupSLOMaxAge
+	}
+	return age
+}
+
+// reconcilePrometheusRule creates the PrometheusRule carrying the SLO
+// alerts when it does not exist yet. Requires the prometheus-operator
+// CRDs in the cluster.
+func reconcilePrometheusRule(namespace string) error {
+	client, err := NewDynamicResourceClient("monitoring.coreos.com", "v1", "prometheusrules", namespace)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Get(PrometheusRuleName, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	maxAge := backupSLOMaxAge()
+	rule := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "monitoring.coreos.com/v1",
+			"kind":       "PrometheusRule",
+			"metadata": map[string]interface{}{
+				"name":      PrometheusRuleName,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"groups": []interface{}{
+					map[string]interface{}{
+						"name": "gitlab-operator.slo",
+						"rules": []interface{}{
+							map[string]interface{}{
+								"alert": "GitLabBackupTooOld",
+								"expr": fmt.Sprintf("gitlab_operator_time_since_last_successful_backup_seconds > %v",
+									int64(maxAge.Seconds())),
+								"for": "15m",
+								"labels": map[string]interface{}{
+									"severity": "critical",
+								},
+								"annotations": map[string]interface{}{
+									"summary": fmt.Sprintf("No successful GitLab backup in over %v", maxAge),
+								},
+							},
+							map[string]interface{}{
+								"alert": "GitLabBackupSuccessRatioLow",
+								"expr":  "gitlab_operator_backup_success_ratio_30d < 0.9",
+								"for":   "1h",
+								"labels": map[string]interface{}{
+									"severity": "warning",
+								},
+								"annotations": map[string]interface{}{
+									"summary": "More than 10% of GitLab backups failed over the last 30 days",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if DryRun {
+		fmt.Printf("Dry run: would create PrometheusRule %v\n", PrometheusRuleName)
+		return nil
+	}
+
+	fmt.Printf("Creating PrometheusRule %v\n", PrometheusRuleName)
+	_, err = client.Create(rule)
+	return err
+}
+
+// Keeps the SLO gauges fresh and, when enabled, ships the alert rules.
+func runSLOController(stop <-chan struct{}) {
+	if operatorConfig.GetBool(PrometheusRulesSetting) {
+		namespace, err := GetNamespace()
+		if err == nil {
+			err = reconcilePrometheusRule(namespace)
+		}
+		if err != nil {
+			fmt.Printf("slo controller: %v\n", err)
+		}
+	}
+
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		updateSLOMetrics()
+	}
+}
+
+func init() {
+	RegisterController(runSLOController)
+}
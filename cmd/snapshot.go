@@ -0,0 +1,113 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// API group and version of the CSI external snapshotter's CRDs.
+const (
+	SnapshotGroup   = "snapshot.storage.k8s.io"
+	SnapshotVersion = "v1alpha1"
+)
+
+// BackupSnapshot takes CSI VolumeSnapshots of the GitLab data PVCs,
+// bracketed by a brief filesystem quiesce in the pod. Much faster than a
+// rake backup for very large instances, at the cost of needing a CSI
+// driver with snapshot support.
+func BackupSnapshot() error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	// Find the PVCs mounted by the GitLab pod.
+	pod, err := clientset.Core().Pods(namespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	var claims []string
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			claims = append(claims, volume.PersistentVolumeClaim.ClaimName)
+		}
+	}
+	if len(claims) == 0 {
+		return fmt.Errorf("pod %v mounts no persistent volume claims to snapshot", podName)
+	}
+
+	snapshots, err := NewDynamicResourceClient(SnapshotGroup, SnapshotVersion, "volumesnapshots", namespace)
+	if err != nil {
+		return err
+	}
+
+	// Quiesce writes so the snapshots are crash-consistent.
+	err = Quiesce(namespace, podName, "snapshot backup")
+	defer Unquiesce(namespace, podName)
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().UTC().Format("20060102-150405")
+	for _, claim := range claims {
+		name := fmt.Sprintf("%v-%v", claim, timestamp)
+		snapshot := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": SnapshotGroup + "/" + SnapshotVersion,
+				"kind":       "VolumeSnapshot",
+				"metadata": map[string]interface{}{
+					"name":      name,
+					"namespace": namespace,
+					"labels": map[string]interface{}{
+						"created-by": "gitlab-operator",
+					},
+				},
+				"spec": map[string]interface{}{
+					"source": map[string]interface{}{
+						"kind": "PersistentVolumeClaim",
+						"name": claim,
+					},
+				},
+			},
+		}
+
+		if DryRun {
+			fmt.Printf("Dry run: would create VolumeSnapshot %v of claim %v\n", name, claim)
+			continue
+		}
+
+		_, err = snapshots.Create(snapshot)
+		if err != nil {
+			return fmt.Errorf("unable to snapshot claim %v: %v", claim, err)
+		}
+		fmt.Printf("Created VolumeSnapshot %v of claim %v\n", name, claim)
+	}
+
+	return nil
+}
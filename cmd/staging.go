@@ -0,0 +1,150 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Staging area for temporary backup files. By default they land in the
+// operator container's ephemeral overlay, which evaporates on restart and
+// competes with the node's disk. Set staging_pvc to the name of a
+// dedicated claim — the operator creates it (staging_pvc_size,
+// staging_pvc_storage_class) and the operator's Deployment must mount it
+// at staging_dir (default /staging). Leftover files are cleaned up
+// automatically.
+const (
+	StagingPVCSetting      = "staging_pvc"
+	StagingPVCSizeSetting  = "staging_pvc_size"
+	StagingPVCClassSetting = "staging_pvc_storage_class"
+	StagingDirSetting      = "staging_dir"
+
+	DefaultStagingDir     = "/staging"
+	DefaultStagingPVCSize = "20Gi"
+
+	// Staged files older than this are leftovers of interrupted runs.
+	stagingMaxAge = 24 * time.Hour
+)
+
+// Reports whether a dedicated staging volume is configured.
+func stagingEnabled() bool {
+	return operatorConfig.GetString(StagingPVCSetting) != ""
+}
+
+// The directory temporary backup files are staged in.
+func stagingDir() string {
+	if !stagingEnabled() {
+		return "."
+	}
+	if dir := operatorConfig.GetString(StagingDirSetting); dir != "" {
+		return dir
+	}
+	return DefaultStagingDir
+}
+
+// stagingPath places a temporary file in the staging directory.
+func stagingPath(filename string) string {
+	if !stagingEnabled() {
+		return filename
+	}
+	return filepath.Join(stagingDir(), filename)
+}
+
+// EnsureStagingPVC creates the staging claim when it does not exist yet.
+// The operator's Deployment is expected to mount it at staging_dir; the
+// claim is created here so one manifest edit is all that enables it.
+func EnsureStagingPVC(namespace string) error {
+	name := operatorConfig.GetString(StagingPVCSetting)
+	if name == "" {
+		return nil
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	pvcs := clientset.Core().PersistentVolumeClaims(namespace)
+	_, err = pvcs.Get(name, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	size := operatorConfig.GetString(StagingPVCSizeSetting)
+	if size == "" {
+		size = DefaultStagingPVCSize
+	}
+
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: resource.MustParse(size),
+				},
+			},
+		},
+	}
+	if class := operatorConfig.GetString(StagingPVCClassSetting); class != "" {
+		pvc.Spec.StorageClassName = &class
+	}
+
+	if DryRun {
+		fmt.Printf("Dry run: would create staging PVC %v (%v)\n", name, size)
+		return nil
+	}
+
+	fmt.Printf("Creating staging PVC %v (%v)\n", name, size)
+	_, err = pvcs.Create(pvc)
+	return err
+}
+
+// CleanupStaging removes staged backup files left behind by interrupted
+// runs. Best effort.
+func CleanupStaging() {
+	entries, err := ioutil.ReadDir(stagingDir())
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if !strings.HasPrefix(name, GitLabLocalBackupPrefix) && !strings.HasPrefix(name, BaseBackupPrefix) {
+			continue
+		}
+		if time.Since(entry.ModTime()) < stagingMaxAge {
+			continue
+		}
+
+		fmt.Printf("Removing stale staged file %v\n", name)
+		os.Remove(filepath.Join(stagingDir(), name))
+	}
+}
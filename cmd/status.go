@@ -0,0 +1,145 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Name of the ConfigMap in the operator's namespace that records the last
+// backup's metadata, so dashboards and other tooling can answer "when did
+// the last good backup happen" without parsing logs.
+const StatusConfigMapName = "gitlab-operator-status"
+
+// BackupResult is the metadata recorded after each backup attempt.
+type BackupResult struct {
+	Timestamp     time.Time     `json:"timestamp"`
+	Duration      time.Duration `json:"duration"`
+	Size          int64         `json:"size"`
+	Destination   string        `json:"destination"`
+	Replica       string        `json:"replica,omitempty"`
+	Checksum      string        `json:"checksum"`
+	GitLabVersion string        `json:"gitlabVersion"`
+	Succeeded     bool          `json:"succeeded"`
+
+	// Components that were not tarred into the backup because their data
+	// already lives in object storage, and where it lives.
+	ObjectStorageRefs map[string]string `json:"objectStorageRefs,omitempty"`
+}
+
+// FileChecksum returns the hex sha256 of a local file.
+func FileChecksum(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// Reads the GitLab version out of the target pod. Best effort; returns ""
+// when the version file cannot be read.
+func gitLabVersion(namespace, podName, containerName string) string {
+	options := ExecOptions{
+		Command:       []string{"cat", "/opt/gitlab/embedded/service/gitlab-rails/VERSION"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: containerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(stdout)
+}
+
+// RecordBackupResult persists the result of a backup to the status
+// ConfigMap. Best effort: a failure to record never fails the backup.
+func RecordBackupResult(result BackupResult) {
+	data := map[string]string{
+		"lastBackupTimestamp": result.Timestamp.UTC().Format(time.RFC3339),
+		"lastBackupDuration":  result.Duration.Round(time.Second).String(),
+		"lastBackupSize":      strconv.FormatInt(result.Size, 10),
+		"lastBackupKey":       result.Destination,
+		"lastBackupReplica":   result.Replica,
+		"lastBackupChecksum":  result.Checksum,
+		"lastBackupSucceeded": strconv.FormatBool(result.Succeeded),
+		"gitlabVersion":       result.GitLabVersion,
+	}
+	if result.Succeeded {
+		data["lastGoodBackupTimestamp"] = data["lastBackupTimestamp"]
+	}
+
+	RecordStatus(data)
+	appendBackupHistory(backupAttempt{Timestamp: result.Timestamp, Succeeded: result.Succeeded})
+}
+
+// RecordStatus merges key/value pairs into the status ConfigMap, creating
+// it on first use. Best effort: a failure to record is logged, never
+// propagated.
+func RecordStatus(data map[string]string) {
+	namespace, err := GetNamespace()
+	if err != nil {
+		fmt.Printf("unable to record operator status: %v\n", err)
+		return
+	}
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		fmt.Printf("unable to record operator status: %v\n", err)
+		return
+	}
+
+	configMaps := clientset.Core().ConfigMaps(namespace)
+	existing, err := configMaps.Get(StatusConfigMapName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		configMap := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: StatusConfigMapName},
+			Data:       data,
+		}
+		_, err = configMaps.Create(configMap)
+	} else if err == nil {
+		if existing.Data == nil {
+			existing.Data = map[string]string{}
+		}
+		// Merge so keys absent from this update are kept, e.g. the
+		// last good backup timestamp when this attempt failed.
+		for key, value := range data {
+			existing.Data[key] = value
+		}
+		_, err = configMaps.Update(existing)
+	}
+	if err != nil {
+		fmt.Printf("unable to record operator status: %v\n", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strings"
+)
+
+// Flags for the tar that CopyFromPod runs inside the pod. copy_exclude
+// skips tmp and cache directories (comma separated patterns),
+// copy_one_file_system keeps tar from wandering across mount points, and
+// copy_tar_flags passes anything else through verbatim. Setting
+// copy_pipe_compression pipes the stream through the compression codec's
+// program (gzip, zstd) via a shell instead of tar's
+// --use-compress-program, which busybox tar does not have.
+const (
+	CopyExcludeSetting         = "copy_exclude"
+	CopyOneFileSystemSetting   = "copy_one_file_system"
+	CopyTarFlagsSetting        = "copy_tar_flags"
+	CopyPipeCompressionSetting = "copy_pipe_compression"
+)
+
+// The configured extra flags for creating a tarball in a pod.
+func tarCreateFlags() []string {
+	var flags []string
+
+	for _, pattern := range strings.Split(operatorConfig.GetString(CopyExcludeSetting), ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			flags = append(flags, "--exclude="+pattern)
+		}
+	}
+	if operatorConfig.GetBool(CopyOneFileSystemSetting) {
+		flags = append(flags, "--one-file-system")
+	}
+	for _, flag := range strings.Fields(operatorConfig.GetString(CopyTarFlagsSetting)) {
+		flags = append(flags, flag)
+	}
+
+	return flags
+}
+
+// buildTarCreateCommand assembles the in-pod command that tars up file and
+// writes the (compressed) stream to stdout.
+func buildTarCreateCommand(file string) []string {
+	flags := tarCreateFlags()
+	codec := CurrentCompression()
+
+	if operatorConfig.GetBool(CopyPipeCompressionSetting) && codec.program != "" {
+		// Pipe through the compressor explicitly, for tars without
+		// --use-compress-program. Flags with spaces cannot survive the
+		// shell join; keep patterns simple.
+		parts := append([]string{"tar", "-c", "-f", "-"}, flags...)
+		parts = append(parts, file)
+		return []string{"sh", "-c", strings.Join(parts, " ") + " | " + codec.program}
+	}
+
+	command := []string{"tar", "-c", "-f", "-"}
+	command = append(command, codec.TarCreateArgs()...)
+	command = append(command, flags...)
+	command = append(command, file)
+	return command
+}
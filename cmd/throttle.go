@@ -0,0 +1,82 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// Upload throttling settings:
+//
+//	upload_rate_limit      bytes/sec applied to uploads, 0 for unlimited
+//	upload_rate_limit_day  bytes/sec during the daytime window, overriding
+//	                       upload_rate_limit so business-hours uploads do
+//	                       not saturate the NAT gateway
+//	upload_day_window      the daytime window as "HH:MM-HH:MM", default
+//	                       09:00-18:00
+const DefaultDayWindow = "09:00-18:00"
+
+// Reports whether now falls within the configured daytime window.
+func inDayWindow(now time.Time) bool {
+	window := operatorConfig.GetString("upload_day_window")
+	if window == "" {
+		window = DefaultDayWindow
+	}
+
+	parts := strings.SplitN(window, "-", 2)
+	if len(parts) != 2 {
+		fmt.Printf("Unable to parse upload_day_window %v\n", window)
+		return false
+	}
+	start, err1 := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil {
+		fmt.Printf("Unable to parse upload_day_window %v\n", window)
+		return false
+	}
+
+	minutes := now.Hour()*60 + now.Minute()
+	startMinutes := start.Hour()*60 + start.Minute()
+	endMinutes := end.Hour()*60 + end.Minute()
+	return minutes >= startMinutes && minutes < endMinutes
+}
+
+// Returns the upload rate limit in bytes/sec that applies right now, or 0
+// for unlimited.
+func currentUploadRateLimit() int64 {
+	limit := operatorConfig.GetInt64("upload_rate_limit")
+	if dayLimit := operatorConfig.GetInt64("upload_rate_limit_day"); dayLimit > 0 && inDayWindow(time.Now()) {
+		limit = dayLimit
+	}
+	return limit
+}
+
+// throttledReader wraps an upload stream with the currently applicable
+// rate limit. With no limit configured the reader is returned unchanged.
+func throttledReader(reader io.Reader) io.Reader {
+	limit := currentUploadRateLimit()
+	if limit <= 0 {
+		return reader
+	}
+
+	fmt.Printf("Limiting upload rate to %v bytes/sec\n", limit)
+	bucket := ratelimit.NewBucketWithRate(float64(limit), limit)
+	return ratelimit.Reader(reader, bucket)
+}
@@ -0,0 +1,226 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Storage tiering. upload_storage_class sets the class new backups are
+// uploaded with (e.g. STANDARD_IA). When archive_after_days is set,
+// backups older than that are transitioned to archive_storage_class
+// (default GLACIER) by an explicit server-side copy, so recent backups
+// stay instantly restorable while old ones get archive pricing. Restoring
+// a Glacier object first issues a restore request and polls until the
+// object is readable again.
+const (
+	UploadStorageClassSetting  = "upload_storage_class"
+	ArchiveStorageClassSetting = "archive_storage_class"
+	ArchiveAfterDaysSetting    = "archive_after_days"
+	DefaultArchiveStorageClass = "GLACIER"
+
+	// How long to wait for a Glacier restore request to complete, and how
+	// often to check. Standard-tier Glacier retrievals take hours.
+	GlacierRestoreDeadline = 12 * time.Hour
+	glacierPollInterval    = 5 * time.Minute
+)
+
+// The configured archive storage class.
+func archiveStorageClass() string {
+	class := operatorConfig.GetString(ArchiveStorageClassSetting)
+	if class == "" {
+		class = DefaultArchiveStorageClass
+	}
+	return class
+}
+
+// Reports whether a storage class needs a restore request before reads.
+func isArchiveClass(class string) bool {
+	return class == "GLACIER" || class == "DEEP_ARCHIVE"
+}
+
+// EnsureObjectRestorable checks an object's storage class and, when it
+// lives in an archive tier, issues a restore request and waits for the
+// object to become readable. A no-op for objects in online tiers.
+func EnsureObjectRestorable(s3Bucket, key string) error {
+	sess, err := newAWSSession()
+	if err != nil {
+		return err
+	}
+	svc := s3.New(sess)
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to inspect %v: %v", key, err)
+	}
+
+	if !isArchiveClass(aws.StringValue(head.StorageClass)) {
+		return nil
+	}
+
+	// An x-amz-restore header with ongoing-request="false" means a
+	// previous restore already completed and the copy is readable.
+	restore := aws.StringValue(head.Restore)
+	if strings.Contains(restore, `ongoing-request="false"`) {
+		return nil
+	}
+
+	if restore == "" {
+		fmt.Printf("%v is archived in %v, requesting restore\n", key, aws.StringValue(head.StorageClass))
+		_, err = svc.RestoreObject(&s3.RestoreObjectInput{
+			Bucket: aws.String(s3Bucket),
+			Key:    aws.String(key),
+			RestoreRequest: &s3.RestoreRequest{
+				Days: aws.Int64(1),
+			},
+		})
+		if err != nil && !strings.Contains(err.Error(), "RestoreAlreadyInProgress") {
+			return fmt.Errorf("unable to request restore of %v: %v", key, err)
+		}
+	}
+
+	fmt.Printf("Waiting for archive restore of %v (checking every %v)\n", key, glacierPollInterval)
+	end := time.Now().Add(GlacierRestoreDeadline)
+	for time.Now().Before(end) {
+		time.Sleep(glacierPollInterval)
+
+		head, err = svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(s3Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to inspect %v: %v", key, err)
+		}
+		if strings.Contains(aws.StringValue(head.Restore), `ongoing-request="false"`) {
+			fmt.Printf("Archive restore of %v complete\n", key)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("archive restore of %v did not complete within %v", key, GlacierRestoreDeadline)
+}
+
+// Reports whether a key is a backup tarball under the default layout:
+// gitlab-backup-<RFC3339><ext>. Metadata, chunks, and component objects
+// live under other prefixes, but guard anyway — archiving a chunk would
+// make its backups unrestorable without a Glacier restore per chunk.
+func isBackupTarballKey(key string) bool {
+	rest := strings.TrimPrefix(key, GitLabLocalBackupPrefix)
+	for _, ext := range []string{".tar.gz", ".tar.zst", ".tar"} {
+		if strings.HasSuffix(rest, ext) {
+			_, err := time.Parse(time.RFC3339, strings.TrimSuffix(rest, ext))
+			return err == nil
+		}
+	}
+	return false
+}
+
+// Transitions backup tarballs older than archive_after_days into the
+// archive storage class with a server-side copy. Metadata objects are left
+// in the online tier so list-backups stays fast.
+func archiveOldBackups(s3Bucket string) error {
+	days := operatorConfig.GetInt(ArchiveAfterDaysSetting)
+	if days <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -days)
+	class := archiveStorageClass()
+
+	sess, err := newAWSSession()
+	if err != nil {
+		return err
+	}
+	svc := s3.New(sess)
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3Bucket),
+		Prefix: aws.String(GitLabLocalBackupPrefix),
+	}
+	var archiveErr error
+	err = svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if !isBackupTarballKey(key) {
+				continue
+			}
+			if isArchiveClass(aws.StringValue(object.StorageClass)) {
+				continue
+			}
+			if aws.TimeValue(object.LastModified).After(cutoff) {
+				continue
+			}
+
+			if DryRun {
+				fmt.Printf("Dry run: would transition %v to %v\n", key, class)
+				continue
+			}
+
+			fmt.Printf("Transitioning %v to %v\n", key, class)
+			_, err := svc.CopyObject(&s3.CopyObjectInput{
+				Bucket:            aws.String(s3Bucket),
+				Key:               aws.String(key),
+				CopySource:        aws.String(s3Bucket + "/" + key),
+				StorageClass:      aws.String(class),
+				MetadataDirective: aws.String("COPY"),
+			})
+			if err != nil {
+				archiveErr = fmt.Errorf("unable to transition %v: %v", key, err)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list objects in %v: %v", s3Bucket, err)
+	}
+	return archiveErr
+}
+
+// Transitions aged backups to the archive tier once a day. Disabled
+// unless archive_after_days is set.
+func runTieringController(stop <-chan struct{}) {
+	if operatorConfig.GetInt(ArchiveAfterDaysSetting) <= 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(24 * time.Hour):
+		}
+
+		s3Bucket := operatorConfig.GetString("s3")
+		if s3Bucket == "" {
+			continue
+		}
+		err := archiveOldBackups(s3Bucket)
+		if err != nil {
+			fmt.Printf("tiering controller: %v\n", err)
+		}
+	}
+}
+
+func init() {
+	RegisterController(runTieringController)
+}
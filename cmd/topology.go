@@ -0,0 +1,110 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeploymentTopology abstracts how a GitLab installation is laid out in
+// the cluster. The original all-in-one Omnibus pod and the cloud native
+// Helm chart (separate toolbox, gitaly, and webservice pods) need
+// different pods, commands, and backup paths.
+type DeploymentTopology interface {
+	Name() string
+	// BackupTarget returns the pod and container backup commands exec in.
+	BackupTarget(namespace string) (podName, containerName string, err error)
+	// BackupCommand returns the command that writes a backup into BackupDir.
+	BackupCommand(skips []string) []string
+	// ConfigBackupCommand returns the command that archives instance
+	// configuration into BackupDir, or nil when the topology has no
+	// exec-reachable configuration to save.
+	ConfigBackupCommand() []string
+	// BackupDir is the directory in the target container where backups land.
+	BackupDir() string
+}
+
+// The single Omnibus pod layout this operator originally supported.
+type omnibusTopology struct{}
+
+func (omnibusTopology) Name() string { return "omnibus" }
+
+func (omnibusTopology) BackupTarget(namespace string) (string, string, error) {
+	podName, err := GetTargetPod(namespace)
+	return podName, GitLabContainerName, err
+}
+
+func (omnibusTopology) BackupCommand(skips []string) []string {
+	command := []string{"gitlab-rake", "gitlab:backup:create"}
+	if len(skips) > 0 {
+		command = append(command, "SKIP="+strings.Join(skips, ","))
+	}
+	return command
+}
+
+func (omnibusTopology) ConfigBackupCommand() []string {
+	return []string{"tar", "czf", GitLabRemoteEtcFile, "/etc/gitlab"}
+}
+
+func (omnibusTopology) BackupDir() string { return GitLabRemoteRakeDir }
+
+// The cloud native Helm chart layout, where backups run through
+// backup-utility in the toolbox (formerly task-runner) pod.
+type helmTopology struct{}
+
+const (
+	HelmToolboxSelector  = "app=task-runner"
+	HelmToolboxContainer = "task-runner"
+	HelmBackupDir        = "/srv/gitlab/tmp/backups"
+)
+
+func (helmTopology) Name() string { return "helm" }
+
+func (helmTopology) BackupTarget(namespace string) (string, string, error) {
+	podNames, err := GetPodsWithSelector(namespace, HelmToolboxSelector, "status.phase=Running", true)
+	if err != nil {
+		return "", "", err
+	}
+	if len(podNames) == 0 {
+		return "", "", fmt.Errorf("no ready toolbox pods matched selector %v in namespace %v", HelmToolboxSelector, namespace)
+	}
+	return podNames[0], HelmToolboxContainer, nil
+}
+
+func (helmTopology) BackupCommand(skips []string) []string {
+	command := []string{"backup-utility"}
+	for _, skip := range skips {
+		command = append(command, "--skip", skip)
+	}
+	return command
+}
+
+// The chart keeps configuration in Secrets and ConfigMaps, not files in
+// the pod, so there is nothing to archive via exec.
+func (helmTopology) ConfigBackupCommand() []string { return nil }
+
+func (helmTopology) BackupDir() string { return HelmBackupDir }
+
+// CurrentTopology returns the configured deployment topology: "omnibus"
+// (the default) or "helm", via the topology setting.
+func CurrentTopology() DeploymentTopology {
+	switch operatorConfig.GetString("topology") {
+	case "helm":
+		return helmTopology{}
+	default:
+		return omnibusTopology{}
+	}
+}
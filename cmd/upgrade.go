@@ -0,0 +1,240 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Phases reported in a GitLab resource's status.upgradePhase while an
+// upgrade is in flight.
+const (
+	UpgradePhaseBackingUp         = "BackingUp"
+	UpgradePhaseWaitingMigrations = "WaitingForMigrations"
+	UpgradePhaseUpgrading         = "Upgrading"
+	UpgradePhaseMigrating         = "Migrating"
+	UpgradePhaseComplete          = "Complete"
+	UpgradePhaseRolledBack        = "RolledBack"
+)
+
+// How long to wait for the upgraded pod to become ready, and for database
+// migrations to finish, before rolling back.
+const UpgradeDeadline = 20 * time.Minute
+
+// Polls the instance's Deployment until at least one replica is ready or
+// the deadline passes.
+func waitForGitLabReady(clientset kubernetes.Interface, namespace, name string, deadline time.Duration) error {
+	end := time.Now().Add(deadline)
+	for time.Now().Before(end) {
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{})
+		if err == nil && deployment.Status.ReadyReplicas > 0 {
+			return nil
+		}
+		time.Sleep(15 * time.Second)
+	}
+
+	return fmt.Errorf("GitLab %v/%v did not become ready within %v", namespace, name, deadline)
+}
+
+// Polls `gitlab-rake db:migrate:status` in the instance's pod until no
+// migrations report "down" or the deadline passes.
+func waitForMigrations(namespace, name string, deadline time.Duration) error {
+	end := time.Now().Add(deadline)
+	for time.Now().Before(end) {
+		podNames, err := GetPodsWithLabel(namespace, "instance", name)
+		if err == nil && len(podNames) == 1 {
+			options := ExecOptions{
+				Command:       []string{"gitlab-rake", "db:migrate:status"},
+				Namespace:     namespace,
+				PodName:       podNames[0],
+				ContainerName: GitLabContainerName,
+				CaptureStdout: true,
+				CaptureStderr: true,
+			}
+			stdout, _, err := ExecWithOutput(options)
+			if err == nil && !strings.Contains(stdout, "\n  down ") {
+				return nil
+			}
+		}
+		time.Sleep(30 * time.Second)
+	}
+
+	return fmt.Errorf("migrations for GitLab %v/%v did not complete within %v", namespace, name, deadline)
+}
+
+// Counts migrations `gitlab-rake db:migrate:status` reports as down.
+func pendingMigrations(namespace, podName string) (int, error) {
+	options := ExecOptions{
+		Command:       []string{"gitlab-rake", "db:migrate:status"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := 0
+	for _, line := range strings.Split(stdout, "\n") {
+		if strings.HasPrefix(line, "  down ") {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// Counts queued background migration jobs through the rails console.
+func backgroundMigrationsRemaining(namespace, podName string) (int, error) {
+	options := ExecOptions{
+		Command: []string{"gitlab-rails", "runner",
+			"puts Sidekiq::Queue.new('background_migration').size"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+	stdout, _, err := ExecWithOutput(options)
+	if err != nil {
+		return 0, err
+	}
+
+	remaining, err := strconv.Atoi(strings.TrimSpace(stdout))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected background migration count %q", strings.TrimSpace(stdout))
+	}
+	return remaining, nil
+}
+
+// Blocks an upgrade until the running instance has no pending schema
+// migrations and no queued background migrations left over from a previous
+// upgrade, reporting the counts in the resource's status as they drain. A
+// rollout on top of unfinished migrations is how upgrades corrupt data.
+func waitForUpgradeGate(client dynamic.ResourceInterface, obj *unstructured.Unstructured, namespace string, deadline time.Duration) error {
+	end := time.Now().Add(deadline)
+	for {
+		podName, err := GetTargetPod(namespace)
+		if err == nil {
+			pending, pendingErr := pendingMigrations(namespace, podName)
+			background, backgroundErr := backgroundMigrationsRemaining(namespace, podName)
+			if pendingErr == nil {
+				SetStatusField(client, obj, "pendingMigrations", int64(pending))
+			}
+			if backgroundErr == nil {
+				SetStatusField(client, obj, "backgroundMigrations", int64(background))
+			}
+			if pendingErr == nil && backgroundErr == nil && pending == 0 && background == 0 {
+				return nil
+			}
+			fmt.Printf("Upgrade of %v gated: %v pending migrations, %v background migrations\n",
+				obj.GetName(), pending, background)
+		}
+
+		if !time.Now().Before(end) {
+			return fmt.Errorf("migrations on GitLab %v/%v did not drain within %v; upgrade blocked",
+				namespace, obj.GetName(), deadline)
+		}
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// UpgradeGitLab moves a GitLab instance from its currently deployed version
+// to the version in its spec: pre-upgrade backup, rolling image update,
+// then wait for readiness and database migrations. If the instance does
+// not come back within UpgradeDeadline the previous image is restored.
+func UpgradeGitLab(client dynamic.ResourceInterface, obj *unstructured.Unstructured, previousVersion string) error {
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	namespace := obj.GetNamespace()
+	name := obj.GetName()
+	spec := gitLabSpecFrom(obj)
+
+	fmt.Printf("Upgrading GitLab instance %v/%v from %v to %v\n", namespace, name, previousVersion, spec.Version)
+
+	SetStatusField(client, obj, "upgradePhase", UpgradePhaseBackingUp)
+	s3Bucket := operatorConfig.GetString("s3")
+	if s3Bucket != "" {
+		err = Backup(s3Bucket, nil)
+		if err != nil {
+			return fmt.Errorf("pre-upgrade backup failed, refusing to upgrade: %v", err)
+		}
+	} else {
+		fmt.Printf("No s3 bucket configured, skipping pre-upgrade backup\n")
+	}
+
+	SetStatusField(client, obj, "upgradePhase", UpgradePhaseWaitingMigrations)
+	err = waitForUpgradeGate(client, obj, namespace, UpgradeDeadline)
+	if err != nil {
+		return err
+	}
+
+	// Quiesce the running instance so the rollout does not kill requests
+	// and jobs mid-flight. The upgrade normally replaces the pod, which
+	// comes back with everything running; the deferred unquiesce only
+	// matters when the rollout never replaced the quiesced pod.
+	if podName, targetErr := GetTargetPod(namespace); targetErr == nil {
+		quiesceErr := Quiesce(namespace, podName, "upgrade")
+		if quiesceErr != nil {
+			fmt.Printf("proceeding with upgrade despite quiesce failure: %v\n", quiesceErr)
+		}
+		defer func() {
+			if current, err := GetTargetPod(namespace); err == nil && current == podName {
+				Unquiesce(namespace, podName)
+			}
+		}()
+	}
+
+	SetStatusField(client, obj, "upgradePhase", UpgradePhaseUpgrading)
+	err = reconcileDeployment(clientset, namespace, name, spec)
+	if err != nil {
+		return err
+	}
+
+	err = waitForGitLabReady(clientset, namespace, name, UpgradeDeadline)
+	if err == nil {
+		SetStatusField(client, obj, "upgradePhase", UpgradePhaseMigrating)
+		err = waitForMigrations(namespace, name, UpgradeDeadline)
+	}
+
+	if err != nil {
+		// Roll back to the image that was running before the upgrade.
+		fmt.Printf("Upgrade of %v/%v failed, rolling back to %v: %v\n", namespace, name, previousVersion, err)
+		previous := spec
+		previous.Version = previousVersion
+		rollbackErr := reconcileDeployment(clientset, namespace, name, previous)
+		if rollbackErr != nil {
+			return fmt.Errorf("upgrade failed (%v) and rollback also failed: %v", err, rollbackErr)
+		}
+		SetStatusField(client, obj, "upgradePhase", UpgradePhaseRolledBack)
+		return err
+	}
+
+	SetStatusField(client, obj, "upgradePhase", UpgradePhaseComplete)
+	return SetStatusField(client, obj, "deployedVersion", spec.Version)
+}
@@ -19,9 +19,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -31,18 +33,48 @@ import (
 	"k8s.io/client-go/tools/remotecommand"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// The cluster client constructor used by everything in this package.
+// Production points it at the in-cluster config; tests substitute a
+// constructor returning a fake clientset.
+var newClusterClient = inClusterClient
+
 // Assumes this process is running within a pod in a k8s cluster. Returns a
 // config and clientset for the cluster.
-func GetInCluster() (*rest.Config, *kubernetes.Clientset, error) {
+func GetInCluster() (*rest.Config, kubernetes.Interface, error) {
+	return newClusterClient()
+}
+
+// inClusterClient builds the production cluster client. The config honors
+// the token_file setting (e.g. a projected, audience-bound token) and the
+// --as / --as-group impersonation flags so the operator can run with least
+// privilege and actions are attributed to a dedicated identity.
+func inClusterClient() (*rest.Config, kubernetes.Interface, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// Use a projected token instead of the default serviceaccount token
+	// when one is configured.
+	if tokenFile := operatorConfig.GetString("token_file"); tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read token file %v: %v", tokenFile, err)
+		}
+		config.BearerToken = strings.TrimSpace(string(token))
+	}
+
+	if ImpersonateUser != "" {
+		config.Impersonate = rest.ImpersonationConfig{
+			UserName: ImpersonateUser,
+			Groups:   ImpersonateGroups,
+		}
+	}
+
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, nil, err
@@ -99,53 +131,197 @@ type ExecOptions struct {
 	CaptureStderr bool
 	// If false, whitespace in std{err,out} will be removed.
 	PreserveWhitespace bool
+	// Set when the command or its output carries a secret: the log and
+	// audit trail record only the program name, and output is captured
+	// for the caller but not streamed to the log.
+	Sensitive bool
+}
+
+// The command as it may appear in the log and the audit trail.
+func (options ExecOptions) loggedCommand() []string {
+	if options.Sensitive && len(options.Command) > 0 {
+		return []string{options.Command[0], "[redacted]"}
+	}
+	return options.Command
+}
+
+// Output captured per stream by ExecWithOutput is capped at this many
+// bytes; everything past the cap is still streamed to the log but dropped
+// from the returned string. Keeps an hours-long rake backup from ballooning
+// memory while callers that inspect short command output still work.
+const ExecOutputCaptureLimit = 1 << 20
+
+// streamWriter logs command output line-by-line as it arrives, while
+// keeping a capped copy for callers that want to inspect it afterwards.
+type streamWriter struct {
+	prefix  string
+	capture bytes.Buffer
+	partial []byte
+	// Capture without logging, for output that carries a secret.
+	quiet bool
+}
+
+func (writer *streamWriter) Write(data []byte) (int, error) {
+	if remaining := ExecOutputCaptureLimit - writer.capture.Len(); remaining > 0 {
+		if len(data) <= remaining {
+			writer.capture.Write(data)
+		} else {
+			writer.capture.Write(data[:remaining])
+		}
+	}
+
+	if writer.quiet {
+		return len(data), nil
+	}
+
+	writer.partial = append(writer.partial, data...)
+	for {
+		index := bytes.IndexByte(writer.partial, '\n')
+		if index < 0 {
+			break
+		}
+		fmt.Printf("%v %s\n", writer.prefix, writer.partial[:index])
+		writer.partial = writer.partial[index+1:]
+	}
+
+	return len(data), nil
+}
+
+// Logs any trailing output that did not end in a newline.
+func (writer *streamWriter) flush() {
+	if len(writer.partial) > 0 {
+		fmt.Printf("%v %s\n", writer.prefix, writer.partial)
+		writer.partial = nil
+	}
 }
 
-// ExecWithOptions executes a command in the specified container,
-// returning stdout, stderr and error. `options` allowed for
+// ExecWithOptions executes a command in the specified container. Its output
+// is streamed to the log as the command runs. `options` allowed for
 // additional parameters to be passed.
 func ExecWithOptions(options ExecOptions) error {
-	var stdout, stderr bytes.Buffer
+	_, _, err := ExecWithOutput(options)
+	fmt.Printf("Finished running %v\n", options.loggedCommand())
+	return err
+}
+
+// ExecWithOutput executes a command in the specified container, streaming
+// stdout and stderr to the log line-by-line as the command runs, and
+// returning stdout, stderr (capped at ExecOutputCaptureLimit each) and
+// error for callers that need to inspect the output.
+func ExecWithOutput(options ExecOptions) (string, string, error) {
+	if DryRun {
+		fmt.Printf("Dry run: would run %v in pod %v/%v container %v\n",
+			options.loggedCommand(), options.Namespace, options.PodName, options.ContainerName)
+		return "", "", nil
+	}
+
+	fmt.Printf("Running %v\n", options.loggedCommand())
+
+	stdout := &streamWriter{prefix: options.PodName + ":", quiet: options.Sensitive}
+	stderr := &streamWriter{prefix: options.PodName + " (stderr):", quiet: options.Sensitive}
+	start := time.Now()
+	err := podExecutor.Execute(options.Namespace, options.PodName, options.ContainerName,
+		options.Command, options.Stdin, stdout, stderr)
+	auditExec(options.Namespace, options.PodName, options.ContainerName, options.loggedCommand(), start, err)
+	stdout.flush()
+	stderr.flush()
+
+	return stdout.capture.String(), stderr.capture.String(), err
+}
+
+// PodExecResult holds the outcome of running a command on one pod during
+// an ExecOnPods fan-out.
+type PodExecResult struct {
+	PodName string
+	Stdout  string
+	Stderr  string
+	Err     error
+}
+
+// How many pods ExecOnPods runs the command on at once.
+const ExecOnPodsParallelism = 4
+
+// ExecOnPods runs the same command on every pod matching the label,
+// ExecOnPodsParallelism pods at a time, and returns the per-pod results
+// ordered by pod name. Used to fan a command out across a scaled
+// component, e.g. flushing caches on all Sidekiq pods before a restore.
+func ExecOnPods(namespace, labelKey, labelValue, containerName string, command []string) ([]PodExecResult, error) {
+	podNames, err := GetPodsWithLabel(namespace, labelKey, labelValue)
+	if err != nil {
+		return nil, err
+	}
+	if len(podNames) == 0 {
+		return nil, fmt.Errorf("no pods with label %v=%v found in namespace %v", labelKey, labelValue, namespace)
+	}
+	sort.Strings(podNames)
+
+	results := make([]PodExecResult, len(podNames))
+	semaphore := make(chan struct{}, ExecOnPodsParallelism)
+	var wg sync.WaitGroup
+	for index, podName := range podNames {
+		wg.Add(1)
+		go func(index int, podName string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			stdout, stderr, err := ExecWithOutput(ExecOptions{
+				Command:       command,
+				Namespace:     namespace,
+				PodName:       podName,
+				ContainerName: containerName,
+				CaptureStdout: true,
+				CaptureStderr: true,
+			})
+			results[index] = PodExecResult{PodName: podName, Stdout: stdout, Stderr: stderr, Err: err}
+		}(index, podName)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Err != nil {
+			return results, fmt.Errorf("unable to run %v on pod %v: %v", command, result.PodName, result.Err)
+		}
+	}
+
+	return results, nil
+}
+
+// PodExecutor runs a command inside a container, wiring the given streams
+// to it. The production implementation drives the pod exec subresource
+// over SPDY; tests substitute a fake that scripts command output.
+type PodExecutor interface {
+	Execute(namespace, podName, containerName string, command []string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// The executor used by the exec and copy helpers; tests substitute a fake.
+var podExecutor PodExecutor = spdyPodExecutor{}
 
-	fmt.Printf("Running %v\n", options.Command)
+// spdyPodExecutor is the production PodExecutor.
+type spdyPodExecutor struct{}
 
+func (spdyPodExecutor) Execute(namespace, podName, containerName string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
 	config, clientset, err := GetInCluster()
 	if err != nil {
 		return err
 	}
-	const tty = false
 
-	req := clientset.Core().RESTClient().Post().
+	req := clientset.CoreV1().RESTClient().Post().
 		Resource("pods").
-		Name(options.PodName).
-		Namespace(options.Namespace).
+		Name(podName).
+		Namespace(namespace).
 		SubResource("exec").
-		Param("container", options.ContainerName)
+		Param("container", containerName)
 	req.VersionedParams(&v1.PodExecOptions{
-		Container: options.ContainerName,
-		Command:   options.Command,
-		Stdin:     options.Stdin != nil,
-		Stdout:    options.CaptureStdout,
-		Stderr:    options.CaptureStderr,
-		TTY:       tty,
+		Container: containerName,
+		Command:   command,
+		Stdin:     stdin != nil,
+		Stdout:    stdout != nil,
+		Stderr:    stderr != nil,
+		TTY:       false,
 	}, scheme.ParameterCodec)
 
-	err = execute("POST", req.URL(), config, options.Stdin, &stdout, &stderr, tty)
-
-	if options.PreserveWhitespace {
-		fmt.Printf("%v\n%v\n", stdout.String(), stderr.String())
-		return err
-
-	}
-
-	fmt.Printf("%v\n%v\n", strings.TrimSpace(stdout.String()), strings.TrimSpace(stderr.String()))
-	fmt.Printf("Finished running %v\n", options.Command)
-
-	return err
-}
-
-func execute(method string, url *url.URL, config *rest.Config, stdin io.Reader, stdout, stderr io.Writer, tty bool) error {
-	exec, err := remotecommand.NewSPDYExecutor(config, method, url)
+	exec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
 	if err != nil {
 		return err
 	}
@@ -153,7 +329,7 @@ func execute(method string, url *url.URL, config *rest.Config, stdin io.Reader,
 		Stdin:  stdin,
 		Stdout: stdout,
 		Stderr: stderr,
-		Tty:    tty,
+		Tty:    false,
 	})
 }
 
@@ -164,7 +340,12 @@ type fileSpec struct {
 }
 
 func CopyFromPod(src, dest fileSpec) error {
-	config, clientset, err := GetInCluster()
+	if DryRun {
+		fmt.Printf("Dry run: would copy %v/%v:%v to %v\n", src.PodNamespace, src.PodName, src.File, dest.File)
+		return nil
+	}
+
+	_, clientset, err := GetInCluster()
 	if err != nil {
 		return err
 	}
@@ -178,35 +359,83 @@ func CopyFromPod(src, dest fileSpec) error {
 	}
 	containerName := pod.Spec.Containers[0].Name
 
+	// Distroless images have no tar; stream through a helper pod that
+	// mounts the same volumes instead.
+	if !hasTar(src.PodNamespace, src.PodName, containerName) {
+		return copyViaDebugPod(src, dest)
+	}
+
 	reader, writer := io.Pipe()
-	// TODO: Improve error messages by first testing if 'tar' is present in the container?
-	command := []string{"tar", "cf", "-", src.File}
+	command := buildTarCreateCommand(src.File)
 
 	go func() {
 		defer writer.Close()
-
-		req := clientset.RESTClient().Post().
-			Resource("pods").
-			Name(src.PodName).
-			Namespace(src.PodNamespace).
-			SubResource("exec").
-			Param("container", containerName)
-		req.VersionedParams(&v1.PodExecOptions{
-			Container: containerName,
-			Command:   command,
-			Stdin:     false,
-			Stdout:    true,
-			Stderr:    true,
-			TTY:       false,
-		}, scheme.ParameterCodec)
-
-		_ = execute("POST", req.URL(), config, nil, writer, bytes.NewBuffer([]byte{}), false)
+		start := time.Now()
+		err := podExecutor.Execute(src.PodNamespace, src.PodName, containerName,
+			command, nil, writer, bytes.NewBuffer([]byte{}))
+		auditExec(src.PodNamespace, src.PodName, containerName, command, start, err)
 		return
 	}()
 
 	return createFileFromStream(reader, dest.File)
 }
 
+// CopyToPod streams a local tarball into `tar xf -` running in the first
+// container of the destination pod, unpacking it at dest.File. This is the
+// inverse of CopyFromPod and is used to push restore artifacts back into
+// the GitLab container.
+func CopyToPod(src string, dest fileSpec) error {
+	if DryRun {
+		fmt.Printf("Dry run: would copy %v to %v/%v:%v\n", src, dest.PodNamespace, dest.PodName, dest.File)
+		return nil
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	pod, err := clientset.Core().Pods(dest.PodNamespace).Get(dest.PodName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return fmt.Errorf("cannot exec into a container in a completed pod; current phase is %s", pod.Status.Phase)
+	}
+	containerName := pod.Spec.Containers[0].Name
+
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var total int64
+	if info, err := file.Stat(); err == nil {
+		total = info.Size()
+	}
+
+	fmt.Printf("Copying %v to %v/%v:%v\n", src, dest.PodNamespace, dest.PodName, dest.File)
+
+	command := []string{"tar", "-x", "-f", "-"}
+	command = append(command, CurrentCompression().TarExtractArgs()...)
+	command = append(command, tarOwnershipArgs()...)
+	command = append(command, "-C", dest.File)
+
+	var stdout, stderr bytes.Buffer
+	tracker := NewProgressTracker("copy "+src, total)
+	defer tracker.Done()
+	start := time.Now()
+	err = podExecutor.Execute(dest.PodNamespace, dest.PodName, containerName,
+		command, tracker.WrapReader(file), &stdout, &stderr)
+	auditExec(dest.PodNamespace, dest.PodName, containerName, command, start, err)
+	if err != nil {
+		return fmt.Errorf("failed to copy %v to pod %v: %v\n%v", src, dest.PodName, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
 func createFileFromStream(reader io.Reader, destFilename string) error {
 	file, err := os.OpenFile(destFilename, os.O_RDWR|os.O_CREATE, 0700)
 	if err != nil {
@@ -214,7 +443,10 @@ func createFileFromStream(reader io.Reader, destFilename string) error {
 	}
 	defer file.Close()
 
-	_, err = io.Copy(file, reader)
+	tracker := NewProgressTracker("copy to "+destFilename, 0)
+	defer tracker.Done()
+
+	_, err = io.Copy(tracker.WrapWriter(file), reader)
 	if err != nil {
 		return err
 	}
@@ -222,11 +454,41 @@ func createFileFromStream(reader io.Reader, destFilename string) error {
 	return nil
 }
 
+// ObjectStore abstracts the bucket operations the backup pipeline needs,
+// so tests can run against an in-memory implementation instead of S3.
+type ObjectStore interface {
+	Upload(bucket, key, filename string) error
+	Download(bucket, key, filename string) error
+	Delete(bucket, key string) error
+	List(bucket, prefix string) ([]string, error)
+}
+
+// The store used by the upload and download helpers; tests substitute an
+// in-memory fake.
+var objectStore ObjectStore = s3ObjectStore{}
+
+// s3ObjectStore is the production ObjectStore, backed by the AWS SDK.
+type s3ObjectStore struct{}
+
 func UploadToS3(s3Bucket, filename string) error {
-	fmt.Printf("Uploading %v to %v\n", filename, s3Bucket)
+	return UploadFileToS3(s3Bucket, filename, filename)
+}
+
+// UploadFileToS3 uploads a local file to the bucket under an explicit key.
+func UploadFileToS3(s3Bucket, key, filename string) error {
+	if DryRun {
+		fmt.Printf("Dry run: would upload %v to %v/%v\n", filename, s3Bucket, key)
+		return nil
+	}
+
+	fmt.Printf("Uploading %v to %v/%v\n", filename, s3Bucket, key)
+
+	return activeObjectStore().Upload(s3Bucket, key, filename)
+}
 
+func (s3ObjectStore) Upload(s3Bucket, key, filename string) error {
 	// The session the S3 Uploader will use
-	sess, err := session.NewSession()
+	sess, err := newAWSSession()
 	if err != nil {
 		return err
 	}
@@ -239,12 +501,26 @@ func UploadToS3(s3Bucket, filename string) error {
 		return fmt.Errorf("failed to open file %q, %v", filename, err)
 	}
 
+	var total int64
+	if info, err := f.Stat(); err == nil {
+		total = info.Size()
+	}
+	tracker := NewProgressTracker("upload "+key, total)
+	defer tracker.Done()
+
 	// Upload the file to S3.
-	result, err := uploader.Upload(&s3manager.UploadInput{
+	input := &s3manager.UploadInput{
 		Bucket: aws.String(s3Bucket),
-		Key:    aws.String(filename),
-		Body:   f,
-	})
+		Key:    aws.String(key),
+		Body:   throttledReader(tracker.WrapReader(f)),
+	}
+	if class := operatorConfig.GetString(UploadStorageClassSetting); class != "" {
+		input.StorageClass = aws.String(class)
+	}
+	if tagging := objectTagging(); tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+	result, err := uploader.Upload(input)
 	if err != nil {
 		return fmt.Errorf("failed to upload file, %v", err)
 	}
@@ -253,3 +529,103 @@ func UploadToS3(s3Bucket, filename string) error {
 
 	return nil
 }
+
+func DownloadFromS3(s3Bucket, key, filename string) error {
+	fmt.Printf("Downloading %v from %v to %v\n", key, s3Bucket, filename)
+
+	return activeObjectStore().Download(s3Bucket, key, filename)
+}
+
+func (s3ObjectStore) Download(s3Bucket, key, filename string) error {
+	// Archived objects must be thawed before they can be read.
+	err := EnsureObjectRestorable(s3Bucket, key)
+	if err != nil {
+		return err
+	}
+
+	sess, err := newAWSSession()
+	if err != nil {
+		return err
+	}
+
+	downloader := s3manager.NewDownloader(sess)
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create file %q, %v", filename, err)
+	}
+	defer f.Close()
+
+	n, err := downloader.Download(f, &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %v, %v", key, err)
+	}
+
+	fmt.Printf("Finished downloading %v bytes\n", n)
+
+	return nil
+}
+
+// DeleteS3Object removes one object from the bucket. Used to clean up
+// partial uploads after a failed or canceled backup.
+func DeleteS3Object(s3Bucket, key string) error {
+	if DryRun {
+		fmt.Printf("Dry run: would delete %v/%v\n", s3Bucket, key)
+		return nil
+	}
+
+	return activeObjectStore().Delete(s3Bucket, key)
+}
+
+func (s3ObjectStore) Delete(s3Bucket, key string) error {
+	sess, err := newAWSSession()
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.New(sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete %v from %v: %v", key, s3Bucket, err)
+	}
+
+	return nil
+}
+
+// Returns the keys in the bucket matching the prefix, in lexical order.
+// Backup keys embed an RFC3339 timestamp so lexical order is also
+// chronological order.
+func ListS3Objects(s3Bucket, prefix string) ([]string, error) {
+	return activeObjectStore().List(s3Bucket, prefix)
+}
+
+func (s3ObjectStore) List(s3Bucket, prefix string) ([]string, error) {
+	sess, err := newAWSSession()
+	if err != nil {
+		return nil, err
+	}
+
+	svc := s3.New(sess)
+
+	var keys []string
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3Bucket),
+		Prefix: aws.String(prefix),
+	}
+	err = svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list objects in %v: %v", s3Bucket, err)
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,304 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func labeledPod(namespace, name string, labels map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    labels,
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "gitlab"}},
+		},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+func TestGetPodsWithLabel(t *testing.T) {
+	_, restore := useFakeCluster(
+		labeledPod("default", "gitlab-0", map[string]string{"app": "gitlab"}),
+		labeledPod("default", "gitlab-1", map[string]string{"app": "gitlab"}),
+		labeledPod("default", "runner-0", map[string]string{"app": "runner"}),
+	)
+	defer restore()
+
+	podNames, err := GetPodsWithLabel("default", "app", "gitlab")
+	if err != nil {
+		t.Fatalf("GetPodsWithLabel: %v", err)
+	}
+
+	expected := []string{"gitlab-0", "gitlab-1"}
+	if !reflect.DeepEqual(podNames, expected) {
+		t.Errorf("got pods %v, expected %v", podNames, expected)
+	}
+}
+
+func TestExecWithOutput(t *testing.T) {
+	executor := &fakePodExecutor{
+		stdout: map[string]string{"gitlab-rake": "12.9.0\n"},
+	}
+	defer usePodExecutor(executor)()
+
+	stdout, _, err := ExecWithOutput(ExecOptions{
+		Command:       []string{"gitlab-rake", "gitlab:env:info"},
+		Namespace:     "default",
+		PodName:       "gitlab-0",
+		ContainerName: "gitlab",
+		CaptureStdout: true,
+		CaptureStderr: true,
+	})
+	if err != nil {
+		t.Fatalf("ExecWithOutput: %v", err)
+	}
+	if stdout != "12.9.0\n" {
+		t.Errorf("got stdout %q, expected %q", stdout, "12.9.0\n")
+	}
+
+	if len(executor.executions) != 1 {
+		t.Fatalf("got %v executions, expected 1", len(executor.executions))
+	}
+	execution := executor.executions[0]
+	if execution.Namespace != "default" || execution.PodName != "gitlab-0" || execution.ContainerName != "gitlab" {
+		t.Errorf("command ran against %v/%v container %v, expected default/gitlab-0 container gitlab",
+			execution.Namespace, execution.PodName, execution.ContainerName)
+	}
+	if !reflect.DeepEqual(execution.Command, []string{"gitlab-rake", "gitlab:env:info"}) {
+		t.Errorf("got command %v", execution.Command)
+	}
+}
+
+func TestExecOnPods(t *testing.T) {
+	_, restoreCluster := useFakeCluster(
+		labeledPod("default", "sidekiq-1", map[string]string{"app": "sidekiq"}),
+		labeledPod("default", "sidekiq-0", map[string]string{"app": "sidekiq"}),
+		labeledPod("default", "gitlab-0", map[string]string{"app": "gitlab"}),
+	)
+	defer restoreCluster()
+
+	executor := &fakePodExecutor{
+		stdout: map[string]string{"flush": "OK\n"},
+	}
+	defer usePodExecutor(executor)()
+
+	results, err := ExecOnPods("default", "app", "sidekiq", "gitlab",
+		[]string{"gitlab-rails", "runner", "flush"})
+	if err != nil {
+		t.Fatalf("ExecOnPods: %v", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("got %v results, expected 2", len(results))
+	}
+	for index, podName := range []string{"sidekiq-0", "sidekiq-1"} {
+		if results[index].PodName != podName {
+			t.Errorf("result %v is for pod %v, expected %v", index, results[index].PodName, podName)
+		}
+		if results[index].Stdout != "OK\n" {
+			t.Errorf("pod %v stdout %q, expected %q", podName, results[index].Stdout, "OK\n")
+		}
+	}
+
+	_, err = ExecOnPods("default", "app", "unicorn", "gitlab", []string{"true"})
+	if err == nil {
+		t.Error("expected an error when no pods match the selector")
+	}
+}
+
+func TestStreamWriterCapsCapture(t *testing.T) {
+	writer := &streamWriter{prefix: "pod:"}
+
+	data := bytes.Repeat([]byte("x"), ExecOutputCaptureLimit+100)
+	n, err := writer.Write(data)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n != len(data) {
+		t.Errorf("Write consumed %v bytes, expected %v", n, len(data))
+	}
+	if writer.capture.Len() != ExecOutputCaptureLimit {
+		t.Errorf("captured %v bytes, expected cap of %v", writer.capture.Len(), ExecOutputCaptureLimit)
+	}
+}
+
+func TestObjectStoreRoundTrip(t *testing.T) {
+	defer useObjectStore(newMemoryObjectStore())()
+
+	directory, err := ioutil.TempDir("", "gitlab-operator-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	source := filepath.Join(directory, "backup.tar.gz")
+	content := []byte("not really a tarball")
+	err = ioutil.WriteFile(source, content, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	err = UploadFileToS3("backups", "gitlab-backup-2020.tar.gz", source)
+	if err != nil {
+		t.Fatalf("UploadFileToS3: %v", err)
+	}
+
+	keys, err := ListS3Objects("backups", GitLabLocalBackupPrefix)
+	if err != nil {
+		t.Fatalf("ListS3Objects: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"gitlab-backup-2020.tar.gz"}) {
+		t.Errorf("got keys %v", keys)
+	}
+
+	destination := filepath.Join(directory, "restored.tar.gz")
+	err = DownloadFromS3("backups", "gitlab-backup-2020.tar.gz", destination)
+	if err != nil {
+		t.Fatalf("DownloadFromS3: %v", err)
+	}
+	restored, err := ioutil.ReadFile(destination)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(restored, content) {
+		t.Errorf("downloaded content %q, expected %q", restored, content)
+	}
+
+	err = DeleteS3Object("backups", "gitlab-backup-2020.tar.gz")
+	if err != nil {
+		t.Fatalf("DeleteS3Object: %v", err)
+	}
+	keys, err = ListS3Objects("backups", GitLabLocalBackupPrefix)
+	if err != nil {
+		t.Fatalf("ListS3Objects: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got keys %v after delete, expected none", keys)
+	}
+}
+
+func TestResolveBackupKey(t *testing.T) {
+	store := newMemoryObjectStore()
+	store.put("backups", GitLabLocalBackupPrefix+"2020-01-01T00:00:00Z.tar.gz", nil)
+	store.put("backups", GitLabLocalBackupPrefix+"2020-02-01T00:00:00Z.tar.gz", nil)
+	store.put("backups", GitLabLocalBackupPrefix+"2020-03-01T00:00:00Z.tar.gz", nil)
+	defer useObjectStore(store)()
+
+	key, err := resolveBackupKey("backups", "latest")
+	if err != nil {
+		t.Fatalf("resolveBackupKey: %v", err)
+	}
+	if key != GitLabLocalBackupPrefix+"2020-03-01T00:00:00Z.tar.gz" {
+		t.Errorf("latest resolved to %v", key)
+	}
+
+	key, err = resolveBackupKey("backups", "2020-02-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("resolveBackupKey: %v", err)
+	}
+	if key != GitLabLocalBackupPrefix+"2020-02-01T00:00:00Z"+CurrentCompression().Extension {
+		t.Errorf("explicit timestamp resolved to %v", key)
+	}
+
+	_, err = resolveBackupKey("empty", "latest")
+	if err == nil {
+		t.Error("expected an error resolving latest in an empty bucket")
+	}
+}
+
+func TestBuildTarCreateCommand(t *testing.T) {
+	defer func() {
+		operatorConfig.Set(CopyExcludeSetting, "")
+		operatorConfig.Set(CopyOneFileSystemSetting, false)
+		operatorConfig.Set(CopyPipeCompressionSetting, false)
+		operatorConfig.Set("compression", "")
+	}()
+
+	operatorConfig.Set("compression", "none")
+	operatorConfig.Set(CopyExcludeSetting, "*/tmp/*, */cache/*")
+	operatorConfig.Set(CopyOneFileSystemSetting, true)
+
+	command := buildTarCreateCommand("/var/opt/gitlab")
+	expected := []string{"tar", "-c", "-f", "-",
+		"--exclude=*/tmp/*", "--exclude=*/cache/*", "--one-file-system", "/var/opt/gitlab"}
+	if !reflect.DeepEqual(command, expected) {
+		t.Errorf("got command %v, expected %v", command, expected)
+	}
+
+	operatorConfig.Set("compression", "gzip")
+	operatorConfig.Set(CopyPipeCompressionSetting, true)
+	command = buildTarCreateCommand("/var/opt/gitlab")
+	if len(command) != 3 || command[0] != "sh" || command[1] != "-c" {
+		t.Fatalf("got command %v, expected a sh -c pipeline", command)
+	}
+	if !strings.Contains(command[2], "| gzip") {
+		t.Errorf("pipeline %q does not pipe through gzip", command[2])
+	}
+	if !strings.Contains(command[2], "--one-file-system") {
+		t.Errorf("pipeline %q lost the tar flags", command[2])
+	}
+}
+
+func TestCopyToPod(t *testing.T) {
+	_, restoreCluster := useFakeCluster(
+		labeledPod("default", "gitlab-0", map[string]string{"app": "gitlab"}),
+	)
+	defer restoreCluster()
+
+	executor := &fakePodExecutor{}
+	defer usePodExecutor(executor)()
+
+	source, err := ioutil.TempFile("", "gitlab-operator-test")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(source.Name())
+	source.WriteString("tarball bytes")
+	source.Close()
+
+	err = CopyToPod(source.Name(), fileSpec{
+		PodNamespace: "default",
+		PodName:      "gitlab-0",
+		File:         "/var/opt/gitlab/backups",
+	})
+	if err != nil {
+		t.Fatalf("CopyToPod: %v", err)
+	}
+
+	if len(executor.executions) != 1 {
+		t.Fatalf("got %v executions, expected 1", len(executor.executions))
+	}
+	execution := executor.executions[0]
+	if execution.ContainerName != "gitlab" {
+		t.Errorf("copy ran in container %v, expected gitlab", execution.ContainerName)
+	}
+	command := strings.Join(execution.Command, " ")
+	if !strings.HasPrefix(command, "tar -x -f -") || !strings.Contains(command, "-C /var/opt/gitlab/backups") {
+		t.Errorf("got command %q", command)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// How long to wait for the throwaway GitLab pod to come up before calling
+// the verification failed.
+const VerifyPodDeadline = 30 * time.Minute
+
+// Polls the named pod until all its containers are ready or the deadline
+// passes.
+func waitForPodReady(clientset kubernetes.Interface, namespace, name string, deadline time.Duration) error {
+	end := time.Now().Add(deadline)
+	for time.Now().Before(end) {
+		pod, err := clientset.Core().Pods(namespace).Get(name, metav1.GetOptions{})
+		if err == nil {
+			for _, condition := range pod.Status.Conditions {
+				if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+					return nil
+				}
+			}
+		}
+		time.Sleep(15 * time.Second)
+	}
+
+	return fmt.Errorf("pod %v/%v did not become ready within %v", namespace, name, deadline)
+}
+
+// VerifyBackup restores a backup into a temporary GitLab pod, runs
+// gitlab-rake gitlab:check against it, and tears the pod down. A passing
+// check proves the backup is actually restorable, not just uploaded.
+func VerifyBackup(s3Bucket, timestamp string) error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+
+	backupKey, err := resolveBackupKey(s3Bucket, timestamp)
+	if err != nil {
+		return err
+	}
+
+	podName := fmt.Sprintf("gitlab-verify-%v", time.Now().Unix())
+	if DryRun {
+		fmt.Printf("Dry run: would verify backup %v in throwaway pod %v\n", backupKey, podName)
+		return nil
+	}
+	fmt.Printf("Verifying backup %v in throwaway pod %v\n", backupKey, podName)
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   podName,
+			Labels: map[string]string{"verify": "gitlab-backup"},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers: []v1.Container{{
+				Name:  GitLabContainerName,
+				Image: "gitlab/gitlab-ce:latest",
+			}},
+		},
+	}
+	_, err = clientset.Core().Pods(namespace).Create(pod)
+	if err != nil {
+		return fmt.Errorf("unable to create verification pod: %v", err)
+	}
+
+	// Always tear the throwaway pod down, pass or fail.
+	defer func() {
+		fmt.Printf("Removing verification pod %v\n", podName)
+		err := clientset.Core().Pods(namespace).Delete(podName, &metav1.DeleteOptions{})
+		if err != nil {
+			fmt.Printf("unable to remove verification pod %v: %v\n", podName, err)
+		}
+	}()
+
+	err = waitForPodReady(clientset, namespace, podName, VerifyPodDeadline)
+	if err != nil {
+		return err
+	}
+
+	localFilename := backupKey
+	err = DownloadFromS3(s3Bucket, backupKey, localFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFilename)
+
+	dest := fileSpec{
+		PodNamespace: namespace,
+		PodName:      podName,
+		File:         "/",
+	}
+	err = CopyToPod(localFilename, dest)
+	if err != nil {
+		return err
+	}
+
+	options := ExecOptions{
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+
+	options.Command = []string{"gitlab-rake", "gitlab:backup:restore", "force=yes"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("restore into verification pod failed: %v", err)
+	}
+
+	options.Command = []string{"gitlab-rake", "gitlab:check", "SANITIZE=true"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("gitlab:check failed on restored backup: %v", err)
+	}
+
+	fmt.Printf("Backup %v verified successfully\n", backupKey)
+	return nil
+}
+
+// verifyBackupCmd represents the verify-backup command
+var verifyBackupCmd = &cobra.Command{
+	Use:          "verify-backup [-s bucket] [-t timestamp]",
+	Short:        "Verifies that a backup is restorable",
+	SilenceUsage: true,
+	Long: `Restores a backup into a temporary GitLab pod, runs gitlab-rake
+gitlab:check against the result, and tears the pod down. Use this to prove
+backups are actually restorable, not just present in the bucket.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		s3 := operatorConfig.GetString("s3")
+		err := VerifyBackup(s3, RestoreTimestamp)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyBackupCmd)
+
+	verifyBackupCmd.Flags().StringVarP(
+		&RestoreTimestamp,
+		"timestamp",
+		"t",
+		"latest",
+		"timestamp of the backup to verify, or \"latest\"")
+}
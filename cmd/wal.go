@@ -0,0 +1,443 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// WAL archiving for the bundled PostgreSQL. A rake backup bounds data
+// loss by its schedule; shipping completed WAL segments to the bucket
+// every wal_archive_interval bounds it by minutes instead, and together
+// with periodic base backups enables point-in-time recovery. Disabled
+// unless wal_archive_interval is set.
+const (
+	WALArchiveIntervalSetting = "wal_archive_interval"
+	BaseBackupIntervalSetting = "base_backup_interval"
+	DefaultBaseBackupInterval = 24 * time.Hour
+
+	// WAL segments and base backups live under their own prefixes so they
+	// never pollute the rake tarball key space "latest" resolves over.
+	WALArchivePrefix = "gitlab-wal/"
+	BaseBackupPrefix = "gitlab-basebackup-"
+
+	// The bundled (omnibus) PostgreSQL data directory.
+	PostgresDataDir = "/var/opt/gitlab/postgresql/data"
+)
+
+// Runs a query against the bundled PostgreSQL and returns its trimmed
+// output.
+func gitlabPSQL(namespace, podName, query string) (string, error) {
+	stdout, _, err := ExecWithOutput(ExecOptions{
+		Command:       []string{"gitlab-psql", "-t", "-A", "-c", query},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	})
+	return strings.TrimSpace(stdout), err
+}
+
+// Reports whether a filename looks like a completed WAL segment (24 hex
+// characters, e.g. 000000010000000000000042).
+func isWALSegmentName(name string) bool {
+	if len(name) != 24 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Lists the WAL segments currently in the pod's pg_xlog directory, in
+// order.
+func listWALSegments(namespace, podName string) ([]string, error) {
+	stdout, _, err := ExecWithOutput(ExecOptions{
+		Command:       []string{"ls", "-1", PostgresDataDir + "/pg_xlog"},
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list WAL segments: %v", err)
+	}
+
+	var segments []string
+	for _, name := range strings.Fields(stdout) {
+		if isWALSegmentName(name) {
+			segments = append(segments, name)
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// Key of the archived copy of a WAL segment. Segments are shipped as the
+// compressed tar stream CopyFromPod produces.
+func walSegmentKey(name string) string {
+	return WALArchivePrefix + name + CurrentCompression().Extension
+}
+
+// ArchiveWAL closes the current WAL segment and ships every completed
+// segment not yet in the bucket. Safe to run as often as wanted; already
+// shipped segments are skipped.
+func ArchiveWAL(s3Bucket string) error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	// Close the segment being written so it becomes shippable.
+	_, err = gitlabPSQL(namespace, podName, "SELECT pg_switch_xlog()")
+	if err != nil {
+		return fmt.Errorf("unable to switch WAL segment: %v", err)
+	}
+
+	segments, err := listWALSegments(namespace, podName)
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		// The highest-named segment is the one now being written.
+		segments = segments[:len(segments)-1]
+	}
+
+	shippedKeys, err := ListS3Objects(s3Bucket, WALArchivePrefix)
+	if err != nil {
+		return err
+	}
+	shipped := map[string]bool{}
+	for _, key := range shippedKeys {
+		shipped[key] = true
+	}
+
+	var archived int
+	for _, segment := range segments {
+		key := walSegmentKey(segment)
+		if shipped[key] {
+			continue
+		}
+
+		localFilename := "wal-segment.tmp"
+		err = CopyFromPod(
+			fileSpec{PodNamespace: namespace, PodName: podName, File: PostgresDataDir + "/pg_xlog/" + segment},
+			fileSpec{File: localFilename})
+		if err != nil {
+			return fmt.Errorf("unable to copy WAL segment %v: %v", segment, err)
+		}
+
+		err = UploadFileToS3(s3Bucket, key, localFilename)
+		os.Remove(localFilename)
+		if err != nil {
+			return err
+		}
+		archived++
+	}
+
+	if archived > 0 {
+		fmt.Printf("Archived %v WAL segments to %v\n", archived, s3Bucket)
+	}
+	RecordStatus(map[string]string{
+		"lastWALArchiveTimestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+
+	return nil
+}
+
+// BaseBackup takes a physical base backup of the bundled PostgreSQL data
+// directory and uploads it. Together with the archived WAL it is the
+// starting point for point-in-time recovery.
+func BaseBackup(s3Bucket string) error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Begining base backup of %v/%v\n", namespace, podName)
+
+	_, err = gitlabPSQL(namespace, podName, "SELECT pg_start_backup('gitlab-operator', true)")
+	if err != nil {
+		return fmt.Errorf("unable to start base backup: %v", err)
+	}
+	// Always take PostgreSQL out of backup mode, even when the copy fails.
+	defer gitlabPSQL(namespace, podName, "SELECT pg_stop_backup()")
+
+	key := BaseBackupPrefix + time.Now().UTC().Format(time.RFC3339) + CurrentCompression().Extension
+	localPath := stagingPath(key)
+	err = CopyFromPod(
+		fileSpec{PodNamespace: namespace, PodName: podName, File: PostgresDataDir},
+		fileSpec{File: localPath})
+	if err != nil {
+		return fmt.Errorf("unable to copy data directory: %v", err)
+	}
+	defer os.Remove(localPath)
+
+	err = UploadFileToS3(s3Bucket, key, localPath)
+	if err != nil {
+		return err
+	}
+
+	RecordStatus(map[string]string{
+		"lastBaseBackupTimestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	fmt.Printf("Finished base backup of %v/%v\n", namespace, podName)
+
+	return nil
+}
+
+// Picks the newest base backup taken at or before the recovery target
+// time. RFC3339 keys compare lexically in chronological order.
+func baseBackupForTarget(s3Bucket, targetTime string) (string, error) {
+	keys, err := ListS3Objects(s3Bucket, BaseBackupPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	var candidate string
+	for _, key := range keys {
+		timestamp := strings.TrimPrefix(key, BaseBackupPrefix)
+		if index := strings.Index(timestamp, ".tar"); index >= 0 {
+			timestamp = timestamp[:index]
+		}
+		if timestamp <= targetTime {
+			candidate = key
+		}
+	}
+	if candidate == "" {
+		return "", fmt.Errorf("no base backup at or before %v found in %v", targetTime, s3Bucket)
+	}
+	return candidate, nil
+}
+
+// RestorePointInTime rolls the bundled PostgreSQL back to targetTime
+// (RFC3339): the newest base backup before the target is restored and the
+// archived WAL is replayed up to the target.
+func RestorePointInTime(s3Bucket, targetTime string) error {
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+	podName, err := GetTargetPod(namespace)
+	if err != nil {
+		return err
+	}
+
+	baseKey, err := baseBackupForTarget(s3Bucket, targetTime)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Begining point-in-time recovery of %v/%v to %v from %v\n", namespace, podName, targetTime, baseKey)
+
+	options := ExecOptions{
+		Namespace:     namespace,
+		PodName:       podName,
+		ContainerName: GitLabContainerName,
+		CaptureStdout: true,
+		CaptureStderr: true,
+	}
+
+	options.Command = []string{"gitlab-ctl", "stop", "postgresql"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("unable to stop postgresql: %v", err)
+	}
+
+	// Move the live data directory aside rather than deleting it, so a
+	// failed recovery can be backed out by hand.
+	options.Command = []string{"sh", "-c",
+		fmt.Sprintf("rm -rf %v.pitr-old && mv %v %v.pitr-old", PostgresDataDir, PostgresDataDir, PostgresDataDir)}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("unable to move data directory aside: %v", err)
+	}
+
+	// The base backup tarball was created from PostgresDataDir with
+	// leading slashes stripped, so extracting at / restores it in place.
+	err = DownloadFromS3(s3Bucket, baseKey, baseKey)
+	if err != nil {
+		return err
+	}
+	err = CopyToPod(baseKey, fileSpec{PodNamespace: namespace, PodName: podName, File: "/"})
+	os.Remove(baseKey)
+	if err != nil {
+		return fmt.Errorf("unable to restore base backup: %v", err)
+	}
+
+	// Stage the archived WAL back into pg_xlog; recovery falls back to
+	// pg_xlog for segments the restore_command cannot produce.
+	shippedKeys, err := ListS3Objects(s3Bucket, WALArchivePrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range shippedKeys {
+		localFilename := "wal-segment.tmp"
+		err = DownloadFromS3(s3Bucket, key, localFilename)
+		if err != nil {
+			return err
+		}
+		err = CopyToPod(localFilename, fileSpec{PodNamespace: namespace, PodName: podName, File: "/"})
+		os.Remove(localFilename)
+		if err != nil {
+			return fmt.Errorf("unable to stage WAL segment %v: %v", key, err)
+		}
+	}
+
+	recovery := fmt.Sprintf("restore_command = '/bin/false'\nrecovery_target_time = '%v'\nrecovery_target_action = 'promote'\n", targetTime)
+	options.Command = []string{"sh", "-c", fmt.Sprintf("cat > %v/recovery.conf && chown gitlab-psql %v/recovery.conf", PostgresDataDir, PostgresDataDir)}
+	options.Stdin = strings.NewReader(recovery)
+	err = ExecWithOptions(options)
+	options.Stdin = nil
+	if err != nil {
+		return fmt.Errorf("unable to write recovery.conf: %v", err)
+	}
+
+	options.Command = []string{"gitlab-ctl", "start", "postgresql"}
+	err = ExecWithOptions(options)
+	if err != nil {
+		return fmt.Errorf("unable to start postgresql: %v", err)
+	}
+
+	fmt.Printf("Finished point-in-time recovery to %v; PostgreSQL is replaying WAL\n", targetTime)
+
+	return nil
+}
+
+// Ships WAL segments at the configured interval and refreshes the base
+// backup every base_backup_interval (default daily). Disabled unless
+// wal_archive_interval is set.
+func runWALArchiveController(stop <-chan struct{}) {
+	interval := operatorConfig.GetDuration(WALArchiveIntervalSetting)
+	if interval <= 0 {
+		return
+	}
+
+	baseInterval := operatorConfig.GetDuration(BaseBackupIntervalSetting)
+	if baseInterval <= 0 {
+		baseInterval = DefaultBaseBackupInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastBase time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s3Bucket := operatorConfig.GetString("s3")
+		if s3Bucket == "" {
+			continue
+		}
+
+		if time.Since(lastBase) >= baseInterval {
+			err := BaseBackup(s3Bucket)
+			if err != nil {
+				fmt.Printf("wal archive controller: %v\n", err)
+				continue
+			}
+			lastBase = time.Now()
+		}
+
+		err := ArchiveWAL(s3Bucket)
+		if err != nil {
+			fmt.Printf("wal archive controller: %v\n", err)
+		}
+	}
+}
+
+// PITRTargetTime is the --target-time flag of the pitr command.
+var PITRTargetTime string
+
+// pitrCmd represents the pitr command
+var pitrCmd = &cobra.Command{
+	Use:          "pitr",
+	Short:        "Point-in-time recovery of the bundled PostgreSQL",
+	SilenceUsage: true,
+	Long: `Restores the bundled PostgreSQL to a point in time from the newest base
+backup before the target plus the archived WAL. Requires WAL archiving to
+have been running (wal_archive_interval).`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		if PITRTargetTime == "" {
+			fmt.Println("a --target-time (RFC3339) is required")
+			ExitCode = 1
+			return
+		}
+
+		err := RestorePointInTime(operatorConfig.GetString("s3"), PITRTargetTime)
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		ExitCode = 0
+		return
+	},
+}
+
+// baseBackupCmd represents the base-backup command
+var baseBackupCmd = &cobra.Command{
+	Use:          "base-backup",
+	Short:        "Takes a PostgreSQL base backup for point-in-time recovery",
+	SilenceUsage: true,
+	Long: `Takes a physical base backup of the bundled PostgreSQL data directory and
+uploads it to the s3 bucket. Normally run by the operator on the
+base_backup_interval schedule.`,
+	PreRunE: validateArguments,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := BaseBackup(operatorConfig.GetString("s3"))
+		if err != nil {
+			fmt.Println(err)
+			ExitCode = 1
+			return
+		}
+
+		ExitCode = 0
+		return
+	},
+}
+
+func init() {
+	pitrCmd.Flags().StringVarP(&PITRTargetTime, "target-time", "t", "",
+		"RFC3339 time to recover the database to")
+	RootCmd.AddCommand(pitrCmd)
+	RootCmd.AddCommand(baseBackupCmd)
+	RegisterController(runWALArchiveController)
+}
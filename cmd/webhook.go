@@ -0,0 +1,195 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Validating admission webhook settings. The webhook server starts with
+// the operator when webhook_tls_cert and webhook_tls_key name a
+// certificate pair (typically mounted from a Secret); a
+// ValidatingWebhookConfiguration pointing at /validate then gives users
+// immediate kubectl feedback on a bad spec instead of a CR stuck in
+// Failed.
+const (
+	DefaultWebhookListenAddr = ":8443"
+	WebhookListenSetting     = "webhook_listen_addr"
+	WebhookCertSetting       = "webhook_tls_cert"
+	WebhookKeySetting        = "webhook_tls_key"
+)
+
+// Validates the spec of one of our custom resources. Returns an error
+// describing the first problem found, or nil when the spec is acceptable.
+func validateCustomResource(kind string, obj *unstructured.Unstructured) error {
+	switch kind {
+	case "GitLabRestore":
+		return validateRestoreSpec(obj)
+	case "GitLab":
+		return validateGitLabResourceSpec(obj)
+	case "Runner":
+		return validateRunnerSpec(obj)
+	}
+	return nil
+}
+
+func validateRestoreSpec(obj *unstructured.Unstructured) error {
+	s3Bucket := GetSpecString(obj, "s3")
+	if s3Bucket == "" {
+		s3Bucket = operatorConfig.GetString("s3")
+	}
+	if s3Bucket == "" {
+		return fmt.Errorf("spec.s3 is required when no bucket is configured on the operator")
+	}
+
+	// Listing the backup prefix both proves the bucket is reachable with
+	// the operator's credentials and gives us the keys to resolve the
+	// timestamp against.
+	keys, err := ListS3Objects(s3Bucket, GitLabLocalBackupPrefix)
+	if err != nil {
+		return fmt.Errorf("bucket %v is not reachable: %v", s3Bucket, err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("bucket %v contains no backups", s3Bucket)
+	}
+
+	timestamp := GetSpecString(obj, "timestamp")
+	if timestamp != "" && timestamp != "latest" {
+		wanted := GitLabLocalBackupPrefix + timestamp + CurrentCompression().Extension
+		found := false
+		for _, key := range keys {
+			if key == wanted {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("no backup with timestamp %v in bucket %v", timestamp, s3Bucket)
+		}
+	}
+
+	return nil
+}
+
+func validateGitLabResourceSpec(obj *unstructured.Unstructured) error {
+	if url := GetSpecString(obj, "externalURL"); url != "" {
+		if len(url) < 8 || (url[:7] != "http://" && url[:8] != "https://") {
+			return fmt.Errorf("spec.externalURL must start with http:// or https://")
+		}
+	}
+	return nil
+}
+
+func validateRunnerSpec(obj *unstructured.Unstructured) error {
+	if GetSpecString(obj, "gitlabURL") == "" {
+		return fmt.Errorf("spec.gitlabURL is required")
+	}
+
+	tokenSecret := GetSpecString(obj, "tokenSecret")
+	if tokenSecret == "" {
+		return fmt.Errorf("spec.tokenSecret is required")
+	}
+
+	_, clientset, err := GetInCluster()
+	if err != nil {
+		return err
+	}
+	secret, err := clientset.CoreV1().Secrets(obj.GetNamespace()).Get(tokenSecret, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("spec.tokenSecret %v is not readable: %v", tokenSecret, err)
+	}
+	if len(secret.Data["registration-token"]) == 0 {
+		return fmt.Errorf("secret %v has no registration-token key", tokenSecret)
+	}
+
+	return nil
+}
+
+// Handles an AdmissionReview POST from the apiserver and responds with an
+// allow or a deny carrying the validation error as the message.
+func validateHandler(writer http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review := admissionv1beta1.AdmissionReview{}
+	err = json.Unmarshal(body, &review)
+	if err != nil || review.Request == nil {
+		http.Error(writer, "unable to decode AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionv1beta1.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+
+	obj := &unstructured.Unstructured{}
+	err = json.Unmarshal(review.Request.Object.Raw, &obj.Object)
+	if err == nil {
+		err = validateCustomResource(review.Request.Kind.Kind, obj)
+	}
+	if err != nil {
+		fmt.Printf("denying %v %v: %v\n", review.Request.Kind.Kind, review.Request.Name, err)
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: err.Error()}
+	}
+
+	review.Response = response
+	review.Request = nil
+	data, err := json.Marshal(review)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(data)
+}
+
+// StartWebhookServer serves the validating admission webhook in the
+// background. A no-op when no TLS certificate pair is configured.
+func StartWebhookServer() {
+	cert := operatorConfig.GetString(WebhookCertSetting)
+	key := operatorConfig.GetString(WebhookKeySetting)
+	if cert == "" || key == "" {
+		return
+	}
+
+	addr := operatorConfig.GetString(WebhookListenSetting)
+	if addr == "" {
+		addr = DefaultWebhookListenAddr
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", validateHandler)
+
+	fmt.Printf("Serving validating webhook on %v\n", addr)
+	go func() {
+		err := http.ListenAndServeTLS(addr, cert, key, mux)
+		if err != nil {
+			fmt.Printf("webhook server failed: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backup windows. When backup_window is set to HH:MM-HH:MM a backup only
+// starts inside that window (start after end spans midnight, e.g.
+// 22:00-04:00); when backup_max_ci_jobs is set a backup only starts while
+// the instance is running no more than that many CI jobs. A backup that
+// arrives outside the window or during heavy CI waits, re-checking every
+// backup_window_retry, and gives up after backup_window_max_delay.
+const (
+	BackupWindowSetting         = "backup_window"
+	BackupMaxCIJobsSetting      = "backup_max_ci_jobs"
+	BackupWindowRetrySetting    = "backup_window_retry"
+	BackupWindowMaxDelaySetting = "backup_window_max_delay"
+
+	DefaultBackupWindowRetry    = 5 * time.Minute
+	DefaultBackupWindowMaxDelay = 4 * time.Hour
+)
+
+// Reports whether now falls inside the configured backup window. Always
+// true when no window is configured.
+func backupWindowOpen(now time.Time) bool {
+	window := operatorConfig.GetString(BackupWindowSetting)
+	if window == "" {
+		return true
+	}
+
+	parts := strings.SplitN(window, "-", 2)
+	if len(parts) != 2 {
+		fmt.Printf("Unable to parse backup_window %v\n", window)
+		return true
+	}
+	start, err1 := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil {
+		fmt.Printf("Unable to parse backup_window %v\n", window)
+		return true
+	}
+
+	minutes := now.Hour()*60 + now.Minute()
+	startMinutes := start.Hour()*60 + start.Minute()
+	endMinutes := end.Hour()*60 + end.Minute()
+	if startMinutes <= endMinutes {
+		return minutes >= startMinutes && minutes < endMinutes
+	}
+	// The window spans midnight.
+	return minutes >= startMinutes || minutes < endMinutes
+}
+
+// Number of CI jobs currently running on the instance, counted straight
+// from the bundled database.
+func runningCIJobs(namespace, podName string) (int, error) {
+	output, err := gitlabPSQL(namespace, podName,
+		"SELECT count(*) FROM ci_builds WHERE status = 'running'")
+	if err != nil {
+		return 0, fmt.Errorf("unable to count running CI jobs: %v", err)
+	}
+	count, err := strconv.Atoi(output)
+	if err != nil {
+		return 0, fmt.Errorf("unable to count running CI jobs: unexpected output %q", output)
+	}
+	return count, nil
+}
+
+// Why a backup cannot start right now, or "" when it can.
+func backupDeferralReason(namespace, podName string) string {
+	if !backupWindowOpen(time.Now()) {
+		return fmt.Sprintf("outside the %v backup window", operatorConfig.GetString(BackupWindowSetting))
+	}
+
+	maxJobs := operatorConfig.GetInt(BackupMaxCIJobsSetting)
+	if maxJobs <= 0 {
+		return ""
+	}
+
+	jobs, err := runningCIJobs(namespace, podName)
+	if err != nil {
+		// The probe failing should not block backups.
+		fmt.Printf("%v\n", err)
+		return ""
+	}
+	if jobs > maxJobs {
+		return fmt.Sprintf("%v CI jobs running, above the %v limit", jobs, maxJobs)
+	}
+
+	return ""
+}
+
+// waitForBackupWindow blocks until the backup window is open and the
+// instance is quiet enough, re-checking every backup_window_retry. Gives
+// up with an error once the backup has been deferred for
+// backup_window_max_delay.
+func waitForBackupWindow(namespace, podName string) error {
+	retry := operatorConfig.GetDuration(BackupWindowRetrySetting)
+	if retry <= 0 {
+		retry = DefaultBackupWindowRetry
+	}
+	maxDelay := operatorConfig.GetDuration(BackupWindowMaxDelaySetting)
+	if maxDelay <= 0 {
+		maxDelay = DefaultBackupWindowMaxDelay
+	}
+
+	deadline := time.Now().Add(maxDelay)
+	for {
+		reason := backupDeferralReason(namespace, podName)
+		if reason == "" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("backup deferred for %v and still %v; giving up", maxDelay, reason)
+		}
+		fmt.Printf("Deferring backup: %v; retrying in %v\n", reason, retry)
+		time.Sleep(retry)
+	}
+}
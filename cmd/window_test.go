@@ -0,0 +1,57 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackupWindowOpen(t *testing.T) {
+	defer operatorConfig.Set(BackupWindowSetting, "")
+
+	at := func(clock string) time.Time {
+		parsed, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatalf("time.Parse: %v", err)
+		}
+		return parsed
+	}
+
+	operatorConfig.Set(BackupWindowSetting, "")
+	if !backupWindowOpen(at("12:00")) {
+		t.Error("expected the window to be open when none is configured")
+	}
+
+	operatorConfig.Set(BackupWindowSetting, "01:00-05:00")
+	if !backupWindowOpen(at("03:00")) {
+		t.Error("expected 03:00 to be inside 01:00-05:00")
+	}
+	if backupWindowOpen(at("12:00")) {
+		t.Error("expected 12:00 to be outside 01:00-05:00")
+	}
+
+	// Windows may span midnight.
+	operatorConfig.Set(BackupWindowSetting, "22:00-04:00")
+	if !backupWindowOpen(at("23:30")) {
+		t.Error("expected 23:30 to be inside 22:00-04:00")
+	}
+	if !backupWindowOpen(at("02:00")) {
+		t.Error("expected 02:00 to be inside 22:00-04:00")
+	}
+	if backupWindowOpen(at("12:00")) {
+		t.Error("expected 12:00 to be outside 22:00-04:00")
+	}
+}